@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/tamalsaha/gdoc-expiring-link/scheduler"
+)
+
+func (s *Server) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.opts.AdminToken == "" {
+			http.Error(w, "admin api is disabled", http.StatusForbidden)
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.opts.AdminToken)) != 1 {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// admin serves
+//
+//	GET  /admin/dead-letters
+//	POST /admin/dead-letters/<id>/replay
+//	GET  /admin/tests/<configDocId>/answers
+//	GET  /admin/tests/<configDocId>/attempts?email=<email>
+//	POST /admin/tests/<configDocId>/reconcile
+//	POST /admin/tests/<configDocId>/validate
+//	POST /admin/tests/<configDocId>/pause?email=<email>&reason=<reason>
+//	POST /admin/tests/<configDocId>/resume?email=<email>
+//	POST /admin/tests/<configDocId>/extend?by=<duration>&email=<email>&reason=<reason>&dryRun=<bool>
+//	POST /admin/tests/<configDocId>/reopen?email=<email>&for=<duration>&reason=<reason>
+//	POST /admin/tests/<configDocId>/grade?email=<email>&grade=<grade>
+//	POST /admin/cache/invalidate?configDocId=<configDocId>
+//	GET  /admin/webhooks
+//	POST /admin/webhooks
+//	DELETE /admin/webhooks/<id>
+//	GET  /admin/webhooks/<id>/deliveries
+func (s *Server) admin(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/"), "/"), "/")
+
+	switch {
+	case len(parts) == 1 && parts[0] == "dead-letters" && r.Method == http.MethodGet:
+		jobs, err := s.sched.DeadLetters()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, jobs)
+	case len(parts) == 3 && parts[0] == "dead-letters" && parts[2] == "replay" && r.Method == http.MethodPost:
+		err := s.sched.Replay(parts[1])
+		if err == scheduler.ErrJobNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 3 && parts[0] == "tests" && parts[2] == "answers" && r.Method == http.MethodGet:
+		ts, err := LoadTestSheet(s.svcSheets, parts[1])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		type row struct {
+			Row         int        `json:"row"`
+			Answer      TestAnswer `json:"answer"`
+			Error       string     `json:"error,omitempty"`
+			DuplicateOf int        `json:"duplicateOf,omitempty"`
+		}
+		rows := make([]row, 0, len(ts.Rows))
+		for _, r := range ts.Rows {
+			out := row{Row: r.Row, Answer: r.Answer, DuplicateOf: r.DuplicateOf}
+			if r.Err != nil {
+				out.Error = r.Err.Error()
+			}
+			rows = append(rows, out)
+		}
+		writeJSON(w, rows)
+	case len(parts) == 3 && parts[0] == "tests" && parts[2] == "attempts" && r.Method == http.MethodGet:
+		history, err := LoadTestAnswers(s.svcSheets, parts[1], r.FormValue("email"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, history)
+	case len(parts) == 3 && parts[0] == "tests" && parts[2] == "reconcile" && r.Method == http.MethodPost:
+		if err := s.Reconcile(parts[1]); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 3 && parts[0] == "tests" && parts[2] == "validate" && r.Method == http.MethodPost:
+		s.validate(w, parts[1])
+	case len(parts) == 3 && parts[0] == "tests" && (parts[2] == "pause" || parts[2] == "resume") && r.Method == http.MethodPost:
+		s.clock(w, r, parts[1], parts[2])
+	case len(parts) == 3 && parts[0] == "tests" && parts[2] == "extend" && r.Method == http.MethodPost:
+		s.extend(w, r, parts[1])
+	case len(parts) == 3 && parts[0] == "tests" && parts[2] == "reopen" && r.Method == http.MethodPost:
+		s.reopen(w, r, parts[1])
+	case len(parts) == 3 && parts[0] == "tests" && parts[2] == "grade" && r.Method == http.MethodPost:
+		s.grade(w, r, parts[1])
+	case parts[0] == "webhooks":
+		s.webhooks(w, r, parts)
+	case len(parts) == 2 && parts[0] == "cache" && parts[1] == "invalidate" && r.Method == http.MethodPost:
+		n := InvalidateCaches(r.FormValue("configDocId"))
+		writeJSON(w, map[string]int{"invalidated": n})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Printf("failed to write response: %v", err)
+	}
+}
+
+// AdminClient calls the /admin/ api of a running server.
+type AdminClient struct {
+	Server string
+	Token  string
+}
+
+func (c *AdminClient) Do(method, p string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = strings.NewReader(string(data))
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(c.Server, "/")+"/admin/"+p, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		msg, _ := io.ReadAll(resp.Body)
+		return errors.Errorf("%s %s: %s: %s", method, p, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+func adminFlags(fs *flag.FlagSet) *AdminClient {
+	c := &AdminClient{}
+	fs.StringVar(&c.Server, "server", "http://localhost:8080", "Address of the running server")
+	fs.StringVar(&c.Token, "admin-token", os.Getenv("GDOC_ADMIN_TOKEN"), "Bearer token of the admin api")
+	return c
+}
+
+// subcommand splits the action, eg, list in `dead-letters list --server=...`,
+// from the flags that follow it.
+func subcommand(args []string) (string, []string) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return "", args
+	}
+	return args[0], args[1:]
+}
+
+// runDeadLetters implements
+//
+//	dead-letters list
+//	dead-letters replay <id>...
+func runDeadLetters(args []string) {
+	fs := flag.NewFlagSet("dead-letters", flag.ExitOnError)
+	c := adminFlags(fs)
+	action, args := subcommand(args)
+	_ = fs.Parse(args)
+
+	switch action {
+	case "list":
+		var jobs []*scheduler.Job
+		handleError(c.Do(http.MethodGet, "dead-letters", nil, &jobs), "Error listing dead letters")
+		for _, job := range jobs {
+			fmt.Printf("%s\t%s\t%s\tattempts=%d\t%s\n", job.ID, job.Type, job.Key, job.Attempts, job.LastError)
+		}
+	case "replay":
+		if fs.NArg() < 1 {
+			log.Fatal("usage: dead-letters replay <id>...")
+		}
+		for _, id := range fs.Args() {
+			handleError(c.Do(http.MethodPost, "dead-letters/"+id+"/replay", nil, nil), "Error replaying "+id)
+			fmt.Printf("replayed %s\n", id)
+		}
+	default:
+		log.Fatal("usage: dead-letters list|replay <id>...")
+	}
+}
+
+// runCache implements
+//
+//	cache invalidate [--config-doc-id=<id>]
+func runCache(args []string) {
+	fs := flag.NewFlagSet("cache", flag.ExitOnError)
+	c := adminFlags(fs)
+	configDocId := fs.String("config-doc-id", "", "Only invalidate the cached entries of this test")
+	action, args := subcommand(args)
+	_ = fs.Parse(args)
+
+	switch action {
+	case "invalidate":
+		var resp map[string]int
+		p := "cache/invalidate?configDocId=" + url.QueryEscape(*configDocId)
+		handleError(c.Do(http.MethodPost, p, nil, &resp), "Error invalidating cache")
+		fmt.Printf("invalidated %d entries\n", resp["invalidated"])
+	default:
+		log.Fatal("usage: cache invalidate [--config-doc-id=<id>]")
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"github.com/gocarina/gocsv"
+	csvtypes "gomodules.xyz/encoding/csv/types"
+	gdrive "gomodules.xyz/gdrive-utils"
+	"google.golang.org/api/sheets/v4"
+)
+
+const ProjectAuditSheet = "audit"
+
+const (
+	// AuditEventPermissionRemoved is recorded when a permission the candidate
+	// added to their test doc is removed, a possible integrity issue.
+	AuditEventPermissionRemoved = "PermissionRemoved"
+	// AuditEventPaused and AuditEventResumed record the intervals the clock
+	// of a candidate was paused for.
+	AuditEventPaused  = "Paused"
+	AuditEventResumed = "Resumed"
+	// AuditEventExtended is recorded when the end of a candidate's test is
+	// moved by an extension.
+	AuditEventExtended = "Extended"
+	// AuditEventReopened is recorded when a candidate is given access again
+	// after their test ended.
+	AuditEventReopened = "Reopened"
+	// AuditEventGraded is recorded when a reviewer grades a candidate's test.
+	AuditEventGraded = "Graded"
+)
+
+type AuditEvent struct {
+	Time    csvtypes.Timestamp `json:"time" csv:"Time"`
+	Email   string             `json:"email" csv:"Email"`
+	Event   string             `json:"event" csv:"Event"`
+	Details string             `json:"details" csv:"Details"`
+}
+
+// SaveAuditEvent appends ev to the audit sheet of the project.
+func SaveAuditEvent(svcSheets *sheets.Service, configDocId string, ev AuditEvent) error {
+	w := gdrive.NewWriter(svcSheets, configDocId, ProjectAuditSheet)
+	data := []*AuditEvent{
+		&ev,
+	}
+	return gocsv.MarshalCSV(data, w)
+}
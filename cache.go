@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Cache is an in-memory cache with a fixed TTL, optionally backed by leveldb
+// so entries survive a restart. A Cache with a TTL <= 0 never returns a hit.
+type Cache struct {
+	name string
+	ttl  time.Duration
+	db   *leveldb.DB
+
+	mu    sync.RWMutex
+	items map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	Value   json.RawMessage `json:"value"`
+	Expires time.Time       `json:"expires"`
+}
+
+var cacheRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "gdoc_cache_requests_total",
+	Help: "Number of cache lookups, by cache and result.",
+}, []string{"cache", "result"})
+
+func init() {
+	prometheus.MustRegister(cacheRequestsTotal)
+}
+
+// Caches for the lookups on the start path. They are disabled until
+// configureCaches is called.
+var (
+	folderCache = NewCache("folder", 0, nil)
+	configCache = NewCache("config", 0, nil)
+)
+
+func configureCaches(ttl time.Duration, db *leveldb.DB) {
+	folderCache = NewCache("folder", ttl, db)
+	configCache = NewCache("config", ttl, db)
+}
+
+// InvalidateCaches drops every cached entry of the test, or of all tests if
+// configDocId is empty, and returns the number of entries dropped.
+func InvalidateCaches(configDocId string) int {
+	return folderCache.Invalidate(configDocId) + configCache.Invalidate(configDocId)
+}
+
+func NewCache(name string, ttl time.Duration, db *leveldb.DB) *Cache {
+	return &Cache{
+		name:  name,
+		ttl:   ttl,
+		db:    db,
+		items: map[string]cacheEntry{},
+	}
+}
+
+func (c *Cache) dbKey(key string) []byte {
+	return []byte("cache/" + c.name + "/" + key)
+}
+
+// Get decodes the entry of key into v and reports whether it was found.
+func (c *Cache) Get(key string, v interface{}) bool {
+	if c.ttl <= 0 {
+		return false
+	}
+
+	c.mu.RLock()
+	e, ok := c.items[key]
+	c.mu.RUnlock()
+	if !ok && c.db != nil {
+		if data, err := c.db.Get(c.dbKey(key), nil); err == nil && json.Unmarshal(data, &e) == nil {
+			ok = true
+			c.mu.Lock()
+			c.items[key] = e
+			c.mu.Unlock()
+		}
+	}
+	if ok && time.Now().After(e.Expires) {
+		c.delete(key)
+		ok = false
+	}
+	if ok && json.Unmarshal(e.Value, v) != nil {
+		ok = false
+	}
+
+	result := "miss"
+	if ok {
+		result = "hit"
+	}
+	cacheRequestsTotal.WithLabelValues(c.name, result).Inc()
+	return ok
+}
+
+func (c *Cache) Set(key string, v interface{}) {
+	if c.ttl <= 0 {
+		return
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	e := cacheEntry{Value: data, Expires: time.Now().Add(c.ttl)}
+
+	c.mu.Lock()
+	c.items[key] = e
+	c.mu.Unlock()
+	if c.db != nil {
+		if data, err := json.Marshal(e); err == nil {
+			_ = c.db.Put(c.dbKey(key), data, nil)
+		}
+	}
+}
+
+func (c *Cache) delete(key string) {
+	c.mu.Lock()
+	delete(c.items, key)
+	c.mu.Unlock()
+	if c.db != nil {
+		_ = c.db.Delete(c.dbKey(key), nil)
+	}
+}
+
+// cacheKeySep separates the id a key belongs to from the rest of the key,
+// eg, the folders of a folder id.
+const cacheKeySep = "\x00"
+
+// belongsTo reports whether key is id, or id followed by cacheKeySep. Every key
+// belongs to the empty id.
+func belongsTo(key, id string) bool {
+	return id == "" || key == id || strings.HasPrefix(key, id+cacheKeySep)
+}
+
+// Invalidate drops the entries of id, ie, the entry of key id and the ones
+// whose key is id followed by cacheKeySep, or all entries if id is empty. It
+// returns the number of entries dropped, counting an entry both in memory and
+// in leveldb once.
+func (c *Cache) Invalidate(id string) int {
+	dropped := map[string]bool{}
+	c.mu.Lock()
+	for key := range c.items {
+		if belongsTo(key, id) {
+			delete(c.items, key)
+			dropped[key] = true
+		}
+	}
+	c.mu.Unlock()
+	n := len(dropped)
+
+	if c.db != nil {
+		prefix := c.dbKey("")
+		batch := new(leveldb.Batch)
+		iter := c.db.NewIterator(util.BytesPrefix(c.dbKey(id)), nil)
+		for iter.Next() {
+			key := string(iter.Key()[len(prefix):])
+			if belongsTo(key, id) {
+				batch.Delete(append([]byte{}, iter.Key()...))
+				// entries not loaded since a restart are only in leveldb
+				if !dropped[key] {
+					n++
+				}
+			}
+		}
+		iter.Release()
+		_ = c.db.Write(batch, nil)
+	}
+	return n
+}
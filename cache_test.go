@@ -0,0 +1,87 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+func openCacheDB(t *testing.T) *leveldb.DB {
+	db, err := leveldb.OpenFile(filepath.Join(t.TempDir(), "cache"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestCacheTTL(t *testing.T) {
+	db := openCacheDB(t)
+	c := NewCache("test", 20*time.Millisecond, db)
+	c.Set("abc", "folder")
+	var v string
+	if !c.Get("abc", &v) || v != "folder" {
+		t.Fatalf("got %q, want a hit", v)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if c.Get("abc", &v) {
+		t.Error("expired entry returned")
+	}
+	if _, err := db.Get(c.dbKey("abc"), nil); err != leveldb.ErrNotFound {
+		t.Errorf("expired entry kept in leveldb: %v", err)
+	}
+
+	disabled := NewCache("test", 0, nil)
+	disabled.Set("abc", "folder")
+	if disabled.Get("abc", &v) {
+		t.Error("a cache without a TTL returned a hit")
+	}
+}
+
+func TestCachePersistence(t *testing.T) {
+	db := openCacheDB(t)
+	NewCache("test", time.Hour, db).Set("abc", QuestionConfig{PoolSize: 3})
+
+	// eg, after a restart
+	var cfg QuestionConfig
+	if !NewCache("test", time.Hour, db).Get("abc", &cfg) || cfg.PoolSize != 3 {
+		t.Errorf("got %+v, want the persisted entry", cfg)
+	}
+	if NewCache("other", time.Hour, db).Get("abc", &cfg) {
+		t.Error("entry of another cache returned")
+	}
+}
+
+func TestCacheInvalidate(t *testing.T) {
+	for name, db := range map[string]*leveldb.DB{"memory": nil, "leveldb": openCacheDB(t)} {
+		c := NewCache("test", time.Hour, db)
+		for _, key := range []string{"abc", "abc" + cacheKeySep + "candidates", "abcd", "abcd" + cacheKeySep + "candidates", "xyz"} {
+			c.Set(key, key)
+		}
+		if n := c.Invalidate("abc"); n != 2 {
+			t.Errorf("%s: dropped %d entries, want 2", name, n)
+		}
+		var v string
+		for key, want := range map[string]bool{"abc": false, "abc" + cacheKeySep + "candidates": false, "abcd": true, "abcd" + cacheKeySep + "candidates": true, "xyz": true} {
+			if got := c.Get(key, &v); got != want {
+				t.Errorf("%s: Get(%q) = %v, want %v", name, key, got, want)
+			}
+		}
+		if n := c.Invalidate(""); n != 3 {
+			t.Errorf("%s: dropped %d entries, want all 3 left", name, n)
+		}
+	}
+
+	// after a restart, entries are only in leveldb until they are read, and
+	// an entry whose write to leveldb failed is only in memory
+	db := openCacheDB(t)
+	NewCache("test", time.Hour, db).Set("abc", "abc")
+	c := NewCache("test", time.Hour, db)
+	c.Set("abc"+cacheKeySep+"candidates", "candidates")
+	c.items["abc"+cacheKeySep+"memory"] = c.items["abc"+cacheKeySep+"candidates"]
+	if n := c.Invalidate("abc"); n != 3 {
+		t.Errorf("dropped %d entries, want 3", n)
+	}
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// countdownHeartbeat is how often the countdown page is sent the time
+	// left.
+	countdownHeartbeat = 15 * time.Second
+	// countdownRefresh is how often the test sheet of a test with candidates
+	// watching the countdown is read again, to pick up manual edits. The
+	// streams of a test share one snapshot of the sheet.
+	countdownRefresh = time.Minute
+)
+
+// defaultCountdownWarnings are how long before the end of a test the
+// countdown page warns the candidate, unless the test sets its own.
+var defaultCountdownWarnings = DurationList{10 * time.Minute, 5 * time.Minute, time.Minute}
+
+// States of a candidate's test shown on the countdown page.
+const (
+	TestStateRunning   = "running"
+	TestStatePaused    = "paused"
+	TestStateSubmitted = "submitted"
+	TestStateExpired   = "expired"
+)
+
+// DurationList is a comma separated list of durations in a sheet, eg,
+// 10m, 5m, 1m.
+type DurationList []time.Duration
+
+func (l *DurationList) MarshalCSV() (string, error) {
+	parts := make([]string, 0, len(*l))
+	for _, d := range *l {
+		parts = append(parts, d.String())
+	}
+	return strings.Join(parts, ", "), nil
+}
+
+func (l *DurationList) UnmarshalCSV(csv string) error {
+	*l = nil
+	for _, part := range strings.Split(csv, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		d, err := time.ParseDuration(part)
+		if err != nil {
+			return errors.Errorf("invalid duration %q in %q, expected eg 10m, 5m, 1m", part, csv)
+		}
+		*l = append(*l, d)
+	}
+	return nil
+}
+
+// CountdownWarnings returns how long before the end of the test the
+// countdown page warns the candidate, longest first.
+func (cfg QuestionConfig) CountdownWarnings() []time.Duration {
+	warnings := append([]time.Duration(nil), cfg.Warnings...)
+	if len(warnings) == 0 {
+		warnings = append(warnings, defaultCountdownWarnings...)
+	}
+	sort.Slice(warnings, func(i, j int) bool { return warnings[i] > warnings[j] })
+	return warnings
+}
+
+// TestStatus is the state of a candidate's test as sent to the countdown
+// page. Left is the time left in seconds, it does not run down while the
+// test is paused.
+type TestStatus struct {
+	State   string    `json:"state"`
+	Now     time.Time `json:"now"`
+	EndDate time.Time `json:"endDate"`
+	Left    float64   `json:"left"`
+}
+
+// statusOf returns the status of the test of ans at now.
+func statusOf(ans TestAnswer, now time.Time) TestStatus {
+	st := TestStatus{Now: now, EndDate: ans.EndDate.Time}
+	switch {
+	case !ans.SubmittedAt.IsZero():
+		st.State = TestStateSubmitted
+	case !ans.PausedAt.IsZero():
+		st.State = TestStatePaused
+		st.Left = ans.EndDate.Sub(ans.PausedAt.Time).Seconds()
+	case now.Before(ans.EndDate.Time):
+		st.State = TestStateRunning
+		st.Left = ans.EndDate.Sub(now).Seconds()
+	default:
+		st.State = TestStateExpired
+	}
+	if st.Left < 0 {
+		st.Left = 0
+	}
+	return st
+}
+
+// testStatus returns the status of the latest attempt of email, from the
+// snapshot of the test sheet shared by the countdown pages of the test. It
+// returns io.EOF if email has not started the test.
+func (s *Server) testStatus(configDocId, email string) (*TestAnswer, *TestStatus, error) {
+	ans, err := s.hub.answer(configDocId, email, countdownRefresh, func() (map[string]TestAnswer, error) {
+		ts, err := LoadTestSheet(s.svcSheets, configDocId)
+		if err != nil {
+			return nil, err
+		}
+		answers := map[string]TestAnswer{}
+		for _, row := range ts.LatestRows() {
+			answers[row.Answer.Email] = row.Answer
+		}
+		return answers, nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	st := statusOf(*ans, time.Now())
+	return ans, &st, nil
+}
+
+// statusHub tells the countdown pages of a candidate that their test
+// changed. Subscribers are keyed by jobKey. It also keeps the snapshot of the
+// test sheet of every test the pages read their status from, so the sheet is
+// read once per test instead of once per page.
+type statusHub struct {
+	mu        sync.Mutex
+	subs      map[string]map[chan string]bool
+	snapshots map[string]*testSnapshot
+}
+
+// testSnapshot is the latest attempt of every candidate of a test, as read
+// from the test sheet at loaded.
+type testSnapshot struct {
+	mu      sync.Mutex
+	loaded  time.Time
+	answers map[string]TestAnswer
+}
+
+func newStatusHub() *statusHub {
+	return &statusHub{
+		subs:      map[string]map[chan string]bool{},
+		snapshots: map[string]*testSnapshot{},
+	}
+}
+
+// answer returns the latest attempt of email in the test. The snapshot of the
+// test is read again with load if it is older than maxAge, or if email is not
+// in it, eg, right after they started. It returns io.EOF if email has not
+// started the test.
+func (h *statusHub) answer(configDocId, email string, maxAge time.Duration, load func() (map[string]TestAnswer, error)) (*TestAnswer, error) {
+	h.mu.Lock()
+	snap := h.snapshots[configDocId]
+	if snap == nil {
+		snap = &testSnapshot{}
+		h.snapshots[configDocId] = snap
+	}
+	h.mu.Unlock()
+
+	snap.mu.Lock()
+	defer snap.mu.Unlock()
+	ans, ok := snap.answers[email]
+	if !ok || time.Since(snap.loaded) >= maxAge {
+		answers, err := load()
+		if err != nil {
+			return nil, err
+		}
+		snap.answers, snap.loaded = answers, time.Now()
+		if ans, ok = answers[email]; !ok {
+			return nil, io.EOF
+		}
+	}
+	return &ans, nil
+}
+
+// subscribe returns a channel receiving the changes of key, and a func to
+// stop receiving them.
+func (h *statusHub) subscribe(key string) (<-chan string, func()) {
+	ch := make(chan string, 1)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs[key] == nil {
+		h.subs[key] = map[chan string]bool{}
+	}
+	h.subs[key][ch] = true
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.subs[key], ch)
+		if len(h.subs[key]) == 0 {
+			delete(h.subs, key)
+		}
+	}
+}
+
+// notify tells the subscribers of key that the test changed. state is the
+// new state if it is known, eg, expired when access was just revoked, else
+// the subscribers read the test again. The snapshot of the test is dropped,
+// so the change is read from the sheet.
+func (h *statusHub) notify(key, state string) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	configDocId, _ := splitJobKey(key)
+	delete(h.snapshots, configDocId)
+	for ch := range h.subs[key] {
+		next := state
+		select {
+		case pending := <-ch:
+			// a change is already pending, keep its state if this one is unknown
+			if next == "" {
+				next = pending
+			}
+		default:
+		}
+		// notify is the only sender and ch is empty now
+		ch <- next
+	}
+}
+
+// streamStatus writes the status of a test as server-sent events until done
+// is closed: right away, on every heartbeat and whenever the test changes.
+// Heartbeats only count down the time left. The status is read with load
+// again on changes and every refresh.
+func streamStatus(w io.Writer, flush func(), done <-chan struct{}, changes <-chan string, heartbeat, refresh time.Duration, load func() (*TestStatus, error)) error {
+	ticker := time.NewTicker(heartbeat)
+	defer ticker.Stop()
+
+	var st *TestStatus
+	var loaded time.Time
+	reload := true
+	for {
+		now := time.Now()
+		if reload || now.Sub(loaded) >= refresh {
+			next, err := load()
+			if err != nil {
+				return err
+			}
+			st, loaded, reload = next, now, false
+		}
+		if st.State == TestStateRunning {
+			st.Left = st.EndDate.Sub(now).Seconds()
+			if st.Left < 0 {
+				st.Left = 0
+			}
+		}
+		st.Now = now
+		data, err := json.Marshal(st)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "event: status\ndata: %s\n\n", data); err != nil {
+			return err
+		}
+		flush()
+
+		select {
+		case <-done:
+			return nil
+		case <-ticker.C:
+		case state := <-changes:
+			if state == TestStateSubmitted || state == TestStateExpired {
+				st.State, st.Left = state, 0
+			} else {
+				reload = true
+			}
+		}
+	}
+}
+
+// events serves GET /tests/<configDocId>/events
+//
+// It streams the status of the candidate's test to the countdown page as
+// server-sent events.
+func (s *Server) events(w http.ResponseWriter, r *http.Request, configDocId string) {
+	sess, ok := s.session(r, configDocId)
+	if !ok {
+		http.Error(w, "verify your email first", http.StatusUnauthorized)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	changes, cancel := s.hub.subscribe(jobKey(configDocId, sess.Email))
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no")
+	err := streamStatus(w, flusher.Flush, r.Context().Done(), changes, countdownHeartbeat, countdownRefresh, func() (*TestStatus, error) {
+		_, st, err := s.testStatus(configDocId, sess.Email)
+		return st, err
+	})
+	if err != nil && r.Context().Err() == nil {
+		log.Printf("failed to stream the status of %s in test %s: %v", sess.Email, configDocId, err)
+	}
+}
+
+// countdownPage is the data of the countdown page of a candidate's test.
+type countdownPage struct {
+	ConfigDocId string
+	DocURL      string
+	Ends        string
+	Status      *TestStatus
+	// Warnings are how many seconds before the end the candidate is warned.
+	Warnings []float64
+	CSRF     string
+}
+
+var countdownTemplate = template.Must(template.New("countdown").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>Your test</title>
+</head>
+<body>
+<h1>Your test</h1>
+<p id="countdown" aria-live="polite"></p>
+<p id="warning" role="alert" hidden></p>
+<div id="running">
+<p>Your test ends at {{.Ends}}.</p>
+<p><a href="{{.DocURL}}" target="_blank" rel="noopener">Open the test doc</a></p>
+<form method="post" action="/tests/{{.ConfigDocId}}/submit" onsubmit="return confirm('Submit the test? You will lose access to the doc.')">
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+<button>Submit the test</button>
+</form>
+</div>
+<script>
+(() => {
+  const warnings = {{.Warnings}};
+  const messages = {
+    paused: "Your test is paused. The clock restarts when it is resumed.",
+    submitted: "Test submitted, access to the doc was revoked.",
+    expired: "Time's up, access to the doc was revoked.",
+  };
+  const countdown = document.getElementById("countdown");
+  const warning = document.getElementById("warning");
+  const running = document.getElementById("running");
+  let status = {{.Status}};
+  let received = performance.now();
+  let warned = warnings.filter(w => status.left <= w);
+
+  function render() {
+    let left = status.left;
+    if (status.state === "running") {
+      left = Math.max(0, left - (performance.now() - received) / 1000);
+    }
+    running.hidden = status.state === "submitted" || status.state === "expired";
+    if (messages[status.state]) {
+      countdown.textContent = messages[status.state];
+      if (status.state !== "paused") warning.hidden = true;
+      return;
+    }
+    if (left <= 0) {
+      countdown.textContent = "Time's up, revoking access to the doc.";
+      return;
+    }
+    const s = Math.floor(left);
+    const hms = [Math.floor(s / 3600), Math.floor(s / 60) % 60, s % 60].map(n => String(n).padStart(2, "0")).join(":");
+    countdown.textContent = hms + " left";
+    for (const w of warnings) {
+      if (left <= w && !warned.includes(w)) {
+        warned.push(w);
+        warning.textContent = "Only " + Math.round(w / 60) + " minute" + (w >= 120 ? "s" : "") + " left, make sure your answers are in the doc.";
+        warning.hidden = false;
+      }
+    }
+  }
+
+  const events = new EventSource("/tests/{{.ConfigDocId}}/events");
+  events.addEventListener("status", e => {
+    status = JSON.parse(e.data);
+    received = performance.now();
+    render();
+    if (status.state === "submitted" || status.state === "expired") events.close();
+  });
+  setInterval(render, 1000);
+  render();
+})();
+</script>
+</body>
+</html>
+`))
+
+// countdown serves GET /tests/<configDocId>/test
+//
+// It shows the candidate a link to their doc and the time left, kept in sync
+// with the server by the events stream.
+func (s *Server) countdown(w http.ResponseWriter, r *http.Request, configDocId string) {
+	sess, ok := s.session(r, configDocId)
+	if !ok {
+		http.Redirect(w, r, "/tests/"+configDocId, http.StatusSeeOther)
+		return
+	}
+	cfg, err := LoadConfig(s.svcSheets, configDocId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	ans, st, err := s.testStatus(configDocId, sess.Email)
+	if err == io.EOF {
+		http.Redirect(w, r, "/tests/"+configDocId, http.StatusSeeOther)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	page := countdownPage{
+		ConfigDocId: configDocId,
+		DocURL:      fmt.Sprintf("https://docs.google.com/document/d/%s/edit", ans.DocId),
+		Ends:        formatTime(ans.EndDate.Time, ans.Location()),
+		Status:      st,
+		CSRF:        s.csrfToken(sess),
+	}
+	for _, d := range cfg.CountdownWarnings() {
+		page.Warnings = append(page.Warnings, d.Seconds())
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := countdownTemplate.Execute(w, page); err != nil {
+		log.Printf("failed to render the countdown of %s in test %s: %v", sess.Email, configDocId, err)
+	}
+}
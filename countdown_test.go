@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	csvtypes "gomodules.xyz/encoding/csv/types"
+)
+
+func TestStatusOf(t *testing.T) {
+	now := time.Date(2022, 6, 1, 9, 0, 0, 0, time.UTC)
+	end := now.Add(30 * time.Minute)
+	for name, tc := range map[string]struct {
+		ans   TestAnswer
+		state string
+		left  time.Duration
+	}{
+		"running":   {TestAnswer{EndDate: csvtypes.Timestamp{Time: end}}, TestStateRunning, 30 * time.Minute},
+		"paused":    {TestAnswer{EndDate: csvtypes.Timestamp{Time: end}, PausedAt: OptionalTimestamp{Time: now.Add(-time.Hour)}}, TestStatePaused, 90 * time.Minute},
+		"submitted": {TestAnswer{EndDate: csvtypes.Timestamp{Time: end}, SubmittedAt: OptionalTimestamp{Time: now}}, TestStateSubmitted, 0},
+		"expired":   {TestAnswer{EndDate: csvtypes.Timestamp{Time: now.Add(-time.Minute)}}, TestStateExpired, 0},
+	} {
+		st := statusOf(tc.ans, now)
+		if st.State != tc.state || st.Left != tc.left.Seconds() {
+			t.Errorf("%s: got %s with %vs left, want %s with %s left", name, st.State, st.Left, tc.state, tc.left)
+		}
+	}
+}
+
+func TestCountdownWarnings(t *testing.T) {
+	var cfg QuestionConfig
+	if got := cfg.CountdownWarnings(); !reflect.DeepEqual(got, []time.Duration(defaultCountdownWarnings)) {
+		t.Errorf("default: got %v", got)
+	}
+	if err := cfg.Warnings.UnmarshalCSV("1m, 15m,"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cfg.CountdownWarnings(), []time.Duration{15 * time.Minute, time.Minute}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if err := cfg.Warnings.UnmarshalCSV("1m, soon"); err == nil {
+		t.Error("invalid duration accepted")
+	}
+}
+
+func TestStatusHub(t *testing.T) {
+	h := newStatusHub()
+	ch, cancel := h.subscribe("k")
+	h.notify("other", "")
+	h.notify("k", TestStateExpired)
+	h.notify("k", "")
+	if got := <-ch; got != TestStateExpired {
+		t.Errorf("got %q, want the pending final state %q", got, TestStateExpired)
+	}
+	cancel()
+	h.notify("k", "")
+	if len(h.subs) != 0 {
+		t.Errorf("subscribers left: %v", h.subs)
+	}
+	var nilHub *statusHub
+	nilHub.notify("k", "")
+}
+
+func TestStatusHubSnapshot(t *testing.T) {
+	h := newStatusHub()
+	loads := 0
+	load := func() (map[string]TestAnswer, error) {
+		loads++
+		return map[string]TestAnswer{"a@b.c": {Email: "a@b.c", Attempt: loads}}, nil
+	}
+	for _, email := range []string{"a@b.c", "a@b.c"} {
+		if ans, err := h.answer("config", email, time.Hour, load); err != nil || ans.Attempt != 1 {
+			t.Fatalf("got %+v, %v", ans, err)
+		}
+	}
+	if loads != 1 {
+		t.Errorf("the snapshot was read %d times, want once", loads)
+	}
+	// a candidate missing from the snapshot may have just started
+	if _, err := h.answer("config", "d@e.f", time.Hour, load); err != io.EOF || loads != 2 {
+		t.Errorf("got %v after %d loads, want io.EOF after 2", err, loads)
+	}
+	h.notify(jobKey("other", "a@b.c"), "")
+	if ans, _ := h.answer("config", "a@b.c", time.Hour, load); ans.Attempt != 2 {
+		t.Errorf("a change of another test dropped the snapshot")
+	}
+	h.notify(jobKey("config", "a@b.c"), "")
+	if ans, _ := h.answer("config", "a@b.c", time.Hour, load); ans.Attempt != 3 {
+		t.Errorf("the snapshot was not read again after a change")
+	}
+	if ans, _ := h.answer("config", "a@b.c", 0, load); ans.Attempt != 4 {
+		t.Errorf("the snapshot was not read again once it was too old")
+	}
+}
+
+func TestStreamStatus(t *testing.T) {
+	end := time.Now().Add(time.Hour)
+	loads := 0
+	load := func() (*TestStatus, error) {
+		loads++
+		return &TestStatus{State: TestStateRunning, EndDate: end}, nil
+	}
+	r, w := io.Pipe()
+	done := make(chan struct{})
+	changes := make(chan string)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- streamStatus(w, func() {}, done, changes, time.Hour, time.Hour, load)
+		w.Close()
+	}()
+
+	br := bufio.NewReader(r)
+	next := func() TestStatus {
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data := strings.TrimPrefix(line, "data: "); data != line {
+				var st TestStatus
+				if err := json.Unmarshal([]byte(data), &st); err != nil {
+					t.Fatal(err)
+				}
+				return st
+			}
+		}
+	}
+
+	if st := next(); st.State != TestStateRunning || st.Left <= 0 || st.Left > time.Hour.Seconds() {
+		t.Errorf("first event: got %+v", st)
+	}
+	changes <- ""
+	if st := next(); st.State != TestStateRunning || loads != 2 {
+		t.Errorf("after a change: got %+v after %d loads", st, loads)
+	}
+	changes <- TestStateExpired
+	if st := next(); st.State != TestStateExpired || st.Left != 0 || loads != 2 {
+		t.Errorf("after the revoke: got %+v after %d loads", st, loads)
+	}
+	close(done)
+	go func() { _, _ = io.Copy(io.Discard, r) }()
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCountdownTemplate(t *testing.T) {
+	var b strings.Builder
+	err := countdownTemplate.Execute(&b, countdownPage{
+		ConfigDocId: "config",
+		DocURL:      "https://docs.google.com/document/d/doc/edit",
+		Status:      &TestStatus{State: TestStateRunning, Left: 60},
+		Warnings:    []float64{600, 60},
+		CSRF:        "token",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{`new EventSource("/tests/config/events")`, `const warnings = [600,60]`, `"state":"running"`, `name="csrf" value="token"`} {
+		if !strings.Contains(b.String(), s) {
+			t.Errorf("page does not contain %s", s)
+		}
+	}
+}
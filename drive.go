@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	gdrive "gomodules.xyz/gdrive-utils"
+	"google.golang.org/api/docs/v1"
+	"google.golang.org/api/drive/v3"
+)
+
+const (
+	MimeTypeFolder   = "application/vnd.google-apps.folder"
+	MimeTypeDocument = "application/vnd.google-apps.document"
+)
+
+// DriveQuery builds the q parameter of a Drive files.list call. Every value is
+// quoted, so user controlled input like a candidate's email can't change the
+// meaning of the query.
+//
+// ref: https://developers.google.com/drive/api/guides/search-files
+type DriveQuery struct {
+	terms []string
+}
+
+func NewDriveQuery() *DriveQuery {
+	return &DriveQuery{}
+}
+
+// Eq adds the term `field = 'value'`.
+func (q *DriveQuery) Eq(field, value string) *DriveQuery {
+	q.terms = append(q.terms, field+" = "+quoteQueryValue(value))
+	return q
+}
+
+// In adds the term `'value' in field`, eg, In(folderId, "parents").
+func (q *DriveQuery) In(value, field string) *DriveQuery {
+	q.terms = append(q.terms, quoteQueryValue(value)+" in "+field)
+	return q
+}
+
+// Is adds the term `field = true|false`, eg, Is("trashed", false).
+func (q *DriveQuery) Is(field string, v bool) *DriveQuery {
+	q.terms = append(q.terms, field+" = "+strconv.FormatBool(v))
+	return q
+}
+
+// Has adds the term `field has { key='key' and value='value' }`, used to match
+// appProperties and properties.
+func (q *DriveQuery) Has(field, key, value string) *DriveQuery {
+	q.terms = append(q.terms, field+" has { key="+quoteQueryValue(key)+" and value="+quoteQueryValue(value)+" }")
+	return q
+}
+
+// String joins all terms with and.
+func (q *DriveQuery) String() string {
+	return strings.Join(q.terms, " and ")
+}
+
+// quoteQueryValue returns s as a single quoted Drive query string. Drive
+// only needs the quote and the escape character itself to be escaped.
+func quoteQueryValue(s string) string {
+	var sb strings.Builder
+	sb.Grow(len(s) + 2)
+	sb.WriteByte('\'')
+	for _, r := range s {
+		if r == '\'' || r == '\\' {
+			sb.WriteByte('\\')
+		}
+		sb.WriteRune(r)
+	}
+	sb.WriteByte('\'')
+	return sb.String()
+}
+
+func FindParentFolderId(svc *drive.Service, configDocId string) (string, error) {
+	d, err := svc.Files.Get(configDocId).Fields("parents").Do()
+	if err != nil {
+		return "", err
+	}
+	if len(d.Parents) == 0 {
+		return "", errors.Errorf("file %s has no parent folder", configDocId)
+	}
+	return d.Parents[0], nil
+}
+
+// GetFolderId returns the id of the folder folders[0]/folders[1]/... next to
+// the config doc, creating missing folders on the way. Unlike a slash
+// separated path, a folder name may contain any character, eg, an email.
+// Resolved folder ids are kept in folderCache.
+func GetFolderId(svc *drive.Service, configDocId string, folders ...string) (string, error) {
+	return walkFolders(svc, configDocId, true, folders)
+}
+
+// FindFolderId returns the id of the folder like GetFolderId, but never
+// creates a folder. The id is empty if a folder on the way is missing.
+func FindFolderId(svc *drive.Service, configDocId string, folders ...string) (string, error) {
+	return walkFolders(svc, configDocId, false, folders)
+}
+
+func walkFolders(svc *drive.Service, configDocId string, create bool, folders []string) (string, error) {
+	// resume the walk from the longest cached prefix of the path
+	start := len(folders)
+	var parentFolderId string
+	for ; start >= 0; start-- {
+		if folderCache.Get(folderCacheKey(configDocId, folders[:start]), &parentFolderId) {
+			break
+		}
+	}
+	if start < 0 {
+		var err error
+		parentFolderId, err = FindParentFolderId(svc, configDocId)
+		if err != nil {
+			return "", errors.Wrap(err, "failed to detect root folder id")
+		}
+		start = 0
+		folderCache.Set(folderCacheKey(configDocId, nil), parentFolderId)
+	}
+
+	for i := start; i < len(folders); i++ {
+		folderName := folders[i]
+		q := NewDriveQuery().
+			Eq("name", folderName).
+			Eq("mimeType", MimeTypeFolder).
+			In(parentFolderId, "parents")
+		files, err := svc.Files.List().Q(q.String()).Spaces("drive").Fields("files(id)").Do()
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to find folder %s inside parent folder %s", folderName, parentFolderId)
+		}
+		if len(files.Files) > 0 {
+			parentFolderId = files.Files[0].Id
+		} else if !create {
+			return "", nil
+		} else {
+			// https://developers.google.com/drive/api/v3/folder#java
+			folderMetadata := &drive.File{
+				Name:     folderName,
+				MimeType: MimeTypeFolder,
+				Parents:  []string{parentFolderId},
+			}
+			folder, err := svc.Files.Create(folderMetadata).Fields("id").Do()
+			if err != nil {
+				return "", errors.Wrapf(err, "failed to create folder %s inside parent folder %s", folderName, parentFolderId)
+			}
+			parentFolderId = folder.Id
+		}
+		folderCache.Set(folderCacheKey(configDocId, folders[:i+1]), parentFolderId)
+	}
+	return parentFolderId, nil
+}
+
+// folderCacheKey starts with the config doc id, so the entries of a test can
+// be invalidated together. Folder names are separated by NUL since they may
+// contain slashes.
+func folderCacheKey(configDocId string, folders []string) string {
+	return configDocId + cacheKeySep + strings.Join(folders, "\x00")
+}
+
+// CopyDoc copies the template into folderId as docName and fills in the
+// replacements. If a doc named docName already exists in the folder, its id is
+// returned instead.
+func CopyDoc(svcDrive *drive.Service, svcDocs *docs.Service, templateDocId string, folderId string, docName string, replacements map[string]string) (string, error) {
+	q := NewDriveQuery().
+		Eq("name", docName).
+		Eq("mimeType", MimeTypeDocument).
+		In(folderId, "parents")
+	files, err := svcDrive.Files.List().Q(q.String()).Spaces("drive").Fields("files(id)").Do()
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to find doc %s inside parent folder %s", docName, folderId)
+	}
+	if len(files.Files) > 0 {
+		return files.Files[0].Id, nil
+	}
+
+	// https://developers.google.com/docs/api/how-tos/documents#copying_an_existing_document
+	doc, err := svcDrive.Files.Copy(templateDocId, &drive.File{
+		Name:    docName,
+		Parents: []string{folderId},
+	}).Fields("id").Do()
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to copy template doc %s into folder %s", templateDocId, folderId)
+	}
+	if err := ReplaceText(svcDocs, doc.Id, replacements); err != nil {
+		return "", err
+	}
+	return doc.Id, nil
+}
+
+// ReplaceText replaces every occurrence of the keys of replacements in the doc.
+//
+// ref: https://developers.google.com/docs/api/how-tos/merge
+func ReplaceText(svcDocs *docs.Service, docId string, replacements map[string]string) error {
+	if len(replacements) == 0 {
+		return nil
+	}
+	req := &docs.BatchUpdateDocumentRequest{
+		Requests: make([]*docs.Request, 0, len(replacements)),
+	}
+	for k, v := range replacements {
+		req.Requests = append(req.Requests, &docs.Request{
+			ReplaceAllText: &docs.ReplaceAllTextRequest{
+				ContainsText: &docs.SubstringMatchCriteria{
+					MatchCase: true,
+					Text:      k,
+				},
+				ReplaceText: v,
+			},
+		})
+	}
+	if _, err := svcDocs.Documents.BatchUpdate(docId, req).Do(); err != nil {
+		return errors.Wrapf(err, "failed to replace template fields in doc %s", docId)
+	}
+	return nil
+}
+
+func listPermissions(svc *drive.Service, docId string) ([]*drive.Permission, error) {
+	var perms []*drive.Permission
+	err := svc.Permissions.List(docId).
+		Fields("permissions(id,role,type,emailAddress,domain)").
+		Pages(context.TODO(), func(resp *drive.PermissionList) error {
+			perms = append(perms, resp.Permissions...)
+			return nil
+		})
+	return perms, err
+}
+
+// LockDownDoc makes sure a candidate's copy of the template can't leave our
+// hands: writers can't share it, readers and commenters can't copy, print or
+// download it, and link sharing is turned off.
+func LockDownDoc(svc *drive.Service, docId string) error {
+	_, err := svc.Files.Update(docId, &drive.File{
+		WritersCanShare:              false,
+		CopyRequiresWriterPermission: true,
+		ForceSendFields:              []string{"WritersCanShare"},
+	}).Fields("id").Do()
+	if err != nil {
+		return err
+	}
+
+	perms, err := listPermissions(svc, docId)
+	if err != nil {
+		return err
+	}
+	for _, perm := range perms {
+		if perm.Type == "anyone" || perm.Type == "domain" {
+			if err := svc.Permissions.Delete(docId, perm.Id).Do(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// findPermission returns the permission of email on the doc, or nil.
+func findPermission(svc *drive.Service, docId, email string) (*drive.Permission, error) {
+	perms, err := listPermissions(svc, docId)
+	if err != nil {
+		return nil, err
+	}
+	for _, perm := range perms {
+		if strings.EqualFold(perm.EmailAddress, email) {
+			return perm, nil
+		}
+	}
+	return nil, nil
+}
+
+// setRole gives email the role on the doc, changing the role of an existing
+// permission of email.
+func setRole(svc *drive.Service, docId, email, role string) error {
+	perm, err := findPermission(svc, docId, email)
+	if err != nil {
+		return err
+	}
+	if perm == nil {
+		_, err = gdrive.AddPermission(svc, docId, email, role)
+		return err
+	}
+	if perm.Role == role {
+		return nil
+	}
+	_, err = svc.Permissions.Update(docId, perm.Id, &drive.Permission{Role: role}).Fields("id").Do()
+	return err
+}
@@ -0,0 +1,68 @@
+package main
+
+import "testing"
+
+func TestQuoteQueryValue(t *testing.T) {
+	cases := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain", "tamal.saha@gmail.com", `'tamal.saha@gmail.com'`},
+		{"empty", "", `''`},
+		{"apostrophe", "o'brien@example.com", `'o\'brien@example.com'`},
+		{"backslash", `a\b@example.com`, `'a\\b@example.com'`},
+		{"escaped apostrophe", `a\'b`, `'a\\\'b'`},
+		{"trailing backslash", `a\`, `'a\\'`},
+		{"unicode", "józef.żółć@例え.jp", `'józef.żółć@例え.jp'`},
+		{"injection", "x' or name contains '", `'x\' or name contains \''`},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := quoteQueryValue(c.in); got != c.want {
+				t.Errorf("quoteQueryValue(%q) = %s, want %s", c.in, got, c.want)
+			}
+		})
+	}
+}
+
+func TestDriveQuery(t *testing.T) {
+	cases := []struct {
+		name string
+		q    *DriveQuery
+		want string
+	}{
+		{
+			name: "folder",
+			q:    NewDriveQuery().Eq("name", "candidates").Eq("mimeType", MimeTypeFolder).In("1AbC", "parents"),
+			want: `name = 'candidates' and mimeType = 'application/vnd.google-apps.folder' and '1AbC' in parents`,
+		},
+		{
+			name: "apostrophe in email",
+			q:    NewDriveQuery().Eq("name", "o'brien@example.com").In("1AbC", "parents"),
+			want: `name = 'o\'brien@example.com' and '1AbC' in parents`,
+		},
+		{
+			name: "doc name with backslash and unicode",
+			q:    NewDriveQuery().Eq("name", `ü\ser@example.com - Test 2022-06-01`).Eq("mimeType", MimeTypeDocument),
+			want: `name = 'ü\\ser@example.com - Test 2022-06-01' and mimeType = 'application/vnd.google-apps.document'`,
+		},
+		{
+			name: "pool docs",
+			q:    NewDriveQuery().In("1AbC", "parents").Has("appProperties", "gdocPoolTemplate", "o'x").Is("trashed", false),
+			want: `'1AbC' in parents and appProperties has { key='gdocPoolTemplate' and value='o\'x' } and trashed = false`,
+		},
+		{
+			name: "crafted parent",
+			q:    NewDriveQuery().In("x' in parents or 'y", "parents"),
+			want: `'x\' in parents or \'y' in parents`,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := c.q.String(); got != c.want {
+				t.Errorf("got  %s\nwant %s", got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tamalsaha/gdoc-expiring-link/scheduler"
+	csvtypes "gomodules.xyz/encoding/csv/types"
+)
+
+// Extension is the change of the end of a candidate's test by Extend.
+type Extension struct {
+	Email  string    `json:"email"`
+	OldEnd time.Time `json:"oldEnd"`
+	NewEnd time.Time `json:"newEnd"`
+	// Jobs is the number of pending jobs moved to the new end.
+	Jobs  int    `json:"jobs"`
+	Error string `json:"error,omitempty"`
+}
+
+// ExtendResult is the outcome of Extend.
+type ExtendResult struct {
+	ConfigDocId string      `json:"configDocId"`
+	By          string      `json:"by"`
+	DryRun      bool        `json:"dryRun"`
+	Extended    []Extension `json:"extended"`
+	Skipped     []Extension `json:"skipped"`
+}
+
+// Extend moves the end of every running test of a candidate, or only the one
+// of email if set, forward by d. The new ends are written to the sheet first,
+// then pending jobs, eg, the revoke, move with them, and the candidate is
+// told with a comment on their doc. With dryRun set, only the changes that
+// would be made are returned.
+func (s *Server) Extend(configDocId, email string, d time.Duration, reason string, dryRun bool) (*ExtendResult, error) {
+	if d <= 0 {
+		return nil, errors.Errorf("extension must be positive, got %s", d)
+	}
+
+	mu := testLock(configDocId)
+	mu.Lock()
+	defer mu.Unlock()
+
+	ts, err := LoadTestSheet(s.svcSheets, configDocId)
+	if err != nil {
+		return nil, err
+	}
+	result := &ExtendResult{
+		ConfigDocId: configDocId,
+		By:          d.String(),
+		DryRun:      dryRun,
+		Extended:    []Extension{},
+		Skipped:     []Extension{},
+	}
+
+	now := time.Now()
+	type extension struct {
+		ans  TestAnswer
+		jobs []*scheduler.Job
+		ext  Extension
+	}
+	var planned []extension
+	for _, row := range ts.LatestRows() {
+		ans := row.Answer
+		if row.Err != nil || !ans.EndDate.After(now) || email != "" && normalizeEmail(ans.Email) != normalizeEmail(email) {
+			continue
+		}
+		ext := Extension{
+			Email:  ans.Email,
+			OldEnd: ans.EndDate.Time,
+			NewEnd: ans.EndDate.Add(d),
+		}
+		if !ans.SubmittedAt.IsZero() {
+			ext.Error = "the test was submitted, reopen it instead"
+			result.Skipped = append(result.Skipped, ext)
+			continue
+		}
+
+		jobs, err := s.sched.Lookup(jobKey(configDocId, ans.Email))
+		if err != nil {
+			return nil, err
+		}
+		ext.Jobs = len(jobs)
+		if !hasJob(jobs, JobTypeRevoke) && ans.PausedAt.IsZero() {
+			// submitted, or the jobs were never scheduled
+			ext.Error = "no pending revoke, the test may have been submitted"
+			result.Skipped = append(result.Skipped, ext)
+			continue
+		}
+		if dryRun {
+			result.Extended = append(result.Extended, ext)
+			continue
+		}
+
+		ans.EndDate = csvtypes.Timestamp{Time: ext.NewEnd}
+		if _, err := ts.Set(&ans); err != nil {
+			return nil, err
+		}
+		planned = append(planned, extension{ans: ans, jobs: jobs, ext: ext})
+	}
+	if dryRun || len(planned) == 0 {
+		return result, nil
+	}
+	// the jobs follow the sheet, so nothing moves if it can't be written
+	if err := ts.Flush(); err != nil {
+		return nil, err
+	}
+
+	var applied []TestAnswer
+	for _, p := range planned {
+		ans, ext := p.ans, p.ext
+		if err := s.extendTestJobs(configDocId, ans, p.jobs, d); err != nil {
+			// not marked as applied, so the reconcile loop moves them
+			ext.Error = fmt.Sprintf("the end was moved, but not the pending jobs: %v", err)
+		} else {
+			applied = append(applied, ans)
+		}
+		result.Extended = append(result.Extended, ext)
+
+		msg := fmt.Sprintf("Your test was extended by %s, it now ends at %s.", d, formatTime(ext.NewEnd, ans.Location()))
+		if ans.PausedAt.IsZero() {
+			if err := s.scheduleJob(now, JobTypeComment, jobKey(configDocId, ans.Email), Comment{DocId: ans.DocId, Content: msg}); err != nil {
+				log.Printf("failed to notify %s in test %s of the extension: %v", ans.Email, configDocId, err)
+			}
+		}
+		if err := s.scheduleJob(now, JobTypeNotify, jobKey(configDocId, ans.Email), Notification{
+			ConfigDocId: configDocId,
+			Email:       ans.Email,
+			Message:     msg,
+		}); err != nil {
+			log.Printf("failed to notify %s in test %s of the extension: %v", ans.Email, configDocId, err)
+		}
+		err = SaveAuditEvent(s.svcSheets, configDocId, AuditEvent{
+			Time:    csvtypes.Timestamp{Time: now},
+			Email:   ans.Email,
+			Event:   AuditEventExtended,
+			Details: fmt.Sprintf("extended by %s from %s to %s: %s", d, ext.OldEnd.UTC().Format(time.RFC3339), ext.NewEnd.UTC().Format(time.RFC3339), reason),
+		})
+		if err != nil {
+			log.Printf("failed to audit the extension of %s in test %s: %v", ans.Email, configDocId, err)
+		}
+		s.hub.notify(jobKey(configDocId, ans.Email), "")
+		s.emit(WebhookEventExtended, configDocId, ans, fmt.Sprintf("extended by %s: %s", d, reason))
+	}
+	return result, s.markApplied(configDocId, applied...)
+}
+
+func hasJob(jobs []*scheduler.Job, jobType string) bool {
+	for _, job := range jobs {
+		if job.Type == jobType {
+			return true
+		}
+	}
+	return false
+}
+
+// extendTestJobs moves the pending jobs of the candidate by d, and updates
+// the end of the test in their payloads. Guards keep their schedule and the
+// permissions they allow.
+func (s *Server) extendTestJobs(configDocId string, ans TestAnswer, jobs []*scheduler.Job, d time.Duration) error {
+	for _, job := range jobs {
+		due := job.Due.Add(d)
+		var v interface{}
+		switch job.Type {
+		case JobTypeRevoke, JobTypeRemind, JobTypeSnapshot:
+			v = ans
+		case JobTypeGuard:
+			var g Guard
+			if err := json.Unmarshal(job.Payload, &g); err != nil {
+				return err
+			}
+			g.EndDate = ans.EndDate.Time
+			v, due = g, job.Due
+		case JobTypeNotify:
+			var n Notification
+			if err := json.Unmarshal(job.Payload, &n); err != nil {
+				return err
+			}
+			if !job.Due.After(time.Now()) {
+				// about to run, eg, a notification of an earlier change
+				continue
+			}
+			v = n
+		default:
+			continue
+		}
+		if err := s.sched.Cancel(job.ID); err == scheduler.ErrJobNotFound {
+			// ran in the meantime
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := s.scheduleJob(due, job.Type, job.Key, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extend serves POST /admin/tests/<configDocId>/extend?by=<duration>&email=<email>&reason=<reason>&dryRun=<bool>
+func (s *Server) extend(w http.ResponseWriter, r *http.Request, configDocId string) {
+	d, err := time.ParseDuration(r.FormValue("by"))
+	if err != nil {
+		http.Error(w, "invalid by: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	dryRun := r.FormValue("dryRun") == "true"
+	result, err := s.Extend(configDocId, r.FormValue("email"), d, r.FormValue("reason"), dryRun)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, result)
+}
+
+// runExtend implements
+//
+//	extend --config-doc-id=<id> --by=<duration> [--email=<email>] [--reason=<reason>] [--dry-run]
+func runExtend(args []string) {
+	fs := flag.NewFlagSet("extend", flag.ExitOnError)
+	c := adminFlags(fs)
+	configDocId := fs.String("config-doc-id", "", "Id of the spreadsheet of the test")
+	by := fs.Duration("by", 0, "How much time to add, eg, 15m")
+	email := fs.String("email", "", "Only extend the test of this candidate")
+	reason := fs.String("reason", "", "Why the test is extended, recorded in the audit trail")
+	dryRun := fs.Bool("dry-run", false, "Only print the changes that would be made")
+	_ = fs.Parse(args)
+	if *configDocId == "" || *by <= 0 {
+		log.Fatal("usage: extend --config-doc-id=<id> --by=<duration> [--email=<email>] [--dry-run]")
+	}
+
+	q := url.Values{}
+	q.Set("by", by.String())
+	q.Set("email", *email)
+	q.Set("reason", *reason)
+	q.Set("dryRun", fmt.Sprint(*dryRun))
+	var result ExtendResult
+	handleError(c.Do(http.MethodPost, "tests/"+*configDocId+"/extend?"+q.Encode(), nil, &result), "Error extending test")
+
+	verb := "extended"
+	if result.DryRun {
+		verb = "would extend"
+	}
+	for _, ext := range result.Extended {
+		fmt.Printf("%s\t%s %s -> %s\t%d jobs\n", ext.Email, verb, ext.OldEnd.Format(time.RFC3339), ext.NewEnd.Format(time.RFC3339), ext.Jobs)
+	}
+	for _, ext := range result.Skipped {
+		fmt.Printf("%s\tskipped: %s\n", ext.Email, ext.Error)
+	}
+	fmt.Printf("%s %d candidates by %s, skipped %d\n", verb, len(result.Extended), result.By, len(result.Skipped))
+}
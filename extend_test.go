@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tamalsaha/gdoc-expiring-link/scheduler"
+	csvtypes "gomodules.xyz/encoding/csv/types"
+)
+
+func TestExtendTestJobs(t *testing.T) {
+	sched, err := scheduler.NewScheduler(filepath.Join(t.TempDir(), "scheduler"), scheduler.DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sched.Close()
+	s := &Server{sched: sched}
+	s.registerJobs()
+
+	end := time.Now().Add(time.Hour).Round(time.Second)
+	ans := TestAnswer{Email: "a@b.c", DocId: "doc", EndDate: csvtypes.Timestamp{Time: end}}
+	key := jobKey("config", ans.Email)
+	guardAt := time.Now().Add(2 * time.Minute).Round(time.Second)
+	for _, job := range []struct {
+		t       time.Time
+		jobType string
+		v       interface{}
+	}{
+		{end, JobTypeRevoke, ans},
+		{end.Add(-10 * time.Minute), JobTypeRemind, ans},
+		{guardAt, JobTypeGuard, Guard{DocId: "doc", EndDate: end, Allowed: []string{"owner", "candidate"}}},
+	} {
+		if err := s.scheduleJob(job.t, job.jobType, key, job.v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	jobs, err := sched.Lookup(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := 15 * time.Minute
+	extended := ans
+	extended.EndDate = csvtypes.Timestamp{Time: end.Add(d)}
+	if err := s.extendTestJobs("config", extended, jobs, d); err != nil {
+		t.Fatal(err)
+	}
+
+	jobs, err = sched.Lookup(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 3 {
+		t.Fatalf("got %d jobs, want 3", len(jobs))
+	}
+	for _, job := range jobs {
+		switch job.Type {
+		case JobTypeRevoke:
+			if !job.Due.Equal(end.Add(d)) {
+				t.Errorf("revoke due %s, want %s", job.Due, end.Add(d))
+			}
+			var got TestAnswer
+			if err := json.Unmarshal(job.Payload, &got); err != nil {
+				t.Fatal(err)
+			}
+			if !got.EndDate.Equal(end.Add(d)) {
+				t.Errorf("revoke payload ends at %s, want %s", got.EndDate.Time, end.Add(d))
+			}
+		case JobTypeRemind:
+			if want := end.Add(d - 10*time.Minute); !job.Due.Equal(want) {
+				t.Errorf("reminder due %s, want %s", job.Due, want)
+			}
+		case JobTypeGuard:
+			if !job.Due.Equal(guardAt) {
+				t.Errorf("guard moved to %s, want %s", job.Due, guardAt)
+			}
+			var g Guard
+			if err := json.Unmarshal(job.Payload, &g); err != nil {
+				t.Fatal(err)
+			}
+			if !g.EndDate.Equal(end.Add(d)) || len(g.Allowed) != 2 {
+				t.Errorf("unexpected guard payload %+v", g)
+			}
+		}
+	}
+}
+
+func TestExtendFailedSave(t *testing.T) {
+	s, f := newFakeServer(t)
+	now := time.Now().UTC().Truncate(time.Second)
+	openTest(t, f, now)
+	ans := TestAnswer{
+		Id:        "id",
+		Email:     "a@b.c",
+		DocId:     "doc",
+		StartDate: csvtypes.Timestamp{Time: now.Add(-10 * time.Minute)},
+		EndDate:   csvtypes.Timestamp{Time: now.Add(50 * time.Minute)},
+		Attempt:   1,
+	}
+	row := f.addAnswer(t, ans)
+	if err := s.scheduleTestJobs("config", ans); err != nil {
+		t.Fatal(err)
+	}
+
+	f.mu.Lock()
+	f.readOnly = true
+	f.mu.Unlock()
+	if _, err := s.Extend("config", "", 15*time.Minute, "outage", false); err == nil {
+		t.Fatal("extended without saving the sheet")
+	}
+	if due := dueJobs(t, s, "config", "a@b.c"); !due[JobTypeRevoke].Equal(ans.EndDate.Time) {
+		t.Errorf("failed extension moved the revoke to %v", due[JobTypeRevoke])
+	}
+
+	f.mu.Lock()
+	f.readOnly = false
+	f.mu.Unlock()
+	result, err := s.Extend("config", "", 15*time.Minute, "outage", false)
+	if err != nil || len(result.Extended) != 1 || result.Extended[0].Error != "" {
+		t.Fatalf("Extend() = %+v, %v", result, err)
+	}
+	want := ans.EndDate.Add(15 * time.Minute)
+	if due := dueJobs(t, s, "config", "a@b.c"); !due[JobTypeRevoke].Equal(want) {
+		t.Errorf("revoke due %v, want %v", due[JobTypeRevoke], want)
+	}
+	if got := f.cell(ProjectTestSheet, row, "End Date"); got != want.Format(csvtypes.TimestampFormat) {
+		t.Errorf("sheet has end date %q, want %v", got, want)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	csvtypes "gomodules.xyz/encoding/csv/types"
+)
+
+// Grade records grade on the row of the latest attempt of email, once their
+// test ended or was submitted. A test can be graded again, the new grade
+// replaces the old one.
+func (s *Server) Grade(configDocId, email, grade string) (*TestAnswer, error) {
+	grade = strings.TrimSpace(grade)
+	if grade == "" {
+		return nil, errors.New("missing grade")
+	}
+
+	mu := testLock(configDocId)
+	mu.Lock()
+	defer mu.Unlock()
+
+	ts, err := LoadTestSheet(s.svcSheets, configDocId)
+	if err != nil {
+		return nil, err
+	}
+	row := ts.Latest(email)
+	if row == nil {
+		return nil, errors.Errorf("%s has not started the test yet", email)
+	}
+	if row.Err != nil {
+		return nil, errors.Wrapf(row.Err, "invalid row %d", row.Row)
+	}
+	ans := row.Answer
+	now := time.Now()
+	if ans.SubmittedAt.IsZero() && (ans.EndDate.After(now) || !ans.PausedAt.IsZero()) {
+		return nil, errors.New("the test has not ended yet")
+	}
+
+	oldGrade := ans.Grade
+	ans.Grade = grade
+	ans.GradedAt = OptionalTimestamp{Time: now}
+	if _, err := ts.Set(&ans); err != nil {
+		return nil, err
+	}
+	if err := ts.Flush(); err != nil {
+		return nil, err
+	}
+	s.emit(WebhookEventGraded, configDocId, ans, grade)
+
+	log.Printf("graded the test of %s in test %s: %s", ans.Email, configDocId, grade)
+	details := "graded " + grade
+	if oldGrade != "" {
+		details += ", was " + oldGrade
+	}
+	err = SaveAuditEvent(s.svcSheets, configDocId, AuditEvent{
+		Time:    csvtypes.Timestamp{Time: now},
+		Email:   ans.Email,
+		Event:   AuditEventGraded,
+		Details: details,
+	})
+	return &ans, err
+}
+
+// grade serves POST /admin/tests/<configDocId>/grade?email=<email>&grade=<grade>
+func (s *Server) grade(w http.ResponseWriter, r *http.Request, configDocId string) {
+	email := r.FormValue("email")
+	if email == "" {
+		http.Error(w, "missing email", http.StatusBadRequest)
+		return
+	}
+	ans, err := s.Grade(configDocId, email, r.FormValue("grade"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	writeJSON(w, ans)
+}
+
+// runGrade implements
+//
+//	grade --config-doc-id=<id> --email=<email> --grade=<grade>
+func runGrade(args []string) {
+	fs := flag.NewFlagSet("grade", flag.ExitOnError)
+	c := adminFlags(fs)
+	configDocId := fs.String("config-doc-id", "", "Id of the spreadsheet of the test")
+	email := fs.String("email", "", "Email of the candidate")
+	grade := fs.String("grade", "", "Grade of the test, recorded on the candidate's row")
+	_ = fs.Parse(args)
+	if *configDocId == "" || *email == "" || *grade == "" {
+		log.Fatal("usage: grade --config-doc-id=<id> --email=<email> --grade=<grade>")
+	}
+
+	q := url.Values{}
+	q.Set("email", *email)
+	q.Set("grade", *grade)
+	var ans TestAnswer
+	handleError(c.Do(http.MethodPost, "tests/"+*configDocId+"/grade?"+q.Encode(), nil, &ans), "Error grading test")
+	fmt.Printf("graded the test of %s: %s\n", ans.Email, ans.Grade)
+}
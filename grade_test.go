@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	csvtypes "gomodules.xyz/encoding/csv/types"
+)
+
+func TestGrade(t *testing.T) {
+	s, f := newFakeServer(t)
+	now := time.Now().UTC().Truncate(time.Second)
+	openTest(t, f, now)
+	row := f.addAnswer(t, TestAnswer{
+		Id:        "id-done@x.y",
+		Email:     "Done@x.y",
+		DocId:     "doc-done@x.y",
+		StartDate: csvtypes.Timestamp{Time: now.Add(-70 * time.Minute)},
+		EndDate:   csvtypes.Timestamp{Time: now.Add(-10 * time.Minute)},
+		Attempt:   1,
+	})
+	f.addAnswer(t, TestAnswer{
+		Id:        "id-run@x.y",
+		Email:     "run@x.y",
+		DocId:     "doc-run@x.y",
+		StartDate: csvtypes.Timestamp{Time: now.Add(-10 * time.Minute)},
+		EndDate:   csvtypes.Timestamp{Time: now.Add(50 * time.Minute)},
+		Attempt:   1,
+	})
+	receiver, received := webhookReceiver(t, 0)
+	if _, err := s.AddWebhook(Webhook{URL: receiver.URL, Events: []string{WebhookEventGraded}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Grade("config", "run@x.y", "A"); err == nil {
+		t.Error("graded a running test")
+	}
+	if _, err := s.Grade("config", "done@x.y", " "); err == nil {
+		t.Error("graded without a grade")
+	}
+
+	ans, err := s.Grade("config", "done@x.y", "A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ans.Grade != "A" || ans.GradedAt.IsZero() {
+		t.Errorf("grade not recorded: %+v", ans)
+	}
+	if got := f.cell(ProjectTestSheet, row, "Grade"); got != "A" {
+		t.Errorf("sheet has grade %q, want A", got)
+	}
+	if got := f.cell(ProjectAuditSheet, 2, "Event"); got != AuditEventGraded {
+		t.Errorf("got audit event %q, want %q", got, AuditEventGraded)
+	}
+	select {
+	case d := <-received:
+		var event WebhookEvent
+		if err := json.Unmarshal(d.body, &event); err != nil {
+			t.Fatal(err)
+		}
+		if event.Type != WebhookEventGraded || event.Email != "Done@x.y" || event.Answer.Grade != "A" {
+			t.Errorf("got event %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no delivery received")
+	}
+}
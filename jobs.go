@@ -0,0 +1,344 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/tamalsaha/gdoc-expiring-link/scheduler"
+	csvtypes "gomodules.xyz/encoding/csv/types"
+	"google.golang.org/api/drive/v3"
+)
+
+// Job types understood by the scheduler. Handlers are registered in
+// Server.registerJobs before persisted jobs are recovered.
+const (
+	JobTypeRevoke    = "revoke"
+	JobTypeRemind    = "remind"
+	JobTypeSnapshot  = "snapshot"
+	JobTypeNotify    = "notify"
+	JobTypeGuard     = "guard"
+	JobTypeFillPool  = "fill-pool"
+	JobTypeReconcile = "reconcile"
+	JobTypePreflight = "preflight"
+	JobTypeComment   = "comment"
+	JobTypeWebhook   = "webhook"
+)
+
+const (
+	// guardInterval is how often the permissions of a running test doc are checked.
+	guardInterval = 2 * time.Minute
+	// poolFillInterval is how often the doc pool of an open test is topped up.
+	poolFillInterval = 10 * time.Minute
+)
+
+type Notification struct {
+	ConfigDocId string `json:"configDocId"`
+	Email       string `json:"email"`
+	Message     string `json:"message"`
+}
+
+// Comment is the payload of a comment job, a message to the candidate posted
+// on their doc.
+type Comment struct {
+	DocId   string `json:"docId"`
+	Content string `json:"content"`
+}
+
+// Guard is the payload of a guard job. Allowed holds the ids of the
+// permissions the doc had right after the candidate was granted access.
+type Guard struct {
+	ConfigDocId string    `json:"configDocId"`
+	Email       string    `json:"email"`
+	DocId       string    `json:"docId"`
+	EndDate     time.Time `json:"endDate"`
+	Allowed     []string  `json:"allowed"`
+}
+
+func (s *Server) registerJobs() {
+	s.sched.Register(JobTypeRevoke, func(job *scheduler.Job) error {
+		var ans TestAnswer
+		if err := json.Unmarshal(job.Payload, &ans); err != nil {
+			return err
+		}
+		if err := s.revoke(ans); err != nil {
+			return err
+		}
+		s.hub.notify(job.Key, TestStateExpired)
+		configDocId, _ := splitJobKey(job.Key)
+		s.emit(WebhookEventExpired, configDocId, ans, "")
+		return nil
+	})
+	s.sched.Register(JobTypeWebhook, func(job *scheduler.Job) error {
+		var d WebhookDelivery
+		if err := json.Unmarshal(job.Payload, &d); err != nil {
+			return err
+		}
+		return s.deliver(d, job.Attempts+1)
+	})
+	s.sched.Register(JobTypeRemind, func(job *scheduler.Job) error {
+		var ans TestAnswer
+		if err := json.Unmarshal(job.Payload, &ans); err != nil {
+			return err
+		}
+		// a comment on the doc is the one place the candidate is sure to look
+		_, err := s.svcDrive.Comments.Create(ans.DocId, &drive.Comment{
+			Content: fmt.Sprintf("%s left to finish the test. Access will be revoked at %s.", time.Until(ans.EndDate.Time).Round(time.Minute), formatTime(ans.EndDate.Time, ans.Location())),
+		}).Fields("id").Do()
+		return err
+	})
+	s.sched.Register(JobTypeSnapshot, func(job *scheduler.Job) error {
+		var ans TestAnswer
+		if err := json.Unmarshal(job.Payload, &ans); err != nil {
+			return err
+		}
+		// the copy is owned by us and does not carry over the candidate's permission
+		_, err := s.svcDrive.Files.Copy(ans.DocId, &drive.File{
+			Name: fmt.Sprintf("%s - Snapshot %s", ans.Email, ans.EndDate.Format(time.RFC3339)),
+		}).Fields("id").Do()
+		return err
+	})
+	s.sched.Register(JobTypeGuard, func(job *scheduler.Job) error {
+		var g Guard
+		if err := json.Unmarshal(job.Payload, &g); err != nil {
+			return err
+		}
+		if err := s.guard(g); err != nil {
+			return err
+		}
+		if next := time.Now().Add(guardInterval); next.Before(g.EndDate) {
+			return s.scheduleJob(next, JobTypeGuard, job.Key, g)
+		}
+		return nil
+	})
+	s.sched.Register(JobTypeFillPool, func(job *scheduler.Job) error {
+		var configDocId string
+		if err := json.Unmarshal(job.Payload, &configDocId); err != nil {
+			return err
+		}
+		cfg, err := LoadConfig(s.svcSheets, configDocId)
+		if err != nil {
+			return err
+		}
+		if cfg.PoolSize <= 0 || time.Now().After(cfg.EndDate.Time) {
+			return nil
+		}
+		n, err := FillPool(s.svcDrive, configDocId, cfg.QuestionTemplateDocId, cfg.PoolSize)
+		if n > 0 {
+			log.Printf("added %d docs to the pool of test %s", n, configDocId)
+		}
+		if err != nil {
+			return err
+		}
+		return s.scheduleJob(time.Now().Add(poolFillInterval), JobTypeFillPool, job.Key, configDocId)
+	})
+	s.sched.Register(JobTypeReconcile, func(job *scheduler.Job) error {
+		var configDocId string
+		if err := json.Unmarshal(job.Payload, &configDocId); err != nil {
+			return err
+		}
+		if err := s.Reconcile(configDocId); err != nil {
+			return err
+		}
+		cfg, err := LoadConfig(s.svcSheets, configDocId)
+		if err != nil {
+			return err
+		}
+		// keep going until the last candidate's time is up
+		if time.Now().After(cfg.LatestEnd()) || s.opts.ReconcileInterval <= 0 {
+			return nil
+		}
+		return s.scheduleJob(time.Now().Add(s.opts.ReconcileInterval), JobTypeReconcile, job.Key, configDocId)
+	})
+	s.sched.Register(JobTypePreflight, func(job *scheduler.Job) error {
+		var configDocId string
+		if err := json.Unmarshal(job.Payload, &configDocId); err != nil {
+			return err
+		}
+		return s.preflight(configDocId)
+	})
+	s.sched.Register(JobTypeComment, func(job *scheduler.Job) error {
+		var c Comment
+		if err := json.Unmarshal(job.Payload, &c); err != nil {
+			return err
+		}
+		_, err := s.svcDrive.Comments.Create(c.DocId, &drive.Comment{Content: c.Content}).Fields("id").Do()
+		return err
+	})
+	s.sched.Register(JobTypeNotify, func(job *scheduler.Job) error {
+		var n Notification
+		if err := json.Unmarshal(job.Payload, &n); err != nil {
+			return err
+		}
+		log.Printf("notify: test %s, candidate %s: %s", n.ConfigDocId, n.Email, n.Message)
+		return nil
+	})
+}
+
+// jobKey groups the jobs of a candidate in a test.
+func jobKey(configDocId, email string) string {
+	return configDocId + "/" + email
+}
+
+// splitJobKey returns the test and the candidate of a key made by jobKey.
+func splitJobKey(key string) (string, string) {
+	configDocId, email, _ := strings.Cut(key, "/")
+	return configDocId, email
+}
+
+func (s *Server) scheduleJob(t time.Time, jobType string, key string, v interface{}) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = s.sched.Schedule(t, jobType, key, payload)
+	return err
+}
+
+// scheduleTestJobs schedules everything that has to happen while the test of
+// ans is running: a periodic guard of the doc's permissions, the reminders of
+// the test mode before the end, then a snapshot of the doc, the revoke of the
+// candidate's access and a notification at the end.
+func (s *Server) scheduleTestJobs(configDocId string, ans TestAnswer) error {
+	cfg, err := LoadConfig(s.svcSheets, configDocId)
+	if err != nil {
+		return err
+	}
+	key := jobKey(configDocId, ans.Email)
+	for _, before := range cfg.TestMode().Reminders() {
+		if remindAt := ans.EndDate.Add(-before); remindAt.After(time.Now()) {
+			if err := s.scheduleJob(remindAt, JobTypeRemind, key, ans); err != nil {
+				return err
+			}
+		}
+	}
+	perms, err := listPermissions(s.svcDrive, ans.DocId)
+	if err != nil {
+		return err
+	}
+	g := Guard{
+		ConfigDocId: configDocId,
+		Email:       ans.Email,
+		DocId:       ans.DocId,
+		EndDate:     ans.EndDate.Time,
+	}
+	for _, perm := range perms {
+		g.Allowed = append(g.Allowed, perm.Id)
+	}
+	if err := s.scheduleJob(time.Now().Add(guardInterval), JobTypeGuard, key, g); err != nil {
+		return err
+	}
+	if err := s.scheduleJob(ans.EndDate.Time, JobTypeSnapshot, key, ans); err != nil {
+		return err
+	}
+	if err := s.scheduleJob(ans.EndDate.Time, JobTypeRevoke, key, ans); err != nil {
+		return err
+	}
+	return s.scheduleJob(ans.EndDate.Time, JobTypeNotify, key, Notification{
+		ConfigDocId: configDocId,
+		Email:       ans.Email,
+		Message:     "test time is over",
+	})
+}
+
+// finishTestJobs is called when a candidate submits early. The pending
+// reminder and revoke are dropped since access is revoked right away, the
+// snapshot is taken now and the end of test notification is replaced.
+func (s *Server) finishTestJobs(configDocId string, ans TestAnswer) error {
+	key := jobKey(configDocId, ans.Email)
+	jobs, err := s.sched.Lookup(key)
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		switch job.Type {
+		case JobTypeSnapshot:
+			err = s.sched.Reschedule(job.ID, time.Now())
+		default:
+			err = s.sched.Cancel(job.ID)
+		}
+		if err != nil && err != scheduler.ErrJobNotFound {
+			return err
+		}
+	}
+	return s.scheduleJob(time.Now(), JobTypeNotify, key, Notification{
+		ConfigDocId: configDocId,
+		Email:       ans.Email,
+		Message:     "test submitted",
+	})
+}
+
+// cancelTestJobs drops every pending job of the candidate in the test.
+func (s *Server) cancelTestJobs(configDocId, email string) error {
+	jobs, err := s.sched.Lookup(jobKey(configDocId, email))
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		if err := s.sched.Cancel(job.ID); err != nil && err != scheduler.ErrJobNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// guard removes every permission on the doc of g that was added after the
+// candidate got access, eg, the candidate sharing the doc with a friend, and
+// records it in the audit trail.
+func (s *Server) guard(g Guard) error {
+	allowed := make(map[string]bool, len(g.Allowed))
+	for _, id := range g.Allowed {
+		allowed[id] = true
+	}
+
+	perms, err := listPermissions(s.svcDrive, g.DocId)
+	if err != nil {
+		return err
+	}
+	for _, perm := range perms {
+		if allowed[perm.Id] || perm.Role == "owner" {
+			continue
+		}
+		if err := s.svcDrive.Permissions.Delete(g.DocId, perm.Id).Do(); err != nil {
+			return err
+		}
+		who := perm.EmailAddress
+		if who == "" {
+			who = perm.Domain
+		}
+		if who == "" {
+			who = perm.Type
+		}
+		log.Printf("removed %s permission of %s from doc %s of %s in test %s", perm.Role, who, g.DocId, g.Email, g.ConfigDocId)
+		err = SaveAuditEvent(s.svcSheets, g.ConfigDocId, AuditEvent{
+			Time:    csvtypes.Timestamp{Time: time.Now()},
+			Email:   g.Email,
+			Event:   AuditEventPermissionRemoved,
+			Details: fmt.Sprintf("possible integrity issue: %s permission of %s %s was added to doc %s during the test", perm.Role, perm.Type, who, g.DocId),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fillPool makes sure the doc pool of the test is being topped up. If now is
+// set, a pending fill is moved up to run right away, eg, after a candidate
+// took a doc from the pool.
+func (s *Server) fillPool(configDocId string, now bool) error {
+	key := "pool/" + configDocId
+	jobs, err := s.sched.Lookup(key)
+	if err != nil {
+		return err
+	}
+	if len(jobs) == 0 {
+		return s.scheduleJob(time.Now(), JobTypeFillPool, key, configDocId)
+	}
+	if now {
+		return s.sched.Reschedule(jobs[0].ID, time.Now())
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Mailer sends plain text emails to candidates.
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// SMTPMailer sends emails through an SMTP server. STARTTLS is used if the
+// server supports it.
+type SMTPMailer struct {
+	// Addr is the host:port of the server.
+	Addr string
+	From string
+	// Auth is optional, eg, smtp.PlainAuth.
+	Auth smtp.Auth
+}
+
+func (m *SMTPMailer) Send(to, subject, body string) error {
+	if err := validAddress(to); err != nil {
+		return err
+	}
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", m.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	return errors.Wrapf(smtp.SendMail(m.Addr, m.Auth, m.From, []string{to}, []byte(msg.String())), "failed to send email to %s", to)
+}
+
+// LogMailer writes emails to the log instead of sending them, for local
+// development.
+type LogMailer struct{}
+
+func (LogMailer) Send(to, subject, body string) error {
+	log.Printf("mail to %s: %s\n%s", to, subject, body)
+	return nil
+}
+
+// newSMTPMailer returns a mailer for the server at addr, authenticating with
+// username and password if set.
+func newSMTPMailer(addr, from, username, password string) (*SMTPMailer, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid smtp address %q", addr)
+	}
+	if err := validAddress(from); err != nil {
+		return nil, err
+	}
+	m := &SMTPMailer{Addr: addr, From: from}
+	if username != "" {
+		m.Auth = smtp.PlainAuth("", username, password, host)
+	}
+	return m, nil
+}
+
+// validAddress checks that addr is a bare email address, eg, a@b.c, and
+// not a list or a display name that could change the headers of an email.
+func validAddress(addr string) error {
+	a, err := mail.ParseAddress(addr)
+	if err != nil || a.Name != "" || a.Address != addr {
+		return errors.Errorf("invalid email address %q", addr)
+	}
+	return nil
+}
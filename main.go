@@ -3,14 +3,22 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"log"
-	"path"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gocarina/gocsv"
 	"github.com/pkg/errors"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/tamalsaha/gdoc-expiring-link/scheduler"
 	csvtypes "gomodules.xyz/encoding/csv/types"
 	_ "gomodules.xyz/gdrive-utils"
 	gdrive "gomodules.xyz/gdrive-utils"
@@ -36,8 +44,63 @@ func handleError(err error, message string) {
 //}
 
 func main() {
+	cmd, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+	switch cmd {
+	case "serve":
+		runServe(args)
+	case "dead-letters":
+		runDeadLetters(args)
+	case "cache":
+		runCache(args)
+	case "migrate":
+		runMigrate(args)
+	case "config":
+		runConfig(args)
+	case "pause", "resume":
+		runClock(cmd, args)
+	case "extend":
+		runExtend(args)
+	case "reopen":
+		runReopen(args)
+	case "grade":
+		runGrade(args)
+	case "webhooks":
+		runWebhooks(args)
+	default:
+		log.Fatalf("unknown command %q, expected one of serve, dead-letters, cache, migrate, config, pause, resume, extend, reopen, grade, webhooks", cmd)
+	}
+}
+
+func runServe(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	var (
+		listen       = fs.String("listen", ":8080", "Address to serve candidate pages, metrics and health checks on")
+		dataDir      = fs.String("data-dir", "data", "Directory used to persist scheduled jobs")
+		adminToken   = fs.String("admin-token", os.Getenv("GDOC_ADMIN_TOKEN"), "Bearer token required by the /admin/ api, the api is disabled if empty")
+		maxAttempts  = fs.Int("max-attempts", scheduler.DefaultOptions().MaxAttempts, "Number of times a failed job is tried before it is moved to the dead letters")
+		backoff      = fs.Duration("retry-backoff", scheduler.DefaultOptions().Backoff, "Delay before a failed job is retried, doubled on every attempt")
+		maxBackoff   = fs.Duration("max-retry-backoff", scheduler.DefaultOptions().MaxBackoff, "Maximum delay between two attempts of a failed job")
+		cacheTTL     = fs.Duration("cache-ttl", time.Minute, "How long resolved folder ids and test configs are cached, 0 disables the cache")
+		persistCache = fs.Bool("persist-cache", false, "Keep cached folder ids and test configs in the data dir across restarts")
+		reconcile    = fs.Duration("reconcile-interval", time.Minute, "How often manual edits to the sheets of open tests are applied, 0 disables it")
+		smtpAddr     = fs.String("smtp-addr", "", "host:port of the SMTP server one-time codes are sent through, codes are logged if empty")
+		smtpFrom     = fs.String("smtp-from", "", "Sender address of one-time code emails")
+		smtpUsername = fs.String("smtp-username", "", "Username to authenticate to the SMTP server")
+		smtpPassword = fs.String("smtp-password", os.Getenv("GDOC_SMTP_PASSWORD"), "Password to authenticate to the SMTP server")
+		secret       = fs.String("session-secret", os.Getenv("GDOC_SESSION_SECRET"), "Key to sign candidate sessions with, a random key is used if empty")
+		oidcIssuer   = fs.String("oidc-issuer", "", "OpenID Connect issuer candidates sign in with before they start, eg, https://accounts.google.com, sign in is skipped if empty")
+		oidcClientID = fs.String("oidc-client-id", "", "OAuth client id registered with the issuer")
+		oidcSecret   = fs.String("oidc-client-secret", os.Getenv("GDOC_OIDC_CLIENT_SECRET"), "OAuth client secret registered with the issuer")
+		publicURL    = fs.String("public-url", "", "URL candidates reach the server at, eg, https://tests.example.com, used to build the sign in callback url")
+	)
+	_ = fs.Parse(args)
+
 	client, err := gdrive.DefaultClient(".")
 	handleError(err, "Error creating YouTube client")
+	client.Transport = instrumentTransport(client.Transport)
 
 	svcSheets, err := sheets.NewService(context.TODO(), option.WithHTTPClient(client))
 	handleError(err, "Error creating Sheets client")
@@ -48,26 +111,59 @@ func main() {
 	svcDocs, err := docs.NewService(context.TODO(), option.WithHTTPClient(client))
 	handleError(err, "Error creating Docs client")
 
-	email := "tamal.saha@gmail.com"
+	var cacheDB *leveldb.DB
+	if *persistCache {
+		cacheDB, err = leveldb.OpenFile(filepath.Join(*dataDir, "cache"), nil)
+		handleError(err, "Error opening cache db")
+		defer cacheDB.Close()
+	}
+	configureCaches(*cacheTTL, cacheDB)
 
-	configDocId := "1KB_Efi9jQcJ0_tCRF4fSLc6TR7QxaBKg05cKXAwbC9E"
-	//qaTemplateDocId := "16Ff6Lum3F6IeyAEy3P5Xy7R8CITIZRjdwnsRwBg9rD4"
-	//now := time.Now()
-	//cfg := QuestionConfig{
-	//	ConfigType:            ConfigTypeQuestion,
-	//	QuestionTemplateDocId: qaTemplateDocId,
-	//	StartDate:             Date{now},
-	//	EndDate:               Date{now.Add(5 * 24 * time.Hour)}, // 3 days
-	//	Duration:              Duration{90 * time.Minute},        // 60 mins
-	//}
-	//err = SaveConfig(svcSheets, configDocId, cfg)
-	//handleError(err, "failed to save config")
-
-	// cfg, err := LoadConfig(svcSheets, configDocId)
-	// handleError(err, "failed to save config")
-	// printJSON(cfg)
-
-	PostPage(svcDrive, svcDocs, svcSheets, configDocId, email)
+	sched, err := scheduler.NewScheduler(filepath.Join(*dataDir, "scheduler"), scheduler.Options{
+		MaxAttempts: *maxAttempts,
+		Backoff:     *backoff,
+		MaxBackoff:  *maxBackoff,
+	})
+	handleError(err, "Error opening scheduler db")
+	defer sched.Close()
+	registerSchedulerMetrics(sched)
+
+	stateDB, err := leveldb.OpenFile(filepath.Join(*dataDir, "state"), nil)
+	handleError(err, "Error opening state db")
+	defer stateDB.Close()
+
+	var mailer Mailer
+	if *smtpAddr != "" {
+		mailer, err = newSMTPMailer(*smtpAddr, *smtpFrom, *smtpUsername, *smtpPassword)
+		handleError(err, "Error configuring SMTP")
+	} else {
+		log.Println("no --smtp-addr set, one-time codes are logged instead of emailed")
+	}
+	if *secret == "" {
+		log.Println("no --session-secret set, candidates have to verify their email again after a restart")
+	}
+
+	var oidc *OIDCProvider
+	if *oidcIssuer != "" {
+		if *publicURL == "" || *oidcClientID == "" {
+			log.Fatal("--oidc-issuer requires --public-url and --oidc-client-id")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		oidc, err = NewOIDCProvider(ctx, *oidcIssuer, *oidcClientID, *oidcSecret, strings.TrimSuffix(*publicURL, "/")+"/oidc/callback")
+		cancel()
+		handleError(err, "Error configuring sign in")
+	}
+
+	srv := NewServer(svcDrive, svcDocs, svcSheets, sched, stateDB, ServerOptions{
+		AdminToken:        *adminToken,
+		ReconcileInterval: *reconcile,
+		Mailer:            mailer,
+		SessionSecret:     []byte(*secret),
+		OIDC:              oidc,
+	})
+	handleError(sched.Recover(), "Error recovering scheduled jobs")
+	log.Printf("listening on %s", *listen)
+	handleError(http.ListenAndServe(*listen, srv), "Error running server")
 }
 
 func main_() {
@@ -119,9 +215,47 @@ const (
 type QuestionConfig struct {
 	ConfigType            ConfigType        `json:"configType" csv:"Config Type"`
 	QuestionTemplateDocId string            `json:"questionTemplateDocId" csv:"Question Template Doc Id"`
-	StartDate             csvtypes.Date     `json:"startDate" csv:"Start Date"`
-	EndDate               csvtypes.Date     `json:"endDate" csv:"End Date"`
-	Duration              csvtypes.Duration `json:"duration"  csv:"Duration"`
+	StartDate             LocalTime         `json:"startDate" csv:"Start Date"`
+	EndDate               LocalTime         `json:"endDate" csv:"End Date"`
+	Duration              csvtypes.Duration `json:"duration"  csv:"Duration,default=0s"`
+	// TimeZone is the IANA name of the time zone Start Date and End Date are
+	// in, unless they have a UTC offset.
+	TimeZone string `json:"timeZone" csv:"Time Zone,default=UTC"`
+	// Mode decides when a candidate's test ends, one of timed, deadline or
+	// fixed-window.
+	Mode TestMode `json:"mode" csv:"Mode,default=timed"`
+	// MaxAttempts is the number of times a candidate may take the test.
+	MaxAttempts int `json:"maxAttempts" csv:"Max Attempts,default=1"`
+	// RetakeCooldown is how long a candidate has to wait after the end of an
+	// attempt before starting the next one.
+	RetakeCooldown csvtypes.Duration `json:"retakeCooldown" csv:"Retake Cooldown,default=0s"`
+	// PoolSize is the number of pre-copied template docs kept ready for
+	// candidates starting the test.
+	PoolSize int `json:"poolSize" csv:"Pool Size,default=0"`
+	// Instructions are shown to candidates before they start the test.
+	Instructions string `json:"instructions" csv:"Instructions"`
+	// Warnings are how long before the end of the test the countdown page
+	// warns the candidate, eg, 10m, 5m, 1m.
+	Warnings DurationList `json:"warnings" csv:"Countdown Warnings"`
+}
+
+// CanRetake checks the retake rules of the test against the previous, ended
+// attempts of a candidate.
+func (cfg QuestionConfig) CanRetake(history []*TestAnswer, now time.Time) error {
+	if len(history) == 0 {
+		return nil
+	}
+	last := history[len(history)-1]
+	if cfg.MaxAttempts <= 1 {
+		return errors.Errorf("%s passed after test has ended!", now.Sub(last.EndDate.Time))
+	}
+	if len(history) >= cfg.MaxAttempts {
+		return errors.Errorf("all %d attempts of this test have been used", cfg.MaxAttempts)
+	}
+	if next := last.EndDate.Add(cfg.RetakeCooldown.Duration); now.Before(next) {
+		return errors.Errorf("the test can be retaken in %s", next.Sub(now).Round(time.Minute))
+	}
+	return nil
 }
 
 const (
@@ -134,7 +268,7 @@ func SaveConfig(svcSheets *sheets.Service, configDocId string, cfg QuestionConfi
 		Header: "Config Type",
 		By: func(column []interface{}) (int, error) {
 			for i, v := range column {
-				if v.(string) == string(cfg.ConfigType) {
+				if cellString(v) == string(cfg.ConfigType) {
 					return i, nil
 				}
 			}
@@ -145,15 +279,23 @@ func SaveConfig(svcSheets *sheets.Service, configDocId string, cfg QuestionConfi
 	data := []*QuestionConfig{
 		&cfg,
 	}
+	configCache.Invalidate(configDocId)
 	return gocsv.MarshalCSV(data, w)
 }
 
+// LoadConfig reads the question config of the test. Parsed configs are kept
+// in configCache.
 func LoadConfig(svcSheets *sheets.Service, configDocId string) (*QuestionConfig, error) {
+	var cached QuestionConfig
+	if configCache.Get(configDocId, &cached) {
+		return &cached, nil
+	}
+
 	r, err := gdrive.NewRowReader(svcSheets, configDocId, ProjectConfigSheet, &gdrive.Predicate{
 		Header: "Config Type",
 		By: func(column []interface{}) (int, error) {
 			for i, v := range column {
-				if v.(string) == string(ConfigTypeQuestion) {
+				if cellString(v) == string(ConfigTypeQuestion) {
 					return i, nil
 				}
 			}
@@ -170,73 +312,134 @@ func LoadConfig(svcSheets *sheets.Service, configDocId string) (*QuestionConfig,
 	if err := gocsv.UnmarshalCSV(r, &configs); err != nil { // Load clients from file
 		return nil, err
 	}
+	if err := configs[0].resolveTimeZone(); err != nil {
+		return nil, err
+	}
+	configCache.Set(configDocId, configs[0])
 	return configs[0], nil
 }
 
 type TestAnswer struct {
+	// Id identifies the row of the answer in the test sheet. It is kept in
+	// the developer metadata of the row, not in a column.
+	Id        string             `json:"id,omitempty" csv:"-"`
 	Email     string             `json:"email" csv:"Email"`
 	DocId     string             `json:"docId"  csv:"Doc Id"`
 	StartDate csvtypes.Timestamp `json:"startDate" csv:"Start Date"`
 	EndDate   csvtypes.Timestamp `json:"endDate" csv:"End Date"`
+	// Attempt numbers the attempts of a candidate, starting from 1.
+	Attempt int `json:"attempt" csv:"Attempt,default=1"`
+	// TimeZone is the IANA name of the time zone times are shown to the
+	// candidate in.
+	TimeZone string `json:"timeZone" csv:"Time Zone"`
+	// PausedAt is set while the candidate's clock is paused.
+	PausedAt OptionalTimestamp `json:"pausedAt" csv:"Paused At"`
+	// Paused is the total time the candidate's clock was paused.
+	Paused csvtypes.Duration `json:"paused" csv:"Paused,default=0s"`
+	// ReopenedAt is set when access was granted again after the test ended.
+	// The new window runs from ReopenedAt to EndDate.
+	ReopenedAt   OptionalTimestamp `json:"reopenedAt" csv:"Reopened At"`
+	ReopenReason string            `json:"reopenReason" csv:"Reopen Reason"`
+	// Account is the Google account the candidate signed in with, if it is
+	// not Email. Access to the doc is granted to it instead of Email.
+	Account string `json:"account,omitempty" csv:"Google Account"`
+	// ConsentedAt is when the candidate confirmed they are ready to start.
+	ConsentedAt OptionalTimestamp `json:"consentedAt" csv:"Consented At"`
+	// SubmittedAt is set when the candidate submitted the test before its
+	// end. It is cleared when the test is reopened.
+	SubmittedAt OptionalTimestamp `json:"submittedAt" csv:"Submitted At"`
+	// Grade is the result recorded by a reviewer once the test ended.
+	Grade    string            `json:"grade,omitempty" csv:"Grade"`
+	GradedAt OptionalTimestamp `json:"gradedAt" csv:"Graded At"`
 }
 
-func SaveTestAnswer(svcSheets *sheets.Service, configDocId string, ans TestAnswer) error {
-	w := gdrive.NewRowWriter(svcSheets, configDocId, ProjectTestSheet, &gdrive.Predicate{
-		Header: "Email",
-		By: func(column []interface{}) (int, error) {
-			for i, v := range column {
-				if v.(string) == ans.Email {
-					return i, nil
-				}
-			}
-			return -1, io.EOF
-		},
-	})
+// Grantee returns the Google account that has access to the candidate's doc.
+func (ans TestAnswer) Grantee() string {
+	if ans.Account != "" {
+		return ans.Account
+	}
+	return ans.Email
+}
+
+// DocName is the name of the candidate's copy of the template for this attempt.
+func (ans TestAnswer) DocName() string {
+	return fmt.Sprintf("%s - Test %s - Attempt %d", ans.Email, ans.StartDate.Format("2006-01-02"), ans.Attempt)
+}
 
-	data := []*TestAnswer{
-		&ans,
+// SaveTestAnswer updates the row of ans, identified by its row id, or appends
+// a new one and sets the row id of ans.
+func SaveTestAnswer(svcSheets *sheets.Service, configDocId string, ans *TestAnswer) error {
+	ts, err := LoadTestSheet(svcSheets, configDocId)
+	if err != nil {
+		return err
 	}
-	return gocsv.MarshalCSV(data, w)
+	if _, err := ts.Set(ans); err != nil {
+		return err
+	}
+	return ts.Flush()
 }
 
+// LoadTestAnswer returns the latest attempt of email, or io.EOF if email has
+// not started the test yet.
 func LoadTestAnswer(svcSheets *sheets.Service, configDocId, email string) (*TestAnswer, error) {
-	r, err := gdrive.NewRowReader(svcSheets, configDocId, ProjectTestSheet, &gdrive.Predicate{
-		Header: "Email",
-		By: func(column []interface{}) (int, error) {
-			for i, v := range column {
-				if v.(string) == email {
-					return i, nil
-				}
-			}
-			return -1, io.EOF
-		},
-	})
-	//if err == io.EOF {
-	//	return nil, errors.Errorf("%s has not started the test yet!", email)
-	//} else
+	history, err := LoadTestAnswers(svcSheets, configDocId, email)
 	if err != nil {
 		return nil, err
 	}
+	if len(history) == 0 {
+		return nil, io.EOF
+	}
+	return history[len(history)-1], nil
+}
 
-	answers := []*TestAnswer{}
-	if err := gocsv.UnmarshalCSV(r, &answers); err != nil {
+// LoadTestAnswers returns all attempts of email ordered by attempt number.
+func LoadTestAnswers(svcSheets *sheets.Service, configDocId, email string) ([]*TestAnswer, error) {
+	ts, err := LoadTestSheet(svcSheets, configDocId)
+	if err != nil {
 		return nil, err
 	}
-	return answers[0], nil
+	var history []*TestAnswer
+	for _, row := range ts.ByEmail(email) {
+		ans := row.Answer
+		history = append(history, &ans)
+	}
+	sort.SliceStable(history, func(i, j int) bool {
+		return history[i].Attempt < history[j].Attempt
+	})
+	return history, nil
 }
 
-func GetTestPage(svcSheets *sheets.Service, configDocId string) {
+func GetTestPage(svcSheets *sheets.Service, configDocId string) (*QuestionConfig, error) {
 	cfg, err := LoadConfig(svcSheets, configDocId)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	if time.Now().After(cfg.EndDate.Time) {
-		panic("Time passed for this test")
+		return nil, errors.New("Time passed for this test")
 	}
-	fmt.Printf("%s left to take the test!", time.Until(cfg.EndDate.Time))
+	return cfg, nil
 }
 
-func PostPage(svcDrive *drive.Service, svcDocs *docs.Service, svcSheets *sheets.Service, configDocId, email string) {
+// StartRequest is a candidate's confirmation to start a test.
+type StartRequest struct {
+	Email string
+	// Account is the Google account to grant access to, if it is not Email.
+	Account string
+	// TimeZone is the time zone of the candidate, times in their doc are
+	// shown in it.
+	TimeZone    string
+	ConsentedAt time.Time
+}
+
+// PostPage starts the test for the candidate of req, unless it has already
+// been started. The returned bool reports whether a new test doc was created
+// by this call. The candidate gets access to the doc from Server.Start, once
+// the revoke is scheduled.
+func PostPage(svcDrive *drive.Service, svcDocs *docs.Service, svcSheets *sheets.Service, configDocId string, req StartRequest) (*TestAnswer, bool, error) {
+	email := req.Email
+	if req.ConsentedAt.IsZero() {
+		return nil, false, errors.New("the candidate has not confirmed the start of the test")
+	}
 	// already submitted
 	// started and x min left to finish the test, redirect, embed
 	// did not start, copy file, stat clock
@@ -245,50 +448,67 @@ func PostPage(svcDrive *drive.Service, svcDocs *docs.Service, svcSheets *sheets.
 
 	cfg, err := LoadConfig(svcSheets, configDocId)
 	if err != nil {
-		panic(err)
+		return nil, false, err
 	}
 
 	if now.After(cfg.EndDate.Time) {
-		panic("Time passed for this test")
+		return nil, false, errors.New("Time passed for this test")
 	}
-	ans, err := LoadTestAnswer(svcSheets, configDocId, email)
-	if err != nil && err != io.EOF {
-		panic(err) // some error
+	if now.Before(cfg.StartDate.Time) {
+		return nil, false, errors.Errorf("the test opens at %s", formatTime(cfg.StartDate.Time, cfg.StartDate.Location()))
 	}
-	if err == nil {
-		if now.After(ans.EndDate.Time) {
-			panic(fmt.Sprintf("%s passed after test has ended!", time.Since(ans.EndDate.Time)))
+	history, err := LoadTestAnswers(svcSheets, configDocId, email)
+	if err != nil {
+		return nil, false, err
+	}
+	attempt := 1
+	if n := len(history); n > 0 {
+		last := history[n-1]
+		if now.Before(last.EndDate.Time) {
+			return last, false, nil
 		}
-	} else {
-		ans = &TestAnswer{
-			Email:     email,
-			DocId:     "",
-			StartDate: csvtypes.Timestamp{now},
-			EndDate:   csvtypes.Timestamp{now.Add(cfg.Duration.Duration)},
+		if err := cfg.CanRetake(history, now); err != nil {
+			return nil, false, err
 		}
+		attempt = last.Attempt + 1
+	}
 
-		folderId, err := gdrive.GetFolderId(svcDrive, configDocId, path.Join("candidates", email))
-		if err != nil {
-			panic(err)
-		}
-		docName := fmt.Sprintf("%s - Test %s", email, ans.StartDate.Format("2006-01-02"))
-		docId, err := gdrive.CopyDoc(
-			svcDrive, svcDocs, cfg.QuestionTemplateDocId, folderId, docName, map[string]string{
-				"{{email}}":      email,
-				"{{start-time}}": ans.StartDate.Format(time.RFC3339),
-				"{{end-time}}":   ans.EndDate.Format(time.RFC3339),
-			})
-		if err != nil {
-			panic(err)
-		}
-		ans.DocId = docId
+	end, err := cfg.EndTime(now)
+	if err != nil {
+		return nil, false, err
+	}
+	ans := &TestAnswer{
+		Email:       email,
+		DocId:       "",
+		StartDate:   csvtypes.Timestamp{Time: now},
+		EndDate:     csvtypes.Timestamp{Time: end},
+		Attempt:     attempt,
+		TimeZone:    displayZone(cfg, req.TimeZone),
+		ConsentedAt: OptionalTimestamp{Time: req.ConsentedAt},
+	}
+	if req.Account != email {
+		ans.Account = req.Account
+	}
 
-		err = SaveTestAnswer(svcSheets, configDocId, *ans)
-		if err != nil {
-			panic(err)
-		}
+	folderId, err := GetFolderId(svcDrive, configDocId, "candidates", email)
+	if err != nil {
+		return nil, false, err
 	}
+	docId, err := NewTestDoc(
+		svcDrive, svcDocs, configDocId, cfg.QuestionTemplateDocId, folderId, ans.DocName(), map[string]string{
+			"{{email}}":      email,
+			"{{start-time}}": formatTime(ans.StartDate.Time, ans.Location()),
+			"{{end-time}}":   formatTime(ans.EndDate.Time, ans.Location()),
+			"{{attempt}}":    strconv.Itoa(ans.Attempt),
+		})
+	if err != nil {
+		return nil, false, err
+	}
+	ans.DocId = docId
 
-	fmt.Printf("%s left to take the test!\n", time.Until(ans.EndDate.Time))
-	fmt.Printf("https://docs.google.com/document/d/%s/edit\n", ans.DocId)
+	err = SaveTestAnswer(svcSheets, configDocId, ans)
+	if err != nil {
+		return nil, false, err
+	}
+	return ans, true, nil
 }
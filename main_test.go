@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	csvtypes "gomodules.xyz/encoding/csv/types"
+)
+
+func TestCanRetake(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	ended := func(ago ...time.Duration) []*TestAnswer {
+		var history []*TestAnswer
+		for i, d := range ago {
+			history = append(history, &TestAnswer{Attempt: i + 1, EndDate: csvtypes.Timestamp{Time: now.Add(-d)}})
+		}
+		return history
+	}
+	for name, tc := range map[string]struct {
+		maxAttempts int
+		cooldown    time.Duration
+		history     []*TestAnswer
+		err         string
+	}{
+		"first attempt":               {1, 0, nil, ""},
+		"single attempt used":         {1, 0, ended(time.Hour), "passed after test has ended"},
+		"default max attempts":        {0, 0, ended(time.Hour), "passed after test has ended"},
+		"second of three":             {3, 0, ended(time.Hour), ""},
+		"third of three":              {3, 0, ended(2*time.Hour, time.Hour), ""},
+		"all attempts used":           {3, 0, ended(3*time.Hour, 2*time.Hour, time.Hour), "all 3 attempts"},
+		"cooldown from the end":       {2, 2 * time.Hour, ended(time.Hour), "can be retaken in 1h0m0s"},
+		"cooldown over":               {2, time.Hour, ended(time.Hour), ""},
+		"cooldown from latest ending": {3, time.Hour, ended(3*time.Hour, 30*time.Minute), "can be retaken in 30m0s"},
+	} {
+		cfg := QuestionConfig{MaxAttempts: tc.maxAttempts, RetakeCooldown: csvtypes.Duration{Duration: tc.cooldown}}
+		err := cfg.CanRetake(tc.history, now)
+		switch {
+		case tc.err == "" && err != nil:
+			t.Errorf("%s: unexpected error %v", name, err)
+		case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+			t.Errorf("%s: got error %v, want %q", name, err, tc.err)
+		}
+	}
+}
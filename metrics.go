@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tamalsaha/gdoc-expiring-link/scheduler"
+)
+
+var (
+	testStartsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gdoc_test_starts_total",
+		Help: "Number of tests started by candidates.",
+	})
+	testSubmissionsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gdoc_test_submissions_total",
+		Help: "Number of tests submitted by candidates before the deadline.",
+	})
+	revokesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gdoc_revokes_total",
+		Help: "Number of attempts to revoke candidate access to a test doc, by result.",
+	}, []string{"result"})
+	otpTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gdoc_otp_total",
+		Help: "Number of one-time codes sent to and checked for candidates, by result.",
+	}, []string{"result"})
+	webhookDeliveriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gdoc_webhook_deliveries_total",
+		Help: "Number of attempts to deliver an event to a webhook, by result.",
+	}, []string{"result"})
+
+	googleAPIRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gdoc_google_api_request_duration_seconds",
+		Help:    "Latency of Google API calls, by method and HTTP status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "code"})
+	googleAPIErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gdoc_google_api_errors_total",
+		Help: "Number of failed Google API calls, by method.",
+	}, []string{"method"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		testStartsTotal,
+		testSubmissionsTotal,
+		revokesTotal,
+		otpTotal,
+		webhookDeliveriesTotal,
+		googleAPIRequestDuration,
+		googleAPIErrorsTotal,
+	)
+}
+
+// registerSchedulerMetrics exposes the depth of the in-memory task queue of sched.
+func registerSchedulerMetrics(sched *scheduler.Scheduler) {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "gdoc_scheduler_queue_depth",
+		Help: "Number of jobs waiting in the scheduler queue.",
+	}, func() float64 {
+		return float64(sched.Len())
+	}))
+}
+
+func resultLabel(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+type instrumentedTransport struct {
+	next http.RoundTripper
+}
+
+// instrumentTransport wraps rt so that every Google API call made through it
+// is recorded in the google api latency and error metrics.
+func instrumentTransport(rt http.RoundTripper) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return &instrumentedTransport{next: rt}
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	method := apiMethod(req)
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	googleAPIRequestDuration.WithLabelValues(method, code).Observe(time.Since(start).Seconds())
+	if err != nil || resp.StatusCode >= http.StatusBadRequest {
+		googleAPIErrorsTotal.WithLabelValues(method).Inc()
+	}
+	return resp, err
+}
+
+var versionSegment = regexp.MustCompile(`^v\d+(beta\d*)?$`)
+
+// apiMethod turns a Google API request into a low cardinality label, eg,
+//
+//	GET https://www.googleapis.com/drive/v3/files/<id>/permissions -> GET drive/files/{id}/permissions
+//	POST https://docs.googleapis.com/v1/documents/<id>:batchUpdate -> POST docs/documents/{id}:batchUpdate
+//
+// Google REST paths alternate between collection names and resource ids, so
+// every second segment after the version is replaced with {id}.
+func apiMethod(req *http.Request) string {
+	service := strings.TrimSuffix(req.URL.Host, ".googleapis.com")
+	segments := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	if len(segments) > 0 && segments[0] == "upload" {
+		segments = segments[1:]
+	}
+	if service == "www" && len(segments) > 0 {
+		service = segments[0]
+		segments = segments[1:]
+	}
+	if len(segments) > 0 && versionSegment.MatchString(segments[0]) {
+		segments = segments[1:]
+	}
+
+	parts := []string{service}
+	for i, seg := range segments {
+		if i%2 == 1 {
+			verb := ""
+			if idx := strings.LastIndex(seg, ":"); idx >= 0 {
+				verb = seg[idx:]
+			}
+			seg = "{id}" + verb
+		}
+		parts = append(parts, seg)
+	}
+	return req.Method + " " + strings.Join(parts, "/")
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TestMode decides when a candidate's test ends.
+type TestMode string
+
+const (
+	// TestModeTimed is a strict timed session: the candidate gets Duration
+	// from the moment they start.
+	TestModeTimed TestMode = "timed"
+	// TestModeDeadline is a take-home: the candidate gets Duration from the
+	// moment they start, but no longer than the End Date of the test. Without
+	// a Duration, everyone has until the End Date.
+	TestModeDeadline TestMode = "deadline"
+	// TestModeFixedWindow is a screening with a hard common end: everyone's
+	// test ends at the End Date, whenever they start.
+	TestModeFixedWindow TestMode = "fixed-window"
+)
+
+// modeReminders are how long before the end of a test the candidate is
+// reminded, by mode.
+var modeReminders = map[TestMode][]time.Duration{
+	TestModeTimed:       {10 * time.Minute},
+	TestModeDeadline:    {24 * time.Hour, time.Hour},
+	TestModeFixedWindow: {time.Hour, 10 * time.Minute},
+}
+
+func (m TestMode) valid() bool {
+	_, ok := modeReminders[m]
+	return ok
+}
+
+// Reminders returns how long before the end of the test the candidate is
+// reminded.
+func (m TestMode) Reminders() []time.Duration {
+	return modeReminders[m]
+}
+
+// TestMode returns the mode of the test. Configs written before modes were
+// added are timed.
+func (cfg QuestionConfig) TestMode() TestMode {
+	if cfg.Mode == "" {
+		return TestModeTimed
+	}
+	return cfg.Mode
+}
+
+// EndTime returns when the test of a candidate starting at start ends.
+func (cfg QuestionConfig) EndTime(start time.Time) (time.Time, error) {
+	switch cfg.TestMode() {
+	case TestModeTimed:
+		return start.Add(cfg.Duration.Duration), nil
+	case TestModeDeadline:
+		if end := start.Add(cfg.Duration.Duration); cfg.Duration.Duration > 0 && end.Before(cfg.EndDate.Time) {
+			return end, nil
+		}
+		return cfg.EndDate.Time, nil
+	case TestModeFixedWindow:
+		return cfg.EndDate.Time, nil
+	}
+	return time.Time{}, errors.Errorf("unknown test mode %q", cfg.Mode)
+}
+
+// LatestEnd returns when the last candidate's test can end at the latest.
+func (cfg QuestionConfig) LatestEnd() time.Time {
+	if cfg.TestMode() == TestModeTimed {
+		return cfg.EndDate.Add(cfg.Duration.Duration)
+	}
+	return cfg.EndDate.Time
+}
+
+// Describe returns the landing page copy explaining how much time the
+// candidate gets, with times shown in loc.
+func (cfg QuestionConfig) Describe(loc *time.Location) string {
+	switch cfg.TestMode() {
+	case TestModeDeadline:
+		if cfg.Duration.Duration > 0 {
+			return fmt.Sprintf("This is a take-home test. Once you start, you have %s to submit it, but no later than %s.", cfg.Duration.Duration, formatTime(cfg.EndDate.Time, loc))
+		}
+		return fmt.Sprintf("This is a take-home test. You can work on it until %s.", formatTime(cfg.EndDate.Time, loc))
+	case TestModeFixedWindow:
+		return fmt.Sprintf("The test ends for everyone at %s, no matter when you start. Start early to get the full time.", formatTime(cfg.EndDate.Time, loc))
+	default:
+		return fmt.Sprintf("This is a timed test. The clock starts when you click start, and you have %s to finish it.", cfg.Duration.Duration)
+	}
+}
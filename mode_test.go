@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	csvtypes "gomodules.xyz/encoding/csv/types"
+)
+
+func TestEndTime(t *testing.T) {
+	open := time.Date(2022, 6, 1, 9, 0, 0, 0, time.UTC)
+	end := open.AddDate(0, 0, 7)
+	cfg := func(mode TestMode, d time.Duration) QuestionConfig {
+		return QuestionConfig{
+			Mode:      mode,
+			StartDate: LocalTime{Time: open},
+			EndDate:   LocalTime{Time: end},
+			Duration:  csvtypes.Duration{Duration: d},
+		}
+	}
+	start := open.Add(2 * time.Hour)
+	late := end.Add(-time.Hour)
+
+	cases := []struct {
+		name  string
+		cfg   QuestionConfig
+		start time.Time
+		want  time.Time
+	}{
+		{"timed", cfg(TestModeTimed, time.Hour), start, start.Add(time.Hour)},
+		{"timed started late", cfg(TestModeTimed, 2*time.Hour), late, late.Add(2 * time.Hour)},
+		{"configs without mode are timed", cfg("", time.Hour), start, start.Add(time.Hour)},
+		{"deadline", cfg(TestModeDeadline, 72*time.Hour), start, start.Add(72 * time.Hour)},
+		{"deadline capped at the end date", cfg(TestModeDeadline, 72*time.Hour), late, end},
+		{"deadline without duration", cfg(TestModeDeadline, 0), start, end},
+		{"fixed window", cfg(TestModeFixedWindow, time.Hour), start, end},
+	}
+	for _, c := range cases {
+		got, err := c.cfg.EndTime(c.start)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if !got.Equal(c.want) {
+			t.Errorf("%s: EndTime() = %s, want %s", c.name, got, c.want)
+		}
+	}
+
+	if _, err := cfg("marathon", time.Hour).EndTime(start); err == nil {
+		t.Error("expected error for an unknown mode")
+	}
+}
+
+func TestModeReminders(t *testing.T) {
+	for _, mode := range []TestMode{TestModeTimed, TestModeDeadline, TestModeFixedWindow} {
+		if len(mode.Reminders()) == 0 {
+			t.Errorf("no reminders for mode %s", mode)
+		}
+	}
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/jws"
+)
+
+const (
+	// oidcLoginTTL is how long a candidate has to sign in with the issuer.
+	oidcLoginTTL = 10 * time.Minute
+	// oidcLeeway is the clock skew allowed when checking the expiry of an
+	// ID token.
+	oidcLeeway = time.Minute
+
+	oidcCookie = "gdoc_oidc"
+)
+
+// OIDCProvider signs candidates in with an OpenID Connect issuer, eg,
+// https://accounts.google.com, to learn the Google account they use.
+type OIDCProvider struct {
+	Issuer  string
+	config  oauth2.Config
+	jwksURI string
+
+	mu   sync.Mutex
+	keys map[string]*rsa.PublicKey
+}
+
+// oidcDiscovery is the part of the discovery document of an issuer used to
+// sign in.
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// IDClaims are the claims of an ID token used to identify a candidate.
+type IDClaims struct {
+	Issuer        string   `json:"iss"`
+	Audience      audience `json:"aud"`
+	Subject       string   `json:"sub"`
+	Expiry        int64    `json:"exp"`
+	Nonce         string   `json:"nonce"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"email_verified"`
+}
+
+// audience is the aud claim, a string or a list of strings.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+func (a audience) contains(v string) bool {
+	for _, s := range a {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// NewOIDCProvider reads the discovery document of issuer. Candidates are sent
+// back to redirectURL, which is served by the oidc callback.
+func NewOIDCProvider(ctx context.Context, issuer, clientID, clientSecret, redirectURL string) (*OIDCProvider, error) {
+	issuer = strings.TrimSuffix(issuer, "/")
+	var d oidcDiscovery
+	if err := getJSON(ctx, issuer+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, errors.Wrapf(err, "failed to discover oidc issuer %s", issuer)
+	}
+	if strings.TrimSuffix(d.Issuer, "/") != issuer {
+		return nil, errors.Errorf("oidc issuer %s reports a different issuer %s", issuer, d.Issuer)
+	}
+	return &OIDCProvider{
+		Issuer: issuer,
+		config: oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			Endpoint: oauth2.Endpoint{
+				AuthURL:   d.AuthorizationEndpoint,
+				TokenURL:  d.TokenEndpoint,
+				AuthStyle: oauth2.AuthStyleInParams,
+			},
+			RedirectURL: redirectURL,
+			Scopes:      []string{"openid", "email"},
+		},
+		jwksURI: d.JWKSURI,
+		keys:    map[string]*rsa.PublicKey{},
+	}, nil
+}
+
+func getJSON(ctx context.Context, u string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// AuthCodeURL returns the url of the issuer's sign in page. The account of
+// loginHint is suggested, but the candidate can pick another one.
+func (p *OIDCProvider) AuthCodeURL(state, nonce, loginHint string) string {
+	return p.config.AuthCodeURL(state,
+		oauth2.SetAuthURLParam("nonce", nonce),
+		oauth2.SetAuthURLParam("login_hint", loginHint),
+		oauth2.SetAuthURLParam("prompt", "select_account"))
+}
+
+// Exchange redeems the code the issuer sent the candidate back with, and
+// returns the claims of their verified ID token.
+func (p *OIDCProvider) Exchange(ctx context.Context, code, nonce string) (*IDClaims, error) {
+	tok, err := p.config.Exchange(ctx, code)
+	if err != nil {
+		return nil, err
+	}
+	raw, ok := tok.Extra("id_token").(string)
+	if !ok || raw == "" {
+		return nil, errors.New("no id token in the token response")
+	}
+	return p.Verify(ctx, raw, nonce)
+}
+
+// Verify checks the signature and claims of an ID token issued for the
+// sign in with nonce.
+func (p *OIDCProvider) Verify(ctx context.Context, raw, nonce string) (*IDClaims, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed id token")
+	}
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, errors.Wrap(err, "malformed id token header")
+	}
+	if header.Algorithm != "RS256" {
+		return nil, errors.Errorf("unsupported id token algorithm %q", header.Algorithm)
+	}
+	key, err := p.key(ctx, header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	if err := jws.Verify(raw, key); err != nil {
+		return nil, errors.Wrap(err, "invalid id token signature")
+	}
+
+	var claims IDClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, errors.Wrap(err, "malformed id token claims")
+	}
+	switch {
+	case strings.TrimSuffix(claims.Issuer, "/") != p.Issuer:
+		return nil, errors.Errorf("id token issued by %s", claims.Issuer)
+	case !claims.Audience.contains(p.config.ClientID):
+		return nil, errors.New("id token issued for another client")
+	case time.Now().Add(-oidcLeeway).After(time.Unix(claims.Expiry, 0)):
+		return nil, errors.New("id token expired")
+	case !hmac.Equal([]byte(claims.Nonce), []byte(nonce)):
+		return nil, errors.New("id token issued for another sign in")
+	case claims.Email == "" || !claims.EmailVerified:
+		return nil, errors.New("the account has no verified email")
+	}
+	return &claims, nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// key returns the signing key of the issuer with the id kid. The keys are
+// fetched again when kid is unknown, as issuers rotate them.
+func (p *OIDCProvider) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+
+	var set struct {
+		Keys []struct {
+			KeyType string `json:"kty"`
+			KeyID   string `json:"kid"`
+			N       string `json:"n"`
+			E       string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := getJSON(ctx, p.jwksURI, &set); err != nil {
+		return nil, errors.Wrap(err, "failed to fetch oidc signing keys")
+	}
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range set.Keys {
+		if k.KeyType != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			continue
+		}
+		keys[k.KeyID] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	p.keys = keys
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, errors.Errorf("unknown id token signing key %q", kid)
+}
+
+// oidcLogin is a sign in in progress, kept in a signed cookie until the
+// issuer sends the candidate back.
+type oidcLogin struct {
+	ConfigDocId string    `json:"configDocId"`
+	Email       string    `json:"email"`
+	State       string    `json:"state"`
+	Nonce       string    `json:"nonce"`
+	Bind        bool      `json:"bind"`
+	Expires     time.Time `json:"expires"`
+}
+
+// signedInAccount returns the account to grant access to when the candidate
+// invited as email signs in as account. Another account than email is only
+// used if the candidate asked to bind it.
+func signedInAccount(email, account string, bind bool) (string, error) {
+	account = normalizeEmail(account)
+	if account == email || bind {
+		return account, nil
+	}
+	return "", errors.Errorf("you signed in to Google as %s, but the test was sent to %s", account, email)
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// login serves GET /tests/<configDocId>/login?bind=<bool>
+//
+// It sends a verified candidate to the issuer to sign in with the Google
+// account they will use for the test. With bind set, the account is used
+// even if it is not the email the test was sent to.
+func (s *Server) login(w http.ResponseWriter, r *http.Request, configDocId string) {
+	p := s.opts.OIDC
+	if p == nil {
+		http.NotFound(w, r)
+		return
+	}
+	sess, ok := s.session(r, configDocId)
+	if !ok {
+		http.Error(w, "verify your email before signing in", http.StatusUnauthorized)
+		return
+	}
+	state, err := randomHex(16)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	nonce, err := randomHex(16)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	login := oidcLogin{
+		ConfigDocId: configDocId,
+		Email:       sess.Email,
+		State:       state,
+		Nonce:       nonce,
+		Bind:        r.FormValue("bind") == "true",
+		Expires:     time.Now().Add(oidcLoginTTL),
+	}
+	value, err := s.encodeCookie("oidc", login)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookie,
+		Value:    value,
+		Path:     "/oidc/",
+		Expires:  login.Expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, p.AuthCodeURL(state, nonce, sess.Email), http.StatusFound)
+}
+
+// oidcCallback serves GET /oidc/callback?state=<state>&code=<code>
+//
+// The issuer sends the candidate back to it after they signed in. The
+// account they signed in with is recorded in their session, and used to
+// grant access when they start the test.
+func (s *Server) oidcCallback(w http.ResponseWriter, r *http.Request) {
+	p := s.opts.OIDC
+	if p == nil {
+		http.NotFound(w, r)
+		return
+	}
+	c, err := r.Cookie(oidcCookie)
+	var login oidcLogin
+	if err != nil || !s.decodeCookie("oidc", c.Value, &login) || time.Now().After(login.Expires) ||
+		!hmac.Equal([]byte(login.State), []byte(r.FormValue("state"))) {
+		http.Error(w, "sign in expired, start again from the test page", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcCookie, Path: "/oidc/", MaxAge: -1})
+	if e := r.FormValue("error"); e != "" {
+		http.Error(w, "sign in failed: "+e, http.StatusForbidden)
+		return
+	}
+
+	claims, err := p.Exchange(r.Context(), r.FormValue("code"), login.Nonce)
+	if err != nil {
+		log.Printf("failed to sign in %s for test %s: %v", login.Email, login.ConfigDocId, err)
+		http.Error(w, "sign in failed, try again", http.StatusForbidden)
+		return
+	}
+	account, err := signedInAccount(login.Email, claims.Email, login.Bind)
+	if err != nil {
+		q := url.Values{"bind": {"true"}}
+		msg := fmt.Sprintf("%s. Sign in as %s, or use %s for the test: /tests/%s/login?%s",
+			err, login.Email, normalizeEmail(claims.Email), login.ConfigDocId, q.Encode())
+		http.Error(w, msg, http.StatusForbidden)
+		return
+	}
+	if account != login.Email {
+		log.Printf("%s uses the Google account %s in test %s", login.Email, account, login.ConfigDocId)
+	}
+
+	sess := &Session{
+		ConfigDocId: login.ConfigDocId,
+		Email:       login.Email,
+		Method:      "oidc",
+		Account:     account,
+		Expires:     time.Now().Add(sessionTTL),
+	}
+	if err := s.setSession(w, r, sess); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/tests/"+login.ConfigDocId, http.StatusSeeOther)
+}
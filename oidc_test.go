@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mockIssuer is a local OpenID Connect issuer. Its token endpoint returns an
+// ID token with the claims returned by claims.
+type mockIssuer struct {
+	*httptest.Server
+	key    *rsa.PrivateKey
+	claims func() map[string]interface{}
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockIssuer{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, oidcDiscovery{
+			Issuer:                m.URL,
+			AuthorizationEndpoint: m.URL + "/authorize",
+			TokenEndpoint:         m.URL + "/token",
+			JWKSURI:               m.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "k1",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != "good-code" {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, map[string]interface{}{
+			"access_token": "at",
+			"token_type":   "Bearer",
+			"id_token":     m.sign(t, "k1", m.claims()),
+		})
+	})
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+func (m *mockIssuer) sign(t *testing.T, kid string, claims map[string]interface{}) string {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": kid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, m.key, crypto.SHA256, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func (m *mockIssuer) idClaims(nonce, email string) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":            m.URL,
+		"aud":            "client",
+		"sub":            "123",
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"nonce":          nonce,
+		"email":          email,
+		"email_verified": true,
+	}
+}
+
+func TestOIDCVerify(t *testing.T) {
+	m := newMockIssuer(t)
+	p, err := NewOIDCProvider(context.Background(), m.URL, "client", "secret", "http://localhost/oidc/callback")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := p.Verify(context.Background(), m.sign(t, "k1", m.idClaims("n", "a@b.c")), "n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Email != "a@b.c" {
+		t.Errorf("got email %q", claims.Email)
+	}
+
+	for name, tc := range map[string]struct {
+		kid    string
+		change func(c map[string]interface{})
+	}{
+		"wrong nonce":      {"k1", func(c map[string]interface{}) { c["nonce"] = "other" }},
+		"wrong audience":   {"k1", func(c map[string]interface{}) { c["aud"] = []string{"other"} }},
+		"wrong issuer":     {"k1", func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" }},
+		"expired":          {"k1", func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() }},
+		"unverified email": {"k1", func(c map[string]interface{}) { c["email_verified"] = false }},
+		"unknown key":      {"k2", func(c map[string]interface{}) {}},
+	} {
+		c := m.idClaims("n", "a@b.c")
+		tc.change(c)
+		if _, err := p.Verify(context.Background(), m.sign(t, tc.kid, c), "n"); err == nil {
+			t.Errorf("%s: token accepted", name)
+		}
+	}
+
+	raw := m.sign(t, "k1", m.idClaims("n", "a@b.c"))
+	parts := strings.Split(raw, ".")
+	forged, _ := json.Marshal(m.idClaims("n", "x@b.c"))
+	parts[1] = base64.RawURLEncoding.EncodeToString(forged)
+	if _, err := p.Verify(context.Background(), strings.Join(parts, "."), "n"); err == nil {
+		t.Error("forged token accepted")
+	}
+}
+
+func TestSignedInAccount(t *testing.T) {
+	for _, tc := range []struct {
+		account string
+		bind    bool
+		want    string
+	}{
+		{"a@b.c", false, "a@b.c"},
+		{"A@B.c", false, "a@b.c"},
+		{"x@gmail.com", false, ""},
+		{"x@gmail.com", true, "x@gmail.com"},
+	} {
+		got, err := signedInAccount("a@b.c", tc.account, tc.bind)
+		if tc.want == "" && err == nil || tc.want != "" && got != tc.want {
+			t.Errorf("signedInAccount(%q, %v) = %q, %v, want %q", tc.account, tc.bind, got, err, tc.want)
+		}
+	}
+}
+
+func TestOIDCLogin(t *testing.T) {
+	m := newMockIssuer(t)
+	p, err := NewOIDCProvider(context.Background(), m.URL, "client", "secret", "http://localhost/oidc/callback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{opts: ServerOptions{SessionSecret: []byte("secret"), OIDC: p}}
+
+	// login with a session verified with a one-time code
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/tests/config/verify", nil)
+	if err := s.setSession(w, r, &Session{ConfigDocId: "config", Email: "a@b.c", Method: "otp", Expires: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	w2 := httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/tests/config/login?bind=true", nil)
+	r.AddCookie(w.Result().Cookies()[0])
+	s.login(w2, r, "config")
+	if w2.Code != http.StatusFound {
+		t.Fatalf("login: got status %d", w2.Code)
+	}
+	loc, err := url.Parse(w2.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(loc.String(), m.URL+"/authorize") || loc.Query().Get("login_hint") != "a@b.c" {
+		t.Fatalf("login redirected to %s", loc)
+	}
+	nonce, state := loc.Query().Get("nonce"), loc.Query().Get("state")
+	loginCookie := w2.Result().Cookies()[0]
+
+	// the issuer sends the candidate back after they signed in with another account
+	m.claims = func() map[string]interface{} { return m.idClaims(nonce, "x@gmail.com") }
+	callback := func(state string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/oidc/callback?code=good-code&state="+state, nil)
+		r.AddCookie(loginCookie)
+		s.oidcCallback(w, r)
+		return w
+	}
+	if w := callback("wrong"); w.Code != http.StatusBadRequest {
+		t.Errorf("wrong state: got status %d", w.Code)
+	}
+	w3 := callback(state)
+	if w3.Code != http.StatusSeeOther {
+		t.Fatalf("callback: got status %d: %s", w3.Code, w3.Body)
+	}
+	var c *http.Cookie
+	for _, cookie := range w3.Result().Cookies() {
+		if cookie.Name == sessionCookie {
+			c = cookie
+		}
+	}
+	if c == nil {
+		t.Fatal("no session set")
+	}
+	r = httptest.NewRequest(http.MethodPost, "/tests/config/start", nil)
+	r.AddCookie(c)
+	sess, ok := s.session(r, "config")
+	if !ok || sess.Email != "a@b.c" || sess.Account != "x@gmail.com" || sess.Method != "oidc" {
+		t.Errorf("got session %+v, %v", sess, ok)
+	}
+}
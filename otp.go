@@ -0,0 +1,281 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+const (
+	// otpDigits is the length of a one-time code.
+	otpDigits = 6
+	// otpTTL is how long a one-time code can be used.
+	otpTTL = 10 * time.Minute
+	// otpMaxAttempts is how many wrong codes are accepted before a new one
+	// has to be requested.
+	otpMaxAttempts = 5
+	// otpResendInterval is how long a candidate waits before another code
+	// is sent to them.
+	otpResendInterval = 30 * time.Second
+	// sessionTTL is how long a candidate stays verified.
+	sessionTTL = 12 * time.Hour
+
+	sessionCookie = "gdoc_session"
+)
+
+var (
+	ErrInvalidCode      = errors.New("invalid or expired code, request a new one")
+	ErrCodeRecentlySent = errors.New("a code was sent recently, check your inbox or try again later")
+)
+
+// otpRecord is a one-time code sent to a candidate. Only a keyed hash of the
+// code is stored.
+type otpRecord struct {
+	Hash     string    `json:"hash"`
+	Sent     time.Time `json:"sent"`
+	Expires  time.Time `json:"expires"`
+	Attempts int       `json:"attempts"`
+}
+
+// Session is a candidate whose email was verified for a test.
+type Session struct {
+	ConfigDocId string `json:"configDocId"`
+	Email       string `json:"email"`
+	// Method is how the session was verified last, otp or oidc.
+	Method string `json:"method"`
+	// Account is the Google account the candidate signed in with, if they
+	// signed in with Google.
+	Account string    `json:"account,omitempty"`
+	Expires time.Time `json:"expires"`
+}
+
+func otpKey(configDocId, email string) []byte {
+	return []byte("otp/" + configDocId + "/" + email)
+}
+
+// normalizeEmail returns the form emails are compared in.
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// SendCode emails a new one-time code for the test to email, replacing any
+// code sent before. Webhooks are sent an invited event once it is emailed.
+func (s *Server) SendCode(configDocId, email string) error {
+	email = normalizeEmail(email)
+	if err := validAddress(email); err != nil {
+		return err
+	}
+	now := time.Now()
+	if rec, err := s.loadCode(configDocId, email); err != nil {
+		return err
+	} else if rec != nil && now.Sub(rec.Sent) < otpResendInterval {
+		return ErrCodeRecentlySent
+	}
+
+	n, err := rand.Int(rand.Reader, big.NewInt(1_000_000))
+	if err != nil {
+		return err
+	}
+	code := fmt.Sprintf("%0*d", otpDigits, n)
+	rec := otpRecord{
+		Hash:    s.hashCode(configDocId, email, code),
+		Sent:    now,
+		Expires: now.Add(otpTTL),
+	}
+	if err := s.saveCode(configDocId, email, &rec); err != nil {
+		return err
+	}
+	body := fmt.Sprintf("Your code to start the test is %s.\n\nIt expires in %s. If you did not ask for it, ignore this email.\n", code, otpTTL)
+	if err := s.opts.Mailer.Send(email, "Your test verification code", body); err != nil {
+		otpTotal.WithLabelValues("error").Inc()
+		return err
+	}
+	otpTotal.WithLabelValues("sent").Inc()
+	s.emit(WebhookEventInvited, configDocId, TestAnswer{Email: email}, "")
+	return nil
+}
+
+// VerifyCode checks the one-time code entered by email. A code can be used
+// once, and is dropped after too many wrong attempts.
+func (s *Server) VerifyCode(configDocId, email, code string) (*Session, error) {
+	email = normalizeEmail(email)
+	rec, err := s.loadCode(configDocId, email)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if rec == nil || now.After(rec.Expires) || rec.Attempts >= otpMaxAttempts {
+		otpTotal.WithLabelValues("invalid").Inc()
+		return nil, ErrInvalidCode
+	}
+	if !hmac.Equal([]byte(rec.Hash), []byte(s.hashCode(configDocId, email, strings.TrimSpace(code)))) {
+		rec.Attempts++
+		if err := s.saveCode(configDocId, email, rec); err != nil {
+			return nil, err
+		}
+		otpTotal.WithLabelValues("invalid").Inc()
+		return nil, ErrInvalidCode
+	}
+	if err := s.db.Delete(otpKey(configDocId, email), nil); err != nil {
+		return nil, err
+	}
+	otpTotal.WithLabelValues("verified").Inc()
+	return &Session{
+		ConfigDocId: configDocId,
+		Email:       email,
+		Method:      "otp",
+		Expires:     now.Add(sessionTTL),
+	}, nil
+}
+
+func (s *Server) hashCode(configDocId, email, code string) string {
+	mac := hmac.New(sha256.New, s.opts.SessionSecret)
+	mac.Write([]byte(configDocId + "\x00" + email + "\x00" + code))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *Server) loadCode(configDocId, email string) (*otpRecord, error) {
+	data, err := s.db.Get(otpKey(configDocId, email), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var rec otpRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+func (s *Server) saveCode(configDocId, email string, rec *otpRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return s.db.Put(otpKey(configDocId, email), data, nil)
+}
+
+// setSession stores sess in a signed cookie scoped to the pages of its test.
+func (s *Server) setSession(w http.ResponseWriter, r *http.Request, sess *Session) error {
+	value, err := s.encodeCookie("session", sess)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    value,
+		Path:     "/tests/" + sess.ConfigDocId,
+		Expires:  sess.Expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// session returns the verified session of the request for the test, if any.
+func (s *Server) session(r *http.Request, configDocId string) (*Session, bool) {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil, false
+	}
+	var sess Session
+	if !s.decodeCookie("session", c.Value, &sess) {
+		return nil, false
+	}
+	if sess.ConfigDocId != configDocId || time.Now().After(sess.Expires) {
+		return nil, false
+	}
+	return &sess, true
+}
+
+// encodeCookie returns v as a cookie value signed for purpose, so a cookie
+// signed for one purpose is not accepted for another.
+func (s *Server) encodeCookie(purpose string, v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + s.sign(purpose, payload), nil
+}
+
+// decodeCookie reads a cookie value written by encodeCookie into v, and
+// reports whether its signature is valid.
+func (s *Server) decodeCookie(purpose, value string, v interface{}) bool {
+	payload, sig, ok := strings.Cut(value, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(s.sign(purpose, payload))) {
+		return false
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(data, v) == nil
+}
+
+func (s *Server) sign(purpose, payload string) string {
+	mac := hmac.New(sha256.New, s.opts.SessionSecret)
+	mac.Write([]byte(purpose + "\x00" + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// code serves POST /tests/<configDocId>/code?email=<email>
+//
+// The candidate is sent back to the landing page to enter the code. The
+// pre-flight check of the test is scheduled if it is still due.
+func (s *Server) code(w http.ResponseWriter, r *http.Request, configDocId string) {
+	cfg, err := GetTestPage(s.svcSheets, configDocId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err := s.ensurePreflight(configDocId, cfg); err != nil {
+		log.Printf("failed to schedule the pre-flight check of test %s: %v", configDocId, err)
+	}
+	email := r.FormValue("email")
+	err = s.SendCode(configDocId, email)
+	if err == ErrCodeRecentlySent {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	} else if err != nil {
+		log.Printf("failed to send a code to %s for test %s: %v", email, configDocId, err)
+		http.Error(w, "failed to send the code, check the email address", http.StatusBadRequest)
+		return
+	}
+	q := url.Values{"email": {normalizeEmail(email)}}
+	http.Redirect(w, r, "/tests/"+configDocId+"?"+q.Encode(), http.StatusSeeOther)
+}
+
+// verify serves POST /tests/<configDocId>/verify?email=<email>&code=<code>
+//
+// The candidate is sent back to the landing page to start the test.
+func (s *Server) verify(w http.ResponseWriter, r *http.Request, configDocId string) {
+	sess, err := s.VerifyCode(configDocId, r.FormValue("email"), r.FormValue("code"))
+	if err == ErrInvalidCode {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := s.setSession(w, r, sess); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/tests/"+configDocId, http.StatusSeeOther)
+}
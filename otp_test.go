@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// smtpSink is a local SMTP server that accepts every email and passes its
+// data to the returned channel.
+func smtpSink(t *testing.T) (string, <-chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	msgs := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSMTP(conn, msgs)
+		}
+	}()
+	return l.Addr().String(), msgs
+}
+
+func serveSMTP(conn net.Conn, msgs chan<- string) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(s string) { _, _ = conn.Write([]byte(s + "\r\n")) }
+	reply("220 localhost")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		switch cmd := strings.ToUpper(strings.Fields(line + " x")[0]); cmd {
+		case "EHLO", "HELO":
+			reply("250 localhost")
+		case "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			msgs <- data.String()
+			reply("250 ok")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func newOTPServer(t *testing.T) (*Server, <-chan string) {
+	db, err := leveldb.OpenFile(filepath.Join(t.TempDir(), "state"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	addr, msgs := smtpSink(t)
+	mailer, err := newSMTPMailer(addr, "tests@example.com", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Server{db: db, opts: ServerOptions{Mailer: mailer, SessionSecret: []byte("secret")}}, msgs
+}
+
+var codeRe = regexp.MustCompile(`code to start the test is (\d{6})`)
+
+func receiveCode(t *testing.T, msgs <-chan string) string {
+	select {
+	case msg := <-msgs:
+		if !strings.Contains(msg, "To: a@b.c\r\n") {
+			t.Fatalf("email not sent to the candidate:\n%s", msg)
+		}
+		m := codeRe.FindStringSubmatch(msg)
+		if m == nil {
+			t.Fatalf("no code in email:\n%s", msg)
+		}
+		return m[1]
+	case <-time.After(5 * time.Second):
+		t.Fatal("no email received")
+	}
+	return ""
+}
+
+func TestVerifyCode(t *testing.T) {
+	s, msgs := newOTPServer(t)
+	if err := s.SendCode("config", " A@b.c"); err != nil {
+		t.Fatal(err)
+	}
+	code := receiveCode(t, msgs)
+	if err := s.SendCode("config", "a@b.c"); err != ErrCodeRecentlySent {
+		t.Errorf("resend: got %v, want %v", err, ErrCodeRecentlySent)
+	}
+
+	if _, err := s.VerifyCode("other", "a@b.c", code); err != ErrInvalidCode {
+		t.Errorf("other test: got %v, want %v", err, ErrInvalidCode)
+	}
+	if _, err := s.VerifyCode("config", "a@b.c", "abcdef"); err != ErrInvalidCode {
+		t.Errorf("wrong code: got %v, want %v", err, ErrInvalidCode)
+	}
+	sess, err := s.VerifyCode("config", "a@b.c", code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sess.Email != "a@b.c" || sess.ConfigDocId != "config" || sess.Method != "otp" {
+		t.Errorf("got session %+v", sess)
+	}
+	if _, err := s.VerifyCode("config", "a@b.c", code); err != ErrInvalidCode {
+		t.Errorf("reused code: got %v, want %v", err, ErrInvalidCode)
+	}
+}
+
+func TestVerifyCodeMaxAttempts(t *testing.T) {
+	s, msgs := newOTPServer(t)
+	if err := s.SendCode("config", "a@b.c"); err != nil {
+		t.Fatal(err)
+	}
+	code := receiveCode(t, msgs)
+	for i := 0; i < otpMaxAttempts; i++ {
+		if _, err := s.VerifyCode("config", "a@b.c", "x"); err != ErrInvalidCode {
+			t.Fatalf("attempt %d: got %v, want %v", i, err, ErrInvalidCode)
+		}
+	}
+	if _, err := s.VerifyCode("config", "a@b.c", code); err != ErrInvalidCode {
+		t.Errorf("code after too many attempts: got %v, want %v", err, ErrInvalidCode)
+	}
+}
+
+func TestSession(t *testing.T) {
+	s := &Server{opts: ServerOptions{SessionSecret: []byte("secret")}}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/tests/config/verify", nil)
+	sess := &Session{ConfigDocId: "config", Email: "a@b.c", Method: "otp", Expires: time.Now().Add(time.Hour)}
+	if err := s.setSession(w, r, sess); err != nil {
+		t.Fatal(err)
+	}
+	cookie := w.Result().Cookies()[0]
+
+	r = httptest.NewRequest(http.MethodPost, "/tests/config/start", nil)
+	r.AddCookie(cookie)
+	if got, ok := s.session(r, "config"); !ok || got.Email != "a@b.c" {
+		t.Errorf("got %+v, %v", got, ok)
+	}
+	if _, ok := s.session(r, "other"); ok {
+		t.Error("session accepted for another test")
+	}
+
+	_, sig, _ := strings.Cut(cookie.Value, ".")
+	forged, _ := json.Marshal(Session{ConfigDocId: "config", Email: "x@b.c", Expires: sess.Expires})
+	tampered := *cookie
+	tampered.Value = base64.RawURLEncoding.EncodeToString(forged) + "." + sig
+	r = httptest.NewRequest(http.MethodPost, "/tests/config/start", nil)
+	r.AddCookie(&tampered)
+	if _, ok := s.session(r, "config"); ok {
+		t.Error("tampered session accepted")
+	}
+}
+
+func TestValidAddress(t *testing.T) {
+	for addr, valid := range map[string]bool{
+		"a@b.c":               true,
+		"A <a@b.c>":           false,
+		"a@b.c, d@e.f":        false,
+		"a@b.c\r\nBcc: d@e.f": false,
+		"":                    false,
+	} {
+		if err := validAddress(addr); (err == nil) != valid {
+			t.Errorf("validAddress(%q) = %v, want valid %v", addr, err, valid)
+		}
+	}
+}
+
+func TestSendCodeInvited(t *testing.T) {
+	s := newTestServer(t)
+	addr, msgs := smtpSink(t)
+	mailer, err := newSMTPMailer(addr, "tests@example.com", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.opts = ServerOptions{Mailer: mailer, SessionSecret: []byte("secret")}
+	receiver, received := webhookReceiver(t, 0)
+	if _, err := s.AddWebhook(Webhook{URL: receiver.URL, Events: []string{WebhookEventInvited}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.SendCode("config", " A@b.c"); err != nil {
+		t.Fatal(err)
+	}
+	receiveCode(t, msgs)
+	select {
+	case d := <-received:
+		var event WebhookEvent
+		if err := json.Unmarshal(d.body, &event); err != nil {
+			t.Fatal(err)
+		}
+		if event.Type != WebhookEventInvited || event.ConfigDocId != "config" || event.Email != "a@b.c" {
+			t.Errorf("got event %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no delivery received")
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/hmac"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// landingPage is the data of the landing page of a test.
+type landingPage struct {
+	ConfigDocId string
+	Opens       string
+	Closes      string
+	Describe    string
+	// Zone is the time zone the times are shown in.
+	Zone         string
+	Duration     time.Duration
+	Instructions []string
+	// Email is the address a code was just sent to.
+	Email   string
+	Session *Session
+	// NeedsLogin is set when the candidate still has to sign in with Google.
+	NeedsLogin bool
+	CSRF       string
+}
+
+var landingTemplate = template.Must(template.New("landing").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>Your test</title>
+</head>
+<body>
+<h1>Your test</h1>
+<p>The test is open from {{.Opens}} to {{.Closes}}.</p>
+<p>{{.Describe}}</p>
+{{- if .Duration}}
+<p>Duration: <strong>{{.Duration}}</strong></p>
+{{- end}}
+<h2>Before you start</h2>
+{{- range .Instructions}}
+<p>{{.}}</p>
+{{- end}}
+<ul>
+<li>When you start, you get edit access to a Google Doc with the questions. Your answers are saved as you type.</li>
+<li>When your time is up, your access ends and what is in the doc is your answer.</li>
+</ul>
+{{- if not .Session}}
+<form method="post" action="/tests/{{.ConfigDocId}}/code">
+<label>Email <input type="email" name="email" value="{{.Email}}" required></label>
+<button>Send me a code</button>
+</form>
+{{- if .Email}}
+<form method="post" action="/tests/{{.ConfigDocId}}/verify">
+<input type="hidden" name="email" value="{{.Email}}">
+<label>Code <input name="code" inputmode="numeric" autocomplete="one-time-code" required></label>
+<button>Verify</button>
+</form>
+{{- end}}
+{{- else if .NeedsLogin}}
+<p>Your email {{.Session.Email}} is verified. Sign in with the Google account you will use to open the test doc.</p>
+<p><a href="/tests/{{.ConfigDocId}}/login">Sign in with Google</a></p>
+{{- else}}
+{{- if and .Session.Account (ne .Session.Account .Session.Email)}}
+<p>Access will be granted to your Google account {{.Session.Account}}.</p>
+{{- end}}
+<form method="post" action="/tests/{{.ConfigDocId}}/start">
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+<input type="hidden" name="tz">
+<label><input type="checkbox" name="consent" value="yes" required> I have read the instructions and I am ready to start. The clock starts as soon as I confirm.</label>
+<button>Start the test</button>
+</form>
+<p>Already started? <a href="/tests/{{.ConfigDocId}}/test">Go back to your test</a>.</p>
+{{- end}}
+<script>
+(() => {
+  const tz = Intl.DateTimeFormat().resolvedOptions().timeZone;
+  for (const el of document.querySelectorAll('input[name="tz"]')) {
+    el.value = tz;
+  }
+  // show the times in the candidate's time zone
+  const url = new URL(location.href);
+  if (tz && tz !== {{.Zone}} && !url.searchParams.has("tz")) {
+    url.searchParams.set("tz", tz);
+    location.replace(url);
+  }
+})();
+</script>
+</body>
+</html>
+`))
+
+// landing serves GET /tests/<configDocId>
+//
+// It only shows the test and the steps to start it, and schedules nothing. A
+// test is only started by the consent form it shows, so link previews
+// fetching the page don't start the clock.
+func (s *Server) landing(w http.ResponseWriter, r *http.Request, configDocId string) {
+	cfg, err := GetTestPage(s.svcSheets, configDocId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	// tz is the candidate's time zone, as reported by their browser, which
+	// reloads the page with it
+	loc, _ := loadLocation(displayZone(cfg, r.FormValue("tz")))
+	page := landingPage{
+		ConfigDocId: configDocId,
+		Zone:        loc.String(),
+		Opens:       formatTime(cfg.StartDate.Time, loc),
+		Closes:      formatTime(cfg.EndDate.Time, loc),
+		Describe:    cfg.Describe(loc),
+		Email:       normalizeEmail(r.FormValue("email")),
+	}
+	if cfg.TestMode() != TestModeFixedWindow {
+		page.Duration = cfg.Duration.Duration
+	}
+	for _, line := range strings.Split(cfg.Instructions, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			page.Instructions = append(page.Instructions, line)
+		}
+	}
+	if sess, ok := s.session(r, configDocId); ok {
+		page.Session = sess
+		page.NeedsLogin = s.opts.OIDC != nil && sess.Account == ""
+		page.CSRF = s.csrfToken(sess)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := landingTemplate.Execute(w, page); err != nil {
+		log.Printf("failed to render the page of test %s: %v", configDocId, err)
+	}
+}
+
+// csrfToken returns the token the start and submit forms of sess are posted
+// with. It is tied to the session, so a page of another site can't start or
+// submit the test.
+func (s *Server) csrfToken(sess *Session) string {
+	return s.sign("csrf", strings.Join([]string{
+		sess.ConfigDocId,
+		sess.Email,
+		sess.Account,
+		strconv.FormatInt(sess.Expires.UnixNano(), 10),
+	}, "\x00"))
+}
+
+// checkStart checks that a request to start the test comes from the consent
+// form of a verified candidate, and returns their session. On failure, the
+// returned status is the one to respond with.
+func (s *Server) checkStart(r *http.Request, configDocId string) (*Session, int, error) {
+	sess, ok := s.session(r, configDocId)
+	if !ok {
+		return nil, http.StatusUnauthorized, errors.New("verify your email before starting the test")
+	}
+	if s.opts.OIDC != nil && sess.Account == "" {
+		return nil, http.StatusUnauthorized, errors.Errorf("sign in with Google before starting the test: /tests/%s/login", configDocId)
+	}
+	if !hmac.Equal([]byte(r.PostFormValue("csrf")), []byte(s.csrfToken(sess))) {
+		return nil, http.StatusForbidden, errors.New("the form expired, reload the test page")
+	}
+	if r.PostFormValue("consent") != "yes" {
+		return nil, http.StatusBadRequest, errors.New("confirm that you are ready to start the test")
+	}
+	return sess, http.StatusOK, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLandingTemplate(t *testing.T) {
+	sess := &Session{ConfigDocId: "config", Email: "a@b.c", Method: "otp", Expires: time.Now().Add(time.Hour)}
+	for name, tc := range map[string]struct {
+		page landingPage
+		want []string
+		not  []string
+	}{
+		"new": {
+			page: landingPage{ConfigDocId: "config", Zone: "Europe/Berlin", Duration: time.Hour, Instructions: []string{"No <b>notes</b>."}},
+			want: []string{`action="/tests/config/code"`, "Duration: <strong>1h0m0s</strong>", "No &lt;b&gt;notes&lt;/b&gt;.", `tz !== "Europe/Berlin"`},
+			not:  []string{`action="/tests/config/verify"`, `action="/tests/config/start"`},
+		},
+		"code sent": {
+			page: landingPage{ConfigDocId: "config", Email: "a@b.c"},
+			want: []string{`action="/tests/config/verify"`, `value="a@b.c"`},
+			not:  []string{`action="/tests/config/start"`},
+		},
+		"needs login": {
+			page: landingPage{ConfigDocId: "config", Session: sess, NeedsLogin: true},
+			want: []string{`href="/tests/config/login"`},
+			not:  []string{`action="/tests/config/start"`},
+		},
+		"ready": {
+			page: landingPage{ConfigDocId: "config", Session: sess, CSRF: "token"},
+			want: []string{`action="/tests/config/start"`, `name="csrf" value="token"`, `name="consent"`},
+			not:  []string{`action="/tests/config/code"`},
+		},
+	} {
+		var b strings.Builder
+		if err := landingTemplate.Execute(&b, tc.page); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for _, s := range tc.want {
+			if !strings.Contains(b.String(), s) {
+				t.Errorf("%s: page does not contain %s", name, s)
+			}
+		}
+		for _, s := range tc.not {
+			if strings.Contains(b.String(), s) {
+				t.Errorf("%s: page contains %s", name, s)
+			}
+		}
+	}
+}
+
+func TestCheckStart(t *testing.T) {
+	s := &Server{opts: ServerOptions{SessionSecret: []byte("secret")}}
+	sess := &Session{ConfigDocId: "config", Email: "a@b.c", Method: "otp", Expires: time.Now().Add(time.Hour)}
+	w := httptest.NewRecorder()
+	if err := s.setSession(w, httptest.NewRequest(http.MethodPost, "/tests/config/verify", nil), sess); err != nil {
+		t.Fatal(err)
+	}
+	cookie := w.Result().Cookies()[0]
+	other := *sess
+	other.Email = "x@b.c"
+
+	for name, tc := range map[string]struct {
+		cookie bool
+		form   url.Values
+		query  string
+		want   int
+	}{
+		"no session":    {false, url.Values{"csrf": {s.csrfToken(sess)}, "consent": {"yes"}}, "", http.StatusUnauthorized},
+		"no csrf":       {true, url.Values{"consent": {"yes"}}, "", http.StatusForbidden},
+		"csrf in query": {true, url.Values{"consent": {"yes"}}, "?csrf=" + url.QueryEscape(s.csrfToken(sess)), http.StatusForbidden},
+		"other session": {true, url.Values{"csrf": {s.csrfToken(&other)}, "consent": {"yes"}}, "", http.StatusForbidden},
+		"no consent":    {true, url.Values{"csrf": {s.csrfToken(sess)}}, "", http.StatusBadRequest},
+		"consent":       {true, url.Values{"csrf": {s.csrfToken(sess)}, "consent": {"yes"}}, "", http.StatusOK},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/tests/config/start"+tc.query, strings.NewReader(tc.form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if tc.cookie {
+			r.AddCookie(cookie)
+		}
+		got, status, err := s.checkStart(r, "config")
+		if status != tc.want {
+			t.Errorf("%s: got status %d (%v), want %d", name, status, err, tc.want)
+		}
+		if status == http.StatusOK && got.Email != "a@b.c" {
+			t.Errorf("%s: got session %+v", name, got)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+	csvtypes "gomodules.xyz/encoding/csv/types"
+)
+
+// ClockResult is the outcome of pausing or resuming the clock of a candidate.
+type ClockResult struct {
+	Email   string    `json:"email"`
+	EndDate time.Time `json:"endDate"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// Pause stops the clock of the candidate, or of every candidate whose test is
+// running if email is empty. Edit access to the doc is suspended and the end
+// of test jobs are dropped until the clock is resumed. The jobs are only
+// dropped once the pause is saved, so a failed pause leaves the revoke at the
+// end of the test in place.
+func (s *Server) Pause(configDocId, email, reason string) ([]ClockResult, error) {
+	running := func(ans TestAnswer, now time.Time) bool {
+		return ans.PausedAt.IsZero() && ans.SubmittedAt.IsZero() && ans.EndDate.After(now)
+	}
+	var suspended []TestAnswer
+	saved := func(ans TestAnswer) error {
+		if err := s.cancelTestJobs(configDocId, ans.Email); err != nil {
+			return err
+		}
+		left := ans.EndDate.Sub(ans.PausedAt.Time).Round(time.Second)
+		log.Printf("paused %s in test %s with %s left", ans.Email, configDocId, left)
+		return SaveAuditEvent(s.svcSheets, configDocId, AuditEvent{
+			Time:    csvtypes.Timestamp{Time: ans.PausedAt.Time},
+			Email:   ans.Email,
+			Event:   AuditEventPaused,
+			Details: fmt.Sprintf("paused with %s left: %s", left, reason),
+		})
+	}
+	results, err := s.changeClock(configDocId, email, WebhookEventPaused, running, saved, func(ts *TestSheet, row *TestRow, now time.Time) error {
+		ans := row.Answer
+		if !ans.PausedAt.IsZero() {
+			return errors.Errorf("paused since %s", ans.PausedAt.Format(time.RFC3339))
+		}
+		if !ans.SubmittedAt.IsZero() {
+			return errors.New("test has been submitted")
+		}
+		if !ans.EndDate.After(now) {
+			return errors.New("test has already ended")
+		}
+		perm, err := findPermission(s.svcDrive, ans.DocId, ans.Grantee())
+		if err != nil {
+			return err
+		}
+		if perm == nil || perm.Role != "writer" {
+			return errors.New("no edit access to pause, the test may have been submitted")
+		}
+
+		if err := setRole(s.svcDrive, ans.DocId, ans.Grantee(), "reader"); err != nil {
+			return err
+		}
+		ans.PausedAt = OptionalTimestamp{Time: now}
+		if _, err := ts.Set(&ans); err != nil {
+			return s.restoreAccess(ans, err)
+		}
+		suspended = append(suspended, ans)
+		return nil
+	})
+	if err != nil {
+		// the pauses were not saved and the revokes are still scheduled
+		for _, ans := range suspended {
+			_ = s.restoreAccess(ans, err)
+		}
+		return nil, err
+	}
+	return results, nil
+}
+
+// restoreAccess gives the candidate of a pause that failed with err edit
+// access back, and returns err.
+func (s *Server) restoreAccess(ans TestAnswer, err error) error {
+	if rerr := s.grant(ans); rerr != nil {
+		log.Printf("failed to restore edit access of %s after a failed pause: %v", ans.Email, rerr)
+	}
+	return err
+}
+
+// Resume restarts the clock of the candidate, or of every paused candidate if
+// email is empty. The time left when the clock was paused is restored by
+// moving the end of the test, and edit access and the end of test jobs are
+// restored.
+func (s *Server) Resume(configDocId, email string) ([]ClockResult, error) {
+	paused := func(ans TestAnswer, _ time.Time) bool {
+		return !ans.PausedAt.IsZero()
+	}
+	return s.changeClock(configDocId, email, WebhookEventResumed, paused, nil, func(ts *TestSheet, row *TestRow, now time.Time) error {
+		ans := row.Answer
+		if ans.PausedAt.IsZero() {
+			return errors.New("not paused")
+		}
+		pausedAt, oldEnd := ans.PausedAt.Time, ans.EndDate.Time
+		ans = ans.resumed(now)
+
+		if err := s.grant(ans); err != nil {
+			return err
+		}
+		if err := s.cancelTestJobs(configDocId, ans.Email); err != nil {
+			return err
+		}
+		if err := s.scheduleTestJobs(configDocId, ans); err != nil {
+			return err
+		}
+		if _, err := ts.Set(&ans); err != nil {
+			return err
+		}
+		if err := s.markApplied(configDocId, ans); err != nil {
+			return err
+		}
+		log.Printf("resumed %s in test %s, paused for %s", ans.Email, configDocId, now.Sub(pausedAt).Round(time.Second))
+		return SaveAuditEvent(s.svcSheets, configDocId, AuditEvent{
+			Time:  csvtypes.Timestamp{Time: now},
+			Email: ans.Email,
+			Event: AuditEventResumed,
+			Details: fmt.Sprintf("paused from %s to %s (%s), end moved from %s to %s",
+				pausedAt.UTC().Format(time.RFC3339), now.UTC().Format(time.RFC3339), now.Sub(pausedAt).Round(time.Second),
+				oldEnd.UTC().Format(time.RFC3339), ans.EndDate.UTC().Format(time.RFC3339)),
+		})
+	})
+}
+
+// resumed returns the answer with the clock restarted at now, and the time
+// left when it was paused restored.
+func (ans TestAnswer) resumed(now time.Time) TestAnswer {
+	left := ans.EndDate.Sub(ans.PausedAt.Time)
+	if left < 0 {
+		left = 0
+	}
+	ans.EndDate = csvtypes.Timestamp{Time: now.Add(left)}
+	ans.Paused = csvtypes.Duration{Duration: ans.Paused.Duration + now.Sub(ans.PausedAt.Time)}
+	ans.PausedAt = OptionalTimestamp{}
+	return ans
+}
+
+// changeClock applies fn to the latest attempt of email, or of every
+// candidate selected by match if email is empty, and writes the changed rows
+// back. When email is empty, candidates fn fails for are reported in the
+// results, and the others are still changed. Once the rows are written, saved
+// is run and event is sent to webhooks for every changed candidate. Errors of
+// saved are reported in the results.
+func (s *Server) changeClock(configDocId, email, event string, match func(ans TestAnswer, now time.Time) bool, saved func(ans TestAnswer) error, fn func(ts *TestSheet, row *TestRow, now time.Time) error) ([]ClockResult, error) {
+	mu := testLock(configDocId)
+	mu.Lock()
+	defer mu.Unlock()
+
+	ts, err := LoadTestSheet(s.svcSheets, configDocId)
+	if err != nil {
+		return nil, err
+	}
+	var rows []*TestRow
+	if email != "" {
+		row := ts.Latest(email)
+		if row == nil {
+			return nil, errors.Errorf("%s has not started the test yet", email)
+		}
+		rows = append(rows, row)
+	} else {
+		now := time.Now()
+		for _, row := range ts.LatestRows() {
+			if row.Err == nil && match(row.Answer, now) {
+				rows = append(rows, row)
+			}
+		}
+	}
+
+	now := time.Now()
+	results := make([]ClockResult, 0, len(rows))
+	var changed []int
+	for _, row := range rows {
+		err := fn(ts, row, now)
+		if err != nil && email != "" {
+			return nil, errors.Wrap(err, email)
+		}
+		res := ClockResult{Email: row.Answer.Email, EndDate: row.Answer.EndDate.Time}
+		if err != nil {
+			res.Error = err.Error()
+		} else {
+			changed = append(changed, len(results))
+		}
+		results = append(results, res)
+	}
+	if err := ts.Flush(); err != nil {
+		return nil, err
+	}
+	for _, i := range changed {
+		ans := rows[i].Answer
+		if saved != nil {
+			// the change is saved, so a failure is only reported
+			if err := saved(ans); err != nil {
+				results[i].Error = err.Error()
+			}
+		}
+		s.hub.notify(jobKey(configDocId, ans.Email), "")
+		s.emit(event, configDocId, ans, "")
+	}
+	return results, nil
+}
+
+// clock serves
+//
+//	POST /admin/tests/<configDocId>/pause?email=<email>&reason=<reason>
+//	POST /admin/tests/<configDocId>/resume?email=<email>
+func (s *Server) clock(w http.ResponseWriter, r *http.Request, configDocId, action string) {
+	var results []ClockResult
+	var err error
+	if action == "pause" {
+		results, err = s.Pause(configDocId, r.FormValue("email"), r.FormValue("reason"))
+	} else {
+		results, err = s.Resume(configDocId, r.FormValue("email"))
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	writeJSON(w, results)
+}
+
+// runClock implements
+//
+//	pause --config-doc-id=<id> [--email=<email>] [--reason=<reason>]
+//	resume --config-doc-id=<id> [--email=<email>]
+func runClock(cmd string, args []string) {
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	c := adminFlags(fs)
+	configDocId := fs.String("config-doc-id", "", "Id of the spreadsheet of the test")
+	email := fs.String("email", "", "Only change the clock of this candidate, instead of every candidate of the test")
+	reason := fs.String("reason", "", "Why the clock is paused, recorded in the audit trail")
+	_ = fs.Parse(args)
+	if *configDocId == "" {
+		log.Fatalf("usage: %s --config-doc-id=<id> [--email=<email>]", cmd)
+	}
+
+	q := url.Values{}
+	q.Set("email", *email)
+	if cmd == "pause" {
+		q.Set("reason", *reason)
+	}
+	var results []ClockResult
+	handleError(c.Do(http.MethodPost, "tests/"+*configDocId+"/"+cmd+"?"+q.Encode(), nil, &results), "Error changing clock")
+	for _, res := range results {
+		if res.Error != "" {
+			fmt.Printf("%s\tskipped: %s\n", res.Email, res.Error)
+			continue
+		}
+		fmt.Printf("%s\t%sd, ends at %s\n", res.Email, cmd, res.EndDate.Format(time.RFC3339))
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	csvtypes "gomodules.xyz/encoding/csv/types"
+)
+
+func TestResumed(t *testing.T) {
+	start := time.Date(2022, 6, 1, 9, 0, 0, 0, time.UTC)
+	ans := TestAnswer{
+		StartDate: csvtypes.Timestamp{Time: start},
+		EndDate:   csvtypes.Timestamp{Time: start.Add(time.Hour)},
+		// 40m left when paused
+		PausedAt: OptionalTimestamp{Time: start.Add(20 * time.Minute)},
+		Paused:   csvtypes.Duration{Duration: 5 * time.Minute},
+	}
+	now := start.Add(50 * time.Minute)
+
+	got := ans.resumed(now)
+	if want := now.Add(40 * time.Minute); !got.EndDate.Equal(want) {
+		t.Errorf("EndDate = %s, want %s", got.EndDate.Time, want)
+	}
+	if want := 35 * time.Minute; got.Paused.Duration != want {
+		t.Errorf("Paused = %s, want %s", got.Paused.Duration, want)
+	}
+	if !got.PausedAt.IsZero() {
+		t.Error("PausedAt not cleared")
+	}
+}
+
+func TestOptionalTimestamp(t *testing.T) {
+	var ts OptionalTimestamp
+	if err := ts.UnmarshalCSV(""); err != nil || !ts.IsZero() {
+		t.Errorf("empty cell = %v, %v, want zero time", ts.Time, err)
+	}
+	if s, _ := ts.MarshalCSV(); s != "" {
+		t.Errorf("zero time = %q, want an empty cell", s)
+	}
+	if err := ts.UnmarshalCSV("6/1/2022 09:30:00"); err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := ts.MarshalCSV(); s != "6/1/2022 09:30:00" {
+		t.Errorf("MarshalCSV() = %q", s)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/rs/xid"
+	"google.golang.org/api/docs/v1"
+	"google.golang.org/api/drive/v3"
+)
+
+// ProjectPoolFolder is the folder next to the config doc that holds
+// pre-copied, locked down and unshared copies of the question template.
+const ProjectPoolFolder = "pool"
+
+// poolAppProperty marks a doc in the pool with the id of the template it was
+// copied from, so copies of an outdated template are never handed out.
+const poolAppProperty = "gdocPoolTemplate"
+
+// poolLocks serializes claims on the pool of each test, so two candidates
+// starting at the same time never get the same doc.
+var poolLocks sync.Map
+
+func poolLock(configDocId string) *sync.Mutex {
+	mu, _ := poolLocks.LoadOrStore(configDocId, &sync.Mutex{})
+	return mu.(*sync.Mutex)
+}
+
+func listPoolDocs(svc *drive.Service, poolFolderId string) ([]*drive.File, error) {
+	q := NewDriveQuery().
+		In(poolFolderId, "parents").
+		Eq("mimeType", MimeTypeDocument).
+		Is("trashed", false)
+	var files []*drive.File
+	err := svc.Files.List().Q(q.String()).Spaces("drive").
+		Fields("nextPageToken", "files(id,appProperties)").
+		Pages(context.TODO(), func(resp *drive.FileList) error {
+			files = append(files, resp.Files...)
+			return nil
+		})
+	return files, err
+}
+
+// FillPool tops up the pool of the test to size copies of templateDocId and
+// trashes the copies of any other template. It returns the number of docs copied.
+func FillPool(svc *drive.Service, configDocId, templateDocId string, size int) (int, error) {
+	poolFolderId, err := GetFolderId(svc, configDocId, ProjectPoolFolder)
+	if err != nil {
+		return 0, err
+	}
+	files, err := listPoolDocs(svc, poolFolderId)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to list pool folder %s", poolFolderId)
+	}
+
+	n := 0
+	for _, f := range files {
+		if f.AppProperties[poolAppProperty] == templateDocId {
+			n++
+			continue
+		}
+		if _, err := svc.Files.Update(f.Id, &drive.File{Trashed: true}).Fields("id").Do(); err != nil {
+			return 0, errors.Wrapf(err, "failed to trash outdated pool doc %s", f.Id)
+		}
+	}
+
+	created := 0
+	for ; n < size; n++ {
+		doc, err := svc.Files.Copy(templateDocId, &drive.File{
+			Name:          "pool - " + xid.New().String(),
+			Parents:       []string{poolFolderId},
+			AppProperties: map[string]string{poolAppProperty: templateDocId},
+		}).Fields("id").Do()
+		if err != nil {
+			return created, errors.Wrapf(err, "failed to copy template doc %s into pool folder %s", templateDocId, poolFolderId)
+		}
+		if err := LockDownDoc(svc, doc.Id); err != nil {
+			return created, err
+		}
+		created++
+	}
+	return created, nil
+}
+
+// ClaimPoolDoc moves a doc from the pool of the test into folderId and renames
+// it to docName. It returns an empty id if the pool is empty.
+func ClaimPoolDoc(svc *drive.Service, configDocId, templateDocId, folderId, docName string) (string, error) {
+	mu := poolLock(configDocId)
+	mu.Lock()
+	defer mu.Unlock()
+
+	poolFolderId, err := GetFolderId(svc, configDocId, ProjectPoolFolder)
+	if err != nil {
+		return "", err
+	}
+	q := NewDriveQuery().
+		In(poolFolderId, "parents").
+		Has("appProperties", poolAppProperty, templateDocId).
+		Is("trashed", false)
+	files, err := svc.Files.List().Q(q.String()).Spaces("drive").PageSize(1).Fields("files(id)").Do()
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to list pool folder %s", poolFolderId)
+	}
+	if len(files.Files) == 0 {
+		return "", nil
+	}
+
+	docId := files.Files[0].Id
+	_, err = svc.Files.Update(docId, &drive.File{
+		Name:          docName,
+		AppProperties: map[string]string{poolAppProperty: ""},
+	}).AddParents(folderId).RemoveParents(poolFolderId).Fields("id").Do()
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to move pool doc %s into folder %s", docId, folderId)
+	}
+	return docId, nil
+}
+
+// NewTestDoc returns a locked down copy of the template named docName inside
+// folderId with the replacements filled in. A doc from the pool of the test is
+// used when available, otherwise the template is copied.
+func NewTestDoc(svcDrive *drive.Service, svcDocs *docs.Service, configDocId, templateDocId, folderId, docName string, replacements map[string]string) (string, error) {
+	docId, err := ClaimPoolDoc(svcDrive, configDocId, templateDocId, folderId, docName)
+	if err != nil {
+		return "", err
+	}
+	if docId != "" {
+		return docId, ReplaceText(svcDocs, docId, replacements)
+	}
+
+	docId, err = CopyDoc(svcDrive, svcDocs, templateDocId, folderId, docName, replacements)
+	if err != nil {
+		return "", err
+	}
+	return docId, LockDownDoc(svcDrive, docId)
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// Columns of the test sheet written by the reconcile loop.
+const (
+	SyncStatusHeader = "Sync Status"
+	SyncErrorHeader  = "Sync Error"
+)
+
+// Values of the Sync Status column.
+const (
+	SyncStatusSynced    = "Synced"
+	SyncStatusRearmed   = "Rearmed"
+	SyncStatusExpired   = "Expired"
+	SyncStatusError     = "Error"
+	SyncStatusPaused    = "Paused"
+	SyncStatusSubmitted = "Submitted"
+)
+
+// startGracePeriod is how long the reconcile loop leaves a freshly started
+// test alone, since its jobs are scheduled right after its row is saved.
+const startGracePeriod = time.Minute
+
+// reconcileState is the state of a test as last applied by the reconcile
+// loop. Answers holds the latest attempt of every candidate by email.
+type reconcileState struct {
+	Config  *QuestionConfig       `json:"config,omitempty"`
+	Answers map[string]TestAnswer `json:"answers"`
+}
+
+// testLocks serializes the changes the server makes to the test sheet of a
+// test, eg, a scheduled reconcile run and a pause triggered from the admin
+// api.
+var testLocks sync.Map
+
+func testLock(configDocId string) *sync.Mutex {
+	mu, _ := testLocks.LoadOrStore(configDocId, &sync.Mutex{})
+	return mu.(*sync.Mutex)
+}
+
+func reconcileStateKey(configDocId string) []byte {
+	return []byte("reconcile/" + configDocId)
+}
+
+func (s *Server) loadReconcileState(configDocId string) (*reconcileState, error) {
+	state := &reconcileState{Answers: map[string]TestAnswer{}}
+	data, err := s.db.Get(reconcileStateKey(configDocId), nil)
+	if err == leveldb.ErrNotFound {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	if state.Answers == nil {
+		state.Answers = map[string]TestAnswer{}
+	}
+	return state, nil
+}
+
+func (s *Server) saveReconcileState(configDocId string, state *reconcileState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return s.db.Put(reconcileStateKey(configDocId), data, nil)
+}
+
+// markApplied records changes the server made to rows of the test sheet as
+// already applied, so the next reconcile run does not re-arm them.
+func (s *Server) markApplied(configDocId string, answers ...TestAnswer) error {
+	state, err := s.loadReconcileState(configDocId)
+	if err != nil {
+		return err
+	}
+	changed := false
+	for _, ans := range answers {
+		if _, ok := state.Answers[ans.Email]; ok {
+			state.Answers[ans.Email] = ans
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return s.saveReconcileState(configDocId, state)
+}
+
+// Reconcile applies the edits admins made by hand in the config and test
+// sheets of the test since the last run. A candidate whose End Date or Doc Id
+// changed gets their pending jobs re-armed, and access granted or revoked to
+// match. The outcome for every candidate is written to the Sync Status and
+// Sync Error columns.
+func (s *Server) Reconcile(configDocId string) error {
+	mu := testLock(configDocId)
+	mu.Lock()
+	defer mu.Unlock()
+
+	prev, err := s.loadReconcileState(configDocId)
+	if err != nil {
+		return err
+	}
+
+	// the sheet is the source of truth, don't trust the cache
+	configCache.Invalidate(configDocId)
+	cfg, err := LoadConfig(s.svcSheets, configDocId)
+	if err != nil {
+		return err
+	}
+	if err := s.ensurePreflight(configDocId, cfg); err != nil {
+		log.Printf("failed to schedule the pre-flight check of test %s: %v", configDocId, err)
+	}
+	next := &reconcileState{Config: cfg, Answers: map[string]TestAnswer{}}
+	if prev.Config != nil && configChanged(prev.Config, cfg) {
+		log.Printf("config of test %s changed", configDocId)
+		InvalidateCaches(configDocId)
+		if cfg.PoolSize > 0 && cfg.PoolSize != prev.Config.PoolSize {
+			if err := s.fillPool(configDocId, true); err != nil {
+				return err
+			}
+		}
+	}
+
+	ts, err := LoadTestSheet(s.svcSheets, configDocId)
+	if err != nil {
+		return err
+	}
+	latest := map[string]*TestRow{}
+	for _, row := range ts.Rows {
+		email := row.Answer.Email
+		if row.DuplicateOf != 0 {
+			setSyncStatus(ts, row, SyncStatusError, fmt.Sprintf("duplicate of row %d", row.DuplicateOf))
+			continue
+		}
+		if email == "" {
+			continue
+		}
+		if cur, ok := latest[email]; !ok || row.Answer.Attempt >= cur.Answer.Attempt {
+			latest[email] = row
+		}
+	}
+
+	for email, row := range latest {
+		var old *TestAnswer
+		if ans, ok := prev.Answers[email]; ok {
+			old = &ans
+		}
+
+		status, done, err := s.reconcileAnswer(configDocId, old, row)
+		switch {
+		case err != nil:
+			log.Printf("failed to reconcile %s in test %s: %v", email, configDocId, err)
+			setSyncStatus(ts, row, SyncStatusError, err.Error())
+			if old != nil {
+				// keep the old state, so the change is retried next time
+				next.Answers[email] = *old
+			}
+		case done:
+			setSyncStatus(ts, row, status, "")
+			next.Answers[email] = row.Answer
+		case old != nil:
+			next.Answers[email] = *old
+		}
+	}
+
+	for email, old := range prev.Answers {
+		if _, ok := latest[email]; ok {
+			continue
+		}
+		// the row was deleted
+		log.Printf("row of %s was removed from test %s", email, configDocId)
+		if err := s.cancelTestJobs(configDocId, email); err != nil {
+			return err
+		}
+		if old.EndDate.After(time.Now()) {
+			if err := s.revoke(old); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := ts.Flush(); err != nil {
+		return err
+	}
+	return s.saveReconcileState(configDocId, next)
+}
+
+// configChanged reports whether cfg differs from prev. They are compared in
+// their stored form, since the zoned times of a config read back from the
+// reconcile state have a different *time.Location than freshly loaded ones.
+func configChanged(prev, cfg *QuestionConfig) bool {
+	a, errA := json.Marshal(prev)
+	b, errB := json.Marshal(cfg)
+	return errA != nil || errB != nil || !bytes.Equal(a, b)
+}
+
+func setSyncStatus(ts *TestSheet, row *TestRow, status, msg string) {
+	if row.Cells[SyncStatusHeader] != status {
+		ts.SetCell(row, SyncStatusHeader, status)
+	}
+	if row.Cells[SyncErrorHeader] != msg {
+		ts.SetCell(row, SyncErrorHeader, msg)
+	}
+}
+
+// reconcileAnswer brings the jobs and permissions of the candidate of row in
+// line with the sheet. old is the state last applied, or nil if the row is
+// new. done is false if the row should be looked at again next time.
+func (s *Server) reconcileAnswer(configDocId string, old *TestAnswer, row *TestRow) (string, bool, error) {
+	if row.Err != nil {
+		return "", false, row.Err
+	}
+	ans := row.Answer
+	if ans.DocId == "" {
+		return "", false, errors.New("missing Doc Id")
+	}
+
+	switch {
+	case !ans.SubmittedAt.IsZero():
+		// access was revoked on submit, only a reopen grants it again
+		return SyncStatusSubmitted, true, nil
+	case !ans.PausedAt.IsZero():
+		// access and jobs are restored on resume
+		return SyncStatusPaused, true, nil
+	}
+
+	now := time.Now()
+	if old == nil {
+		if now.Sub(ans.StartDate.Time) < startGracePeriod {
+			return "", false, nil
+		}
+		jobs, err := s.sched.Lookup(jobKey(configDocId, ans.Email))
+		if err != nil {
+			return "", false, err
+		}
+		if len(jobs) > 0 {
+			// started through the landing page or reopened, which grant
+			// access after scheduling the jobs and may have failed to
+			if ans.EndDate.After(now) {
+				if err := s.grant(ans); err != nil {
+					return "", false, err
+				}
+			}
+			return SyncStatusSynced, true, nil
+		}
+		if !ans.EndDate.After(now) {
+			return SyncStatusExpired, true, nil
+		}
+		// added by hand
+		return s.rearm(configDocId, nil, ans)
+	}
+
+	if old.DocId == ans.DocId && old.EndDate.Equal(ans.EndDate.Time) {
+		return SyncStatusSynced, true, nil
+	}
+	return s.rearm(configDocId, old, ans)
+}
+
+// rearm replaces the pending jobs of the candidate with ones matching ans.
+// If the test is still running, access to the doc is granted if missing. If
+// the end was moved into the past, the end of test jobs run right away.
+func (s *Server) rearm(configDocId string, old *TestAnswer, ans TestAnswer) (string, bool, error) {
+	if err := s.cancelTestJobs(configDocId, ans.Email); err != nil {
+		return "", false, err
+	}
+	if old != nil && old.DocId != ans.DocId && old.EndDate.After(time.Now()) {
+		if err := s.revoke(*old); err != nil {
+			return "", false, err
+		}
+	}
+
+	now := time.Now()
+	if !ans.EndDate.After(now) {
+		if old == nil || !old.EndDate.After(now) {
+			return SyncStatusExpired, true, nil
+		}
+		// shortened, revoke now
+		if err := s.scheduleTestJobs(configDocId, ans); err != nil {
+			return "", false, err
+		}
+		return SyncStatusExpired, true, nil
+	}
+
+	if err := s.grant(ans); err != nil {
+		return "", false, err
+	}
+	if err := s.scheduleTestJobs(configDocId, ans); err != nil {
+		return "", false, err
+	}
+	return SyncStatusRearmed, true, nil
+}
+
+// grant gives the candidate writer access to their doc, unless they already have it.
+func (s *Server) grant(ans TestAnswer) error {
+	return setRole(s.svcDrive, ans.DocId, ans.Grantee(), "writer")
+}
+
+// ensureReconcile makes sure the reconcile loop runs for the test.
+func (s *Server) ensureReconcile(configDocId string) error {
+	if s.opts.ReconcileInterval <= 0 {
+		return nil
+	}
+	key := "reconcile/" + configDocId
+	jobs, err := s.sched.Lookup(key)
+	if err != nil || len(jobs) > 0 {
+		return err
+	}
+	return s.scheduleJob(time.Now().Add(s.opts.ReconcileInterval), JobTypeReconcile, key, configDocId)
+}
@@ -0,0 +1,634 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gocarina/gocsv"
+	csvtypes "gomodules.xyz/encoding/csv/types"
+	"google.golang.org/api/docs/v1"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/option"
+	"google.golang.org/api/sheets/v4"
+)
+
+// fakeGoogle is an in-memory spreadsheet, Drive folder and set of Drive
+// permissions served over the parts of the Sheets, Drive and Docs apis the
+// server uses. Every spreadsheet id refers to the same spreadsheet, and every
+// file not created through the fake is in the folder "root".
+type fakeGoogle struct {
+	mu       sync.Mutex
+	sheets   map[string]*fakeSheet
+	metadata []*sheets.DeveloperMetadata
+	files    []*drive.File
+	perms    map[string][]*drive.Permission
+	nextId   int64
+	// readOnly makes writes to the values of the sheets fail.
+	readOnly bool
+}
+
+// fakeAccount is the account the server uses with the fake.
+const fakeAccount = "server@x.y"
+
+type fakeSheet struct {
+	id   int64
+	rows [][]string
+}
+
+func newFakeGoogle() *fakeGoogle {
+	return &fakeGoogle{sheets: map[string]*fakeSheet{}, perms: map[string][]*drive.Permission{}}
+}
+
+// newFakeServer returns a test server talking to a fakeGoogle.
+func newFakeServer(t *testing.T) (*Server, *fakeGoogle) {
+	f := newFakeGoogle()
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+
+	s := newTestServer(t)
+	var err error
+	s.svcSheets, err = sheets.NewService(context.TODO(), option.WithEndpoint(srv.URL+"/sheets/"), option.WithHTTPClient(srv.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.svcDrive, err = drive.NewService(context.TODO(), option.WithEndpoint(srv.URL+"/drive/v3/"), option.WithHTTPClient(srv.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.svcDocs, err = docs.NewService(context.TODO(), option.WithEndpoint(srv.URL+"/docs/"), option.WithHTTPClient(srv.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.hub = newStatusHub()
+	return s, f
+}
+
+func (f *fakeGoogle) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p := r.URL.EscapedPath()
+	switch {
+	case strings.HasPrefix(p, "/sheets/v4/spreadsheets/"):
+		f.serveSheets(w, r, strings.TrimPrefix(p, "/sheets/v4/spreadsheets/"))
+	case strings.HasPrefix(p, "/docs/v1/documents/"):
+		// an empty document, or the reply to a batchUpdate
+		writeJSON(w, &docs.Document{})
+	case p == "/drive/v3/about":
+		writeJSON(w, &drive.About{User: &drive.User{EmailAddress: fakeAccount}})
+	case strings.HasPrefix(p, "/drive/v3/files"):
+		parts := strings.Split(strings.TrimPrefix(strings.TrimPrefix(p, "/drive/v3/files"), "/"), "/")
+		for i := range parts {
+			parts[i], _ = url.PathUnescape(parts[i])
+		}
+		f.serveDrive(w, r, parts)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeGoogle) serveSheets(w http.ResponseWriter, r *http.Request, p string) {
+	_, p, nested := strings.Cut(p, "/")
+	switch {
+	case !nested && r.Method == http.MethodGet:
+		resp := &sheets.Spreadsheet{}
+		for title, sh := range f.sheets {
+			resp.Sheets = append(resp.Sheets, &sheets.Sheet{Properties: &sheets.SheetProperties{SheetId: sh.id, Title: title}})
+		}
+		writeJSON(w, resp)
+	case !nested:
+		// :batchUpdate
+		var req sheets.BatchUpdateSpreadsheetRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		resp := &sheets.BatchUpdateSpreadsheetResponse{}
+		for _, req := range req.Requests {
+			reply := &sheets.Response{}
+			switch {
+			case req.AddSheet != nil:
+				f.sheet(req.AddSheet.Properties.Title)
+			case req.CreateDeveloperMetadata != nil:
+				md := req.CreateDeveloperMetadata.DeveloperMetadata
+				f.nextId++
+				md.MetadataId = f.nextId
+				f.metadata = append(f.metadata, md)
+				reply.CreateDeveloperMetadata = &sheets.CreateDeveloperMetadataResponse{DeveloperMetadata: md}
+			}
+			resp.Replies = append(resp.Replies, reply)
+		}
+		writeJSON(w, resp)
+	case p == "developerMetadata:search":
+		resp := &sheets.SearchDeveloperMetadataResponse{}
+		for _, md := range f.metadata {
+			resp.MatchedDeveloperMetadata = append(resp.MatchedDeveloperMetadata, &sheets.MatchedDeveloperMetadata{DeveloperMetadata: md})
+		}
+		writeJSON(w, resp)
+	case f.readOnly && r.Method != http.MethodGet && strings.HasPrefix(p, "values"):
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = fmt.Fprint(w, `{"error":{"code":403,"message":"The caller does not have permission"}}`)
+	case p == "values:batchUpdate":
+		var req sheets.BatchUpdateValuesRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		for _, vr := range req.Data {
+			if title, _, _, _, _ := parseA1(vr.Range); f.sheets[title] == nil {
+				missingRange(w, vr.Range)
+				return
+			}
+		}
+		for _, vr := range req.Data {
+			title, c, row, _, _ := parseA1(vr.Range)
+			f.write(title, row, c, vr.Values)
+		}
+		writeJSON(w, &sheets.BatchUpdateValuesResponse{})
+	case strings.HasPrefix(p, "values/"):
+		rng := strings.TrimPrefix(p, "values/")
+		appending := strings.HasSuffix(rng, ":append")
+		rng, _ = url.PathUnescape(strings.TrimSuffix(rng, ":append"))
+		title, c1, r1, c2, r2 := parseA1(rng)
+		var vr sheets.ValueRange
+		switch {
+		case f.sheets[title] == nil:
+			missingRange(w, rng)
+		case appending:
+			_ = json.NewDecoder(r.Body).Decode(&vr)
+			row := len(f.sheets[title].rows) + 1
+			f.write(title, row, c1, vr.Values)
+			writeJSON(w, &sheets.AppendValuesResponse{Updates: &sheets.UpdateValuesResponse{
+				UpdatedRange: fmt.Sprintf("%s!%s%d", title, columnName(c1-1), row),
+			}})
+		case r.Method == http.MethodPut:
+			_ = json.NewDecoder(r.Body).Decode(&vr)
+			f.write(title, r1, c1, vr.Values)
+			writeJSON(w, &sheets.UpdateValuesResponse{})
+		default:
+			writeJSON(w, f.read(title, c1, r1, c2, r2, r.FormValue("majorDimension") == "COLUMNS"))
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeGoogle) serveDrive(w http.ResponseWriter, r *http.Request, parts []string) {
+	docId := parts[0]
+	switch {
+	case docId == "" && r.Method == http.MethodGet:
+		resp := &drive.FileList{}
+		q := r.FormValue("q")
+		for _, file := range f.files {
+			if strings.Contains(q, quoteQueryValue(file.Name)) && strings.Contains(q, quoteQueryValue(file.Parents[0])+" in parents") {
+				resp.Files = append(resp.Files, file)
+			}
+		}
+		writeJSON(w, resp)
+	case docId == "":
+		var file drive.File
+		_ = json.NewDecoder(r.Body).Decode(&file)
+		writeJSON(w, f.create(&file))
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		for _, file := range f.files {
+			if file.Id == docId {
+				writeJSON(w, file)
+				return
+			}
+		}
+		writeJSON(w, &drive.File{Id: docId, Name: docId, MimeType: MimeTypeDocument, Parents: []string{"root"}})
+	case len(parts) == 1:
+		writeJSON(w, &drive.File{Id: docId})
+	case len(parts) == 2 && parts[1] == "copy":
+		var file drive.File
+		_ = json.NewDecoder(r.Body).Decode(&file)
+		writeJSON(w, f.create(&file))
+	case len(parts) == 2 && parts[1] == "permissions" && r.Method == http.MethodGet:
+		writeJSON(w, &drive.PermissionList{Permissions: f.perms[docId]})
+	case len(parts) == 2 && parts[1] == "permissions":
+		var perm drive.Permission
+		_ = json.NewDecoder(r.Body).Decode(&perm)
+		f.nextId++
+		perm.Id = fmt.Sprintf("perm-%d", f.nextId)
+		f.perms[docId] = append(f.perms[docId], &perm)
+		writeJSON(w, &perm)
+	case len(parts) == 3 && parts[1] == "permissions":
+		for i, perm := range f.perms[docId] {
+			if perm.Id != parts[2] {
+				continue
+			}
+			if r.Method == http.MethodDelete {
+				f.perms[docId] = append(f.perms[docId][:i], f.perms[docId][i+1:]...)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			var update drive.Permission
+			_ = json.NewDecoder(r.Body).Decode(&update)
+			perm.Role = update.Role
+			writeJSON(w, perm)
+			return
+		}
+		http.NotFound(w, r)
+	case len(parts) == 2 && parts[1] == "comments":
+		writeJSON(w, map[string]string{"id": "new"})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// missingRange replies with the error of the Sheets api for a range of a
+// sheet that does not exist.
+func missingRange(w http.ResponseWriter, rng string) {
+	w.WriteHeader(http.StatusBadRequest)
+	_, _ = fmt.Fprintf(w, `{"error":{"code":400,"message":"Unable to parse range: %s"}}`, rng)
+}
+
+func (f *fakeGoogle) create(file *drive.File) *drive.File {
+	f.nextId++
+	file.Id = fmt.Sprintf("file-%d", f.nextId)
+	if len(file.Parents) == 0 {
+		file.Parents = []string{"root"}
+	}
+	f.files = append(f.files, file)
+	return file
+}
+
+// parseA1 returns the sheet and the 1-based bounds of an A1 range, 0 if
+// unbounded, eg, test!C2:C is column 3 from row 2.
+func parseA1(rng string) (title string, c1, r1, c2, r2 int) {
+	title, cells, _ := strings.Cut(rng, "!")
+	if cells == "" {
+		return title, 0, 0, 0, 0
+	}
+	ref := func(s string) (c, r int) {
+		for _, ch := range s {
+			if ch >= 'A' && ch <= 'Z' {
+				c = c*26 + int(ch-'A'+1)
+			} else {
+				r = r*10 + int(ch-'0')
+			}
+		}
+		return c, r
+	}
+	start, end, ok := strings.Cut(cells, ":")
+	if !ok {
+		end = start
+	}
+	c1, r1 = ref(start)
+	c2, r2 = ref(end)
+	return title, c1, r1, c2, r2
+}
+
+func (f *fakeGoogle) sheet(title string) *fakeSheet {
+	if f.sheets[title] == nil {
+		f.nextId++
+		f.sheets[title] = &fakeSheet{id: f.nextId}
+	}
+	return f.sheets[title]
+}
+
+// write writes values to the sheet starting at row and col, 1-based.
+func (f *fakeGoogle) write(title string, row, col int, values [][]interface{}) {
+	sh := f.sheet(title)
+	if col == 0 {
+		col = 1
+	}
+	for i, vs := range values {
+		for len(sh.rows) < row+i {
+			sh.rows = append(sh.rows, nil)
+		}
+		cells := sh.rows[row+i-1]
+		for j, v := range vs {
+			for len(cells) < col+j {
+				cells = append(cells, "")
+			}
+			if v != nil {
+				cells[col+j-1] = fmt.Sprint(v)
+			}
+		}
+		sh.rows[row+i-1] = cells
+	}
+}
+
+// read returns the values in the bounds like the Sheets api does, without
+// trailing empty cells and rows.
+func (f *fakeGoogle) read(title string, c1, r1, c2, r2 int, columns bool) *sheets.ValueRange {
+	sh := f.sheets[title]
+	if r1 == 0 {
+		r1 = 1
+	}
+	if r2 == 0 || r2 > len(sh.rows) {
+		r2 = len(sh.rows)
+	}
+	if c1 == 0 {
+		c1 = 1
+	}
+	var grid [][]string
+	for r := r1; r <= r2; r++ {
+		cells := sh.rows[r-1]
+		end := len(cells)
+		if c2 > 0 && c2 < end {
+			end = c2
+		}
+		var row []string
+		if c1 <= end {
+			row = cells[c1-1 : end]
+		}
+		grid = append(grid, row)
+	}
+	if columns {
+		var transposed [][]string
+		for r, row := range grid {
+			for c, v := range row {
+				for len(transposed) <= c {
+					transposed = append(transposed, nil)
+				}
+				for len(transposed[c]) < r {
+					transposed[c] = append(transposed[c], "")
+				}
+				transposed[c] = append(transposed[c], v)
+			}
+		}
+		grid = transposed
+	}
+
+	vr := &sheets.ValueRange{}
+	for _, row := range grid {
+		for len(row) > 0 && row[len(row)-1] == "" {
+			row = row[:len(row)-1]
+		}
+		values := make([]interface{}, len(row))
+		for i, v := range row {
+			values[i] = v
+		}
+		vr.Values = append(vr.Values, values)
+	}
+	for len(vr.Values) > 0 && len(vr.Values[len(vr.Values)-1]) == 0 {
+		vr.Values = vr.Values[:len(vr.Values)-1]
+	}
+	return vr
+}
+
+// setConfig writes the config sheet.
+func (f *fakeGoogle) setConfig(t *testing.T, cfg QuestionConfig) {
+	w := &memCSV{}
+	if err := gocsv.MarshalCSV([]*QuestionConfig{&cfg}, w); err != nil {
+		t.Fatal(err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sheet(ProjectConfigSheet).rows = w.rows
+}
+
+// addAnswer appends a row for ans to the test sheet, tagged with its row id
+// if it has one, and returns the number of the row.
+func (f *fakeGoogle) addAnswer(t *testing.T, ans TestAnswer) int {
+	w := &memCSV{}
+	if err := gocsv.MarshalCSV([]*TestAnswer{&ans}, w); err != nil {
+		t.Fatal(err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sh := f.sheet(ProjectTestSheet)
+	if len(sh.rows) == 0 {
+		sh.rows = append(sh.rows, w.rows[0])
+	}
+	sh.rows = append(sh.rows, w.rows[1])
+	row := len(sh.rows)
+	if ans.Id != "" {
+		f.nextId++
+		f.metadata = append(f.metadata, &sheets.DeveloperMetadata{
+			MetadataId:    f.nextId,
+			MetadataKey:   rowIdKey,
+			MetadataValue: ans.Id,
+			Location: &sheets.DeveloperMetadataLocation{DimensionRange: &sheets.DimensionRange{
+				SheetId:    sh.id,
+				Dimension:  "ROWS",
+				StartIndex: int64(row - 1),
+				EndIndex:   int64(row),
+			}},
+		})
+	}
+	return row
+}
+
+// deleteRow deletes a row of the test sheet, and moves the row ids of the
+// rows below it up.
+func (f *fakeGoogle) deleteRow(row int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sh := f.sheets[ProjectTestSheet]
+	sh.rows = append(sh.rows[:row-1], sh.rows[row:]...)
+	var kept []*sheets.DeveloperMetadata
+	for _, md := range f.metadata {
+		dr := md.Location.DimensionRange
+		switch {
+		case dr == nil || dr.StartIndex < int64(row-1):
+			kept = append(kept, md)
+		case dr.StartIndex > int64(row-1):
+			dr.StartIndex--
+			dr.EndIndex--
+			kept = append(kept, md)
+		}
+	}
+	f.metadata = kept
+}
+
+// cell returns the cell of a row of a sheet in the column of header.
+func (f *fakeGoogle) cell(title string, row int, header string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	rows := f.sheets[title].rows
+	for i, h := range rows[0] {
+		if h == header && i < len(rows[row-1]) {
+			return rows[row-1][i]
+		}
+	}
+	return ""
+}
+
+func (f *fakeGoogle) setCell(title string, row int, header, value string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	rows := f.sheets[title].rows
+	for i, h := range rows[0] {
+		if h == header {
+			for len(rows[row-1]) <= i {
+				rows[row-1] = append(rows[row-1], "")
+			}
+			rows[row-1][i] = value
+		}
+	}
+}
+
+// role returns the role email has on the doc, or "" if none.
+func (f *fakeGoogle) role(docId, email string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, perm := range f.perms[docId] {
+		if perm.EmailAddress == email {
+			return perm.Role
+		}
+	}
+	return ""
+}
+
+// dueJobs returns when the pending jobs of the candidate are due, by type.
+func dueJobs(t *testing.T, s *Server, configDocId, email string) map[string]time.Time {
+	jobs, err := s.sched.Lookup(jobKey(configDocId, email))
+	if err != nil {
+		t.Fatal(err)
+	}
+	due := map[string]time.Time{}
+	for _, job := range jobs {
+		due[job.Type] = job.Due
+	}
+	return due
+}
+
+// openTest writes the config of a timed test open from yesterday to
+// tomorrow.
+func openTest(t *testing.T, f *fakeGoogle, now time.Time) {
+	f.setConfig(t, QuestionConfig{
+		ConfigType:            ConfigTypeQuestion,
+		QuestionTemplateDocId: "template",
+		StartDate:             LocalTime{Time: now.Add(-24 * time.Hour)},
+		EndDate:               LocalTime{Time: now.Add(24 * time.Hour)},
+		Duration:              csvtypes.Duration{Duration: time.Hour},
+		TimeZone:              "UTC",
+		Mode:                  TestModeTimed,
+		MaxAttempts:           1,
+	})
+}
+
+func TestReconcile(t *testing.T) {
+	s, f := newFakeServer(t)
+	now := time.Now().UTC().Truncate(time.Second)
+	openTest(t, f, now)
+
+	answer := func(email string, end time.Time) TestAnswer {
+		return TestAnswer{
+			Id:        "id-" + email,
+			Email:     email,
+			DocId:     "doc-" + email,
+			StartDate: csvtypes.Timestamp{Time: now.Add(-10 * time.Minute)},
+			EndDate:   csvtypes.Timestamp{Time: end},
+			Attempt:   1,
+		}
+	}
+	end := now.Add(50 * time.Minute)
+	rows := map[string]int{}
+	for _, ans := range []TestAnswer{answer("hand@x.y", end), answer("run@x.y", end), answer("gone@x.y", end)} {
+		rows[ans.Email] = f.addAnswer(t, ans)
+	}
+	submitted := answer("submitted@x.y", end)
+	submitted.SubmittedAt = OptionalTimestamp{Time: now.Add(-time.Minute)}
+	rows[submitted.Email] = f.addAnswer(t, submitted)
+	paused := answer("paused@x.y", end)
+	paused.PausedAt = OptionalTimestamp{Time: now.Add(-time.Minute)}
+	rows[paused.Email] = f.addAnswer(t, paused)
+
+	// started from the landing page, run@x.y failed to get access
+	for _, email := range []string{"run@x.y", "gone@x.y"} {
+		if err := s.scheduleTestJobs("config", answer(email, end)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := setRole(s.svcDrive, "doc-gone@x.y", "gone@x.y", "writer"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Reconcile("config"); err != nil {
+		t.Fatal(err)
+	}
+	for email, want := range map[string]string{
+		"hand@x.y":      SyncStatusRearmed,
+		"run@x.y":       SyncStatusSynced,
+		"submitted@x.y": SyncStatusSubmitted,
+		"paused@x.y":    SyncStatusPaused,
+	} {
+		if got := f.cell(ProjectTestSheet, rows[email], SyncStatusHeader); got != want {
+			t.Errorf("%s: got sync status %q, want %q", email, got, want)
+		}
+	}
+	if got := f.role("doc-run@x.y", "run@x.y"); got != "writer" {
+		t.Errorf("started without access: got role %q, want writer", got)
+	}
+	// added by hand
+	if got := f.role("doc-hand@x.y", "hand@x.y"); got != "writer" {
+		t.Errorf("row added by hand: got role %q, want writer", got)
+	}
+	if due := dueJobs(t, s, "config", "hand@x.y"); !due[JobTypeRevoke].Equal(end) {
+		t.Errorf("row added by hand: revoke due %v, want %v", due[JobTypeRevoke], end)
+	}
+	// access was revoked on submit and is suspended while paused
+	for _, email := range []string{"submitted@x.y", "paused@x.y"} {
+		if got := f.role("doc-"+email, email); got != "" {
+			t.Errorf("%s: got role %q, want no access", email, got)
+		}
+		if due := dueJobs(t, s, "config", email); len(due) != 0 {
+			t.Errorf("%s: got jobs %v, want none", email, due)
+		}
+	}
+
+	// end date changed by hand
+	later := now.Add(2 * time.Hour)
+	f.setCell(ProjectTestSheet, rows["run@x.y"], "End Date", later.Format(csvtypes.TimestampFormat))
+	// row removed by hand
+	f.deleteRow(rows["gone@x.y"])
+	for email, row := range rows {
+		if row > rows["gone@x.y"] {
+			rows[email]--
+		}
+	}
+
+	if err := s.Reconcile("config"); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.cell(ProjectTestSheet, rows["run@x.y"], SyncStatusHeader); got != SyncStatusRearmed {
+		t.Errorf("moved end: got sync status %q, want %q", got, SyncStatusRearmed)
+	}
+	if due := dueJobs(t, s, "config", "run@x.y"); !due[JobTypeRevoke].Equal(later) {
+		t.Errorf("moved end: revoke due %v, want %v", due[JobTypeRevoke], later)
+	}
+	if got := f.role("doc-run@x.y", "run@x.y"); got != "writer" {
+		t.Errorf("moved end: got role %q, want writer", got)
+	}
+	if got := f.role("doc-gone@x.y", "gone@x.y"); got != "" {
+		t.Errorf("removed row: got role %q, want no access", got)
+	}
+	if due := dueJobs(t, s, "config", "gone@x.y"); len(due) != 0 {
+		t.Errorf("removed row: got jobs %v, want none", due)
+	}
+}
+
+func TestConfigChanged(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &QuestionConfig{
+		ConfigType: ConfigTypeQuestion,
+		StartDate:  LocalTime{Time: time.Date(2022, 6, 1, 9, 0, 0, 0, loc)},
+		EndDate:    LocalTime{Time: time.Date(2022, 6, 1, 17, 0, 0, 0, loc)},
+		TimeZone:   "Europe/Berlin",
+	}
+	data, err := json.Marshal(reconcileState{Config: cfg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored reconcileState
+	if err := json.Unmarshal(data, &stored); err != nil {
+		t.Fatal(err)
+	}
+	if configChanged(stored.Config, cfg) {
+		t.Error("config read back from the reconcile state reported as changed")
+	}
+
+	moved := *cfg
+	moved.EndDate = LocalTime{Time: cfg.EndDate.Add(time.Hour)}
+	if !configChanged(stored.Config, &moved) {
+		t.Error("moved end date not reported as changed")
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+	csvtypes "gomodules.xyz/encoding/csv/types"
+)
+
+// Reopen gives email writer access to the doc of their latest attempt again
+// for d, after their test ended or was submitted. The end of test jobs are
+// scheduled for the new end, and the new window and the reason are recorded
+// on their row, before access is granted.
+func (s *Server) Reopen(configDocId, email string, d time.Duration, reason string) (*TestAnswer, error) {
+	if d <= 0 {
+		return nil, errors.Errorf("duration must be positive, got %s", d)
+	}
+	if reason == "" {
+		return nil, errors.New("missing reason")
+	}
+
+	mu := testLock(configDocId)
+	mu.Lock()
+	defer mu.Unlock()
+
+	ts, err := LoadTestSheet(s.svcSheets, configDocId)
+	if err != nil {
+		return nil, err
+	}
+	row := ts.Latest(email)
+	if row == nil {
+		return nil, errors.Errorf("%s has not started the test yet", email)
+	}
+	if row.Err != nil {
+		return nil, errors.Wrapf(row.Err, "invalid row %d", row.Row)
+	}
+	ans := row.Answer
+	// the jobs are keyed by the email as written in the sheet
+	email = ans.Email
+	if !ans.PausedAt.IsZero() {
+		return nil, errors.New("the test is paused, resume it instead")
+	}
+	now := time.Now()
+	if ans.EndDate.After(now) && ans.SubmittedAt.IsZero() {
+		jobs, err := s.sched.Lookup(jobKey(configDocId, email))
+		if err != nil {
+			return nil, err
+		}
+		if hasJob(jobs, JobTypeRevoke) {
+			return nil, errors.New("the test is still running, extend it instead")
+		}
+	}
+
+	oldEnd := ans.EndDate.Time
+	ans.EndDate = csvtypes.Timestamp{Time: now.Add(d)}
+	ans.ReopenedAt = OptionalTimestamp{Time: now}
+	ans.ReopenReason = reason
+	ans.SubmittedAt = OptionalTimestamp{}
+	if err := s.cancelTestJobs(configDocId, email); err != nil {
+		return nil, err
+	}
+	if err := s.scheduleTestJobs(configDocId, ans); err != nil {
+		return nil, err
+	}
+	if _, err := ts.Set(&ans); err != nil {
+		return nil, err
+	}
+	if err := ts.Flush(); err != nil {
+		if cerr := s.cancelTestJobs(configDocId, email); cerr != nil {
+			log.Printf("failed to cancel the jobs of the failed reopen of %s in test %s: %v", email, configDocId, cerr)
+		}
+		return nil, err
+	}
+	if err := s.grant(ans); err != nil {
+		// not marked as applied, so the reconcile loop grants it
+		return nil, errors.Wrap(err, "reopened, but failed to grant access")
+	}
+	if err := s.markApplied(configDocId, ans); err != nil {
+		return nil, err
+	}
+	s.hub.notify(jobKey(configDocId, email), "")
+	s.emit(WebhookEventReopened, configDocId, ans, fmt.Sprintf("reopened for %s: %s", d, reason))
+
+	log.Printf("reopened the test of %s in test %s until %s", email, configDocId, ans.EndDate.Format(time.RFC3339))
+	msg := fmt.Sprintf("Your test was reopened, you have until %s.", formatTime(ans.EndDate.Time, ans.Location()))
+	if err := s.scheduleJob(now, JobTypeComment, jobKey(configDocId, email), Comment{DocId: ans.DocId, Content: msg}); err != nil {
+		log.Printf("failed to notify %s in test %s of the reopen: %v", email, configDocId, err)
+	}
+	if err := s.scheduleJob(now, JobTypeNotify, jobKey(configDocId, email), Notification{
+		ConfigDocId: configDocId,
+		Email:       email,
+		Message:     msg,
+	}); err != nil {
+		log.Printf("failed to notify %s in test %s of the reopen: %v", email, configDocId, err)
+	}
+	err = SaveAuditEvent(s.svcSheets, configDocId, AuditEvent{
+		Time:    csvtypes.Timestamp{Time: now},
+		Email:   email,
+		Event:   AuditEventReopened,
+		Details: fmt.Sprintf("reopened for %s until %s, ended at %s: %s", d, ans.EndDate.UTC().Format(time.RFC3339), oldEnd.UTC().Format(time.RFC3339), reason),
+	})
+	return &ans, err
+}
+
+// reopen serves POST /admin/tests/<configDocId>/reopen?email=<email>&for=<duration>&reason=<reason>
+func (s *Server) reopen(w http.ResponseWriter, r *http.Request, configDocId string) {
+	email := r.FormValue("email")
+	if email == "" {
+		http.Error(w, "missing email", http.StatusBadRequest)
+		return
+	}
+	d, err := time.ParseDuration(r.FormValue("for"))
+	if err != nil {
+		http.Error(w, "invalid for: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	ans, err := s.Reopen(configDocId, email, d, r.FormValue("reason"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	writeJSON(w, ans)
+}
+
+// runReopen implements
+//
+//	reopen --config-doc-id=<id> --email=<email> --for=<duration> --reason=<reason>
+func runReopen(args []string) {
+	fs := flag.NewFlagSet("reopen", flag.ExitOnError)
+	c := adminFlags(fs)
+	configDocId := fs.String("config-doc-id", "", "Id of the spreadsheet of the test")
+	email := fs.String("email", "", "Email of the candidate")
+	d := fs.Duration("for", 0, "How long the candidate gets access again, eg, 30m")
+	reason := fs.String("reason", "", "Why the test is reopened, recorded on the candidate's row")
+	_ = fs.Parse(args)
+	if *configDocId == "" || *email == "" || *d <= 0 || *reason == "" {
+		log.Fatal("usage: reopen --config-doc-id=<id> --email=<email> --for=<duration> --reason=<reason>")
+	}
+
+	q := url.Values{}
+	q.Set("email", *email)
+	q.Set("for", d.String())
+	q.Set("reason", *reason)
+	var ans TestAnswer
+	handleError(c.Do(http.MethodPost, "tests/"+*configDocId+"/reopen?"+q.Encode(), nil, &ans), "Error reopening test")
+	fmt.Printf("reopened the test of %s until %s\n", ans.Email, ans.EndDate.Format(time.RFC3339))
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	csvtypes "gomodules.xyz/encoding/csv/types"
+)
+
+func TestReopen(t *testing.T) {
+	s, f := newFakeServer(t)
+	now := time.Now().UTC().Truncate(time.Second)
+	openTest(t, f, now)
+
+	expired := TestAnswer{
+		Id:        "id-late@x.y",
+		Email:     "late@x.y",
+		DocId:     "doc-late@x.y",
+		StartDate: csvtypes.Timestamp{Time: now.Add(-70 * time.Minute)},
+		EndDate:   csvtypes.Timestamp{Time: now.Add(-10 * time.Minute)},
+		Attempt:   1,
+	}
+	row := f.addAnswer(t, expired)
+	running := TestAnswer{
+		Id:        "id-run@x.y",
+		Email:     "run@x.y",
+		DocId:     "doc-run@x.y",
+		StartDate: csvtypes.Timestamp{Time: now.Add(-10 * time.Minute)},
+		EndDate:   csvtypes.Timestamp{Time: now.Add(50 * time.Minute)},
+		Attempt:   1,
+	}
+	f.addAnswer(t, running)
+	if err := s.scheduleTestJobs("config", running); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Reopen("config", "run@x.y", 30*time.Minute, "outage"); err == nil || !strings.Contains(err.Error(), "extend it instead") {
+		t.Errorf("reopened a running test: %v", err)
+	}
+	if _, err := s.Reopen("config", "late@x.y", 30*time.Minute, ""); err == nil {
+		t.Error("reopened without a reason")
+	}
+
+	ans, err := s.Reopen("config", "late@x.y", 30*time.Minute, "outage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := ans.EndDate.Sub(now); d < 30*time.Minute || d > 31*time.Minute {
+		t.Errorf("reopened until %v, want 30m from now", ans.EndDate)
+	}
+	if ans.ReopenedAt.IsZero() || ans.ReopenReason != "outage" {
+		t.Errorf("reopen not recorded: %+v", ans)
+	}
+	if got := f.role("doc-late@x.y", "late@x.y"); got != "writer" {
+		t.Errorf("got role %q, want writer", got)
+	}
+	if due := dueJobs(t, s, "config", "late@x.y"); !due[JobTypeRevoke].Equal(ans.EndDate.Time) {
+		t.Errorf("revoke due %v, want %v", due[JobTypeRevoke], ans.EndDate)
+	}
+	if got, want := f.cell(ProjectTestSheet, row, "End Date"), ans.EndDate.UTC().Format(csvtypes.TimestampFormat); got != want {
+		t.Errorf("sheet has end date %q, want %q", got, want)
+	}
+	if got := f.cell(ProjectTestSheet, row, "Reopen Reason"); got != "outage" {
+		t.Errorf("sheet has reopen reason %q, want outage", got)
+	}
+	if got := f.cell(ProjectAuditSheet, 2, "Event"); got != AuditEventReopened {
+		t.Errorf("got audit event %q, want %q", got, AuditEventReopened)
+	}
+
+	// now running again
+	if _, err := s.Reopen("config", "late@x.y", 30*time.Minute, "outage"); err == nil {
+		t.Error("reopened a reopened test")
+	}
+}
+
+func TestReopenEmailCase(t *testing.T) {
+	s, f := newFakeServer(t)
+	now := time.Now().UTC().Truncate(time.Second)
+	openTest(t, f, now)
+	f.addAnswer(t, TestAnswer{
+		Id:        "id",
+		Email:     "Late@X.y",
+		DocId:     "doc",
+		StartDate: csvtypes.Timestamp{Time: now.Add(-70 * time.Minute)},
+		EndDate:   csvtypes.Timestamp{Time: now.Add(-10 * time.Minute)},
+		Attempt:   1,
+	})
+
+	ans, err := s.Reopen("config", "late@x.y", 30*time.Minute, "outage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if due := dueJobs(t, s, "config", "Late@X.y"); !due[JobTypeRevoke].Equal(ans.EndDate.Time) {
+		t.Errorf("revoke due %v, want %v", due[JobTypeRevoke], ans.EndDate)
+	}
+}
+
+func TestReopenFailedSave(t *testing.T) {
+	s, f := newFakeServer(t)
+	now := time.Now().UTC().Truncate(time.Second)
+	openTest(t, f, now)
+	f.addAnswer(t, TestAnswer{
+		Id:        "id",
+		Email:     "late@x.y",
+		DocId:     "doc",
+		StartDate: csvtypes.Timestamp{Time: now.Add(-70 * time.Minute)},
+		EndDate:   csvtypes.Timestamp{Time: now.Add(-10 * time.Minute)},
+		Attempt:   1,
+	})
+
+	f.mu.Lock()
+	f.readOnly = true
+	f.mu.Unlock()
+	if _, err := s.Reopen("config", "late@x.y", 30*time.Minute, "outage"); err == nil {
+		t.Fatal("reopened without saving the row")
+	}
+	if got := f.role("doc", "late@x.y"); got != "" {
+		t.Errorf("failed reopen granted %q", got)
+	}
+	if due := dueJobs(t, s, "config", "late@x.y"); len(due) != 0 {
+		t.Errorf("failed reopen left jobs %v", due)
+	}
+}
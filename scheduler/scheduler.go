@@ -0,0 +1,496 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/madflojo/tasks"
+	"github.com/pkg/errors"
+	"github.com/rs/xid"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// JobVersion is the version of the Job envelope written by this package.
+const JobVersion = 1
+
+// Keys in leveldb are
+//
+//	job/<xid>          pending jobs
+//	dead-letter/<xid>  jobs that failed MaxAttempts times
+//	meta/version       keyVersion of the database
+//
+// where <xid> is the string form of the job id, the same id the job is
+// registered with in the in-memory queue.
+var (
+	jobPrefix        = []byte("job/")
+	deadLetterPrefix = []byte("dead-letter/")
+	versionKey       = []byte("meta/version")
+)
+
+// keyVersion is the version of the key scheme. Version 1 databases stored
+// jobs under the raw 12 bytes of their xid.
+const keyVersion = "2"
+
+func jobKey(id string) []byte {
+	return append(append([]byte{}, jobPrefix...), id...)
+}
+
+func deadLetterKey(id string) []byte {
+	return append(append([]byte{}, deadLetterPrefix...), id...)
+}
+
+// Job is the envelope persisted for every scheduled job, so that a job
+// recovered after a restart is dispatched to the handler of its type.
+type Job struct {
+	// ID is assigned by Schedule. The leveldb key is derived from it.
+	ID string `json:"id,omitempty"`
+	// Key is an optional caller supplied key used to look up related jobs,
+	// eg, all jobs of a candidate.
+	Key     string          `json:"key,omitempty"`
+	Type    string          `json:"type"`
+	Version int             `json:"version"`
+	Due     time.Time       `json:"due"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+
+	// Attempts is the number of times the job has failed so far.
+	Attempts  int    `json:"attempts,omitempty"`
+	LastError string `json:"lastError,omitempty"`
+}
+
+var ErrJobNotFound = errors.New("job not found")
+
+// Handler runs a job of the type it is registered for.
+type Handler func(job *Job) error
+
+// Options controls how failed jobs are retried. A failed job is retried after
+// Backoff, doubling every attempt up to MaxBackoff. After MaxAttempts failures
+// the job is moved to the dead letters.
+type Options struct {
+	MaxAttempts int
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+}
+
+func DefaultOptions() Options {
+	return Options{
+		MaxAttempts: 5,
+		Backoff:     30 * time.Second,
+		MaxBackoff:  30 * time.Minute,
+	}
+}
+
+type Scheduler struct {
+	db   *leveldb.DB
+	s    *tasks.Scheduler
+	opts Options
+
+	mu       sync.RWMutex
+	handlers map[string]Handler
+
+	// jobMu serializes changes to pending jobs, so the in-memory queue and
+	// leveldb are updated together.
+	jobMu sync.Mutex
+}
+
+func NewScheduler(path string, opts Options) (*Scheduler, error) {
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = 1
+	}
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := migrate(db); err != nil {
+		_ = db.Close()
+		return nil, errors.Wrap(err, "failed to migrate scheduler db")
+	}
+	return &Scheduler{
+		s:        tasks.New(),
+		db:       db,
+		opts:     opts,
+		handlers: map[string]Handler{},
+	}, nil
+}
+
+func (s *Scheduler) Close() error {
+	s.s.Stop()
+	return s.db.Close()
+}
+
+// Len returns the number of tasks currently waiting in the in-memory queue.
+func (s *Scheduler) Len() int {
+	return len(s.s.Tasks())
+}
+
+// Ping checks that the underlying leveldb is open and readable.
+func (s *Scheduler) Ping() error {
+	_, err := s.db.GetProperty("leveldb.num-files-at-level0")
+	return err
+}
+
+// Register sets the handler for jobType. All job types must be registered
+// before Recover is called, otherwise persisted jobs of that type are skipped.
+func (s *Scheduler) Register(jobType string, h Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[jobType] = h
+}
+
+func (s *Scheduler) handler(jobType string) (Handler, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	h, ok := s.handlers[jobType]
+	return h, ok
+}
+
+// Recover re-arms the jobs persisted by a previous run. Jobs that became due
+// while the process was down run right away.
+func (s *Scheduler) Recover() error {
+	s.jobMu.Lock()
+	defer s.jobMu.Unlock()
+
+	iter := s.db.NewIterator(util.BytesPrefix(jobPrefix), nil)
+	for iter.Next() {
+		// Remember that the contents of the returned slice should not be modified, and
+		// only valid until the next call to Next.
+		key := string(iter.Key())
+		data := iter.Value()
+
+		id, err := xid.FromString(strings.TrimPrefix(key, string(jobPrefix)))
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "skipping task with invalid key %s: %v\n", key, err)
+			continue
+		}
+		var job Job
+		if err := json.Unmarshal(data, &job); err != nil || job.Type == "" {
+			_, _ = fmt.Fprintf(os.Stderr, "skipping task id %s with unrecognized data %s\n", id, string(data))
+			continue
+		}
+		job.ID = id.String()
+		if t, _ := s.s.Lookup(taskID(&job)); t != nil {
+			continue
+		}
+		if _, ok := s.handler(job.Type); !ok {
+			_, _ = fmt.Fprintf(os.Stderr, "skipping task id %s, no handler registered for job type %s\n", id, job.Type)
+			continue
+		}
+		if err := s.add(id, &job); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "failed to recover task id %s, type %s, err: %v\n", id, job.Type, err)
+		}
+	}
+	iter.Release()
+	return iter.Error()
+}
+
+// Schedule persists a job of jobType that runs at t with the given payload and
+// returns the id of the job. key may be empty. t is kept in UTC, so the time
+// zone it was computed in, and daylight saving changes in it, don't matter.
+func (s *Scheduler) Schedule(t time.Time, jobType string, key string, payload []byte) (string, error) {
+	if _, ok := s.handler(jobType); !ok {
+		return "", errors.Errorf("no handler registered for job type %s", jobType)
+	}
+	job := &Job{
+		Key:     key,
+		Type:    jobType,
+		Version: JobVersion,
+		Due:     t.UTC(),
+		Payload: payload,
+	}
+	data, err := json.Marshal(job)
+	if err != nil {
+		return "", err
+	}
+
+	s.jobMu.Lock()
+	defer s.jobMu.Unlock()
+	for {
+		id := xid.New()
+		job.ID = id.String()
+		err := s.add(id, job)
+		if err == tasks.ErrIDInUse {
+			continue
+		} else if err != nil {
+			return "", errors.Wrapf(err, "failed to schedule task")
+		}
+		if err = s.db.Put(jobKey(job.ID), data, nil); err != nil {
+			s.s.Del(taskID(job))
+			return "", err
+		}
+		return id.String(), nil
+	}
+}
+
+// Get returns the pending job with the given id.
+func (s *Scheduler) Get(id string) (*Job, error) {
+	if _, err := xid.FromString(id); err != nil {
+		return nil, errors.Wrapf(err, "invalid job id %s", id)
+	}
+	return s.get(jobKey(id), id)
+}
+
+func (s *Scheduler) get(key []byte, id string) (*Job, error) {
+	data, err := s.db.Get(key, nil)
+	if err == leveldb.ErrNotFound {
+		return nil, ErrJobNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	var job Job
+	if err := json.Unmarshal(data, &job); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode job %s", id)
+	}
+	job.ID = id
+	return &job, nil
+}
+
+// Cancel removes the pending job with the given id, both from the in-memory
+// queue and from leveldb.
+func (s *Scheduler) Cancel(id string) error {
+	s.jobMu.Lock()
+	defer s.jobMu.Unlock()
+
+	job, err := s.Get(id)
+	if err != nil {
+		return err
+	}
+	s.s.Del(taskID(job))
+	return s.db.Delete(jobKey(id), nil)
+}
+
+// Reschedule moves the pending job with the given id to run at t.
+func (s *Scheduler) Reschedule(id string, t time.Time) error {
+	s.jobMu.Lock()
+	defer s.jobMu.Unlock()
+
+	job, err := s.Get(id)
+	if err != nil {
+		return err
+	}
+	s.s.Del(taskID(job))
+
+	job.Due = t.UTC()
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	xi, _ := xid.FromString(id)
+	if err := s.db.Put(jobKey(id), data, nil); err != nil {
+		return err
+	}
+	return s.add(xi, job)
+}
+
+// List returns all pending jobs ordered by id, ie, by the time they were scheduled.
+func (s *Scheduler) List() ([]*Job, error) {
+	return s.list(func(*Job) bool { return true })
+}
+
+// Lookup returns the pending jobs scheduled with key.
+func (s *Scheduler) Lookup(key string) ([]*Job, error) {
+	return s.list(func(job *Job) bool { return job.Key == key })
+}
+
+func (s *Scheduler) list(match func(*Job) bool) ([]*Job, error) {
+	var jobs []*Job
+	iter := s.db.NewIterator(util.BytesPrefix(jobPrefix), nil)
+	for iter.Next() {
+		var job Job
+		if err := json.Unmarshal(iter.Value(), &job); err != nil || job.Type == "" {
+			continue
+		}
+		job.ID = string(iter.Key()[len(jobPrefix):])
+		if match(&job) {
+			jobs = append(jobs, &job)
+		}
+	}
+	iter.Release()
+	return jobs, iter.Error()
+}
+
+// DeadLetters returns the jobs that failed MaxAttempts times.
+func (s *Scheduler) DeadLetters() ([]*Job, error) {
+	var jobs []*Job
+	iter := s.db.NewIterator(util.BytesPrefix(deadLetterPrefix), nil)
+	for iter.Next() {
+		var job Job
+		if err := json.Unmarshal(iter.Value(), &job); err != nil {
+			continue
+		}
+		job.ID = string(iter.Key()[len(deadLetterPrefix):])
+		jobs = append(jobs, &job)
+	}
+	iter.Release()
+	return jobs, iter.Error()
+}
+
+// Replay moves the dead letter with the given id back to the pending jobs and
+// runs it right away with a fresh attempt count.
+func (s *Scheduler) Replay(id string) error {
+	xi, err := xid.FromString(id)
+	if err != nil {
+		return errors.Wrapf(err, "invalid job id %s", id)
+	}
+	dlKey := deadLetterKey(id)
+
+	s.jobMu.Lock()
+	defer s.jobMu.Unlock()
+
+	job, err := s.get(dlKey, id)
+	if err != nil {
+		return err
+	}
+	if _, ok := s.handler(job.Type); !ok {
+		return errors.Errorf("no handler registered for job type %s", job.Type)
+	}
+	job.Due = time.Now()
+	job.Attempts = 0
+	job.LastError = ""
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	batch := new(leveldb.Batch)
+	batch.Delete(dlKey)
+	batch.Put(jobKey(id), data)
+	if err := s.db.Write(batch, nil); err != nil {
+		return err
+	}
+	return s.add(xi, job)
+}
+
+func (s *Scheduler) add(id xid.ID, job *Job) error {
+	return s.s.AddWithID(taskID(job), &tasks.Task{
+		Interval: intervalUntil(job.Due),
+		RunOnce:  true,
+		TaskFunc: func() error {
+			h, ok := s.handler(job.Type)
+			if !ok {
+				return s.fail(id, job, errors.Errorf("no handler registered for job type %s", job.Type))
+			}
+			if err := h(job); err != nil {
+				return s.fail(id, job, err)
+			}
+			return s.db.Delete(jobKey(job.ID), nil)
+		},
+		ErrFunc: func(e error) {
+			_, _ = fmt.Fprintf(os.Stderr, "an error occurred when executing task %s of type %s - %v\n", id, job.Type, e)
+		},
+	})
+}
+
+// fail records a failed attempt of job. The job is retried with backoff until
+// it has failed MaxAttempts times, then it is moved to the dead letters.
+func (s *Scheduler) fail(id xid.ID, job *Job, cause error) error {
+	s.jobMu.Lock()
+	defer s.jobMu.Unlock()
+
+	if _, err := s.Get(id.String()); err == ErrJobNotFound {
+		// canceled while running
+		return cause
+	}
+
+	job.Attempts++
+	job.LastError = cause.Error()
+	if job.Attempts >= s.opts.MaxAttempts {
+		data, err := json.Marshal(job)
+		if err != nil {
+			return err
+		}
+		batch := new(leveldb.Batch)
+		batch.Delete(jobKey(job.ID))
+		batch.Put(deadLetterKey(job.ID), data)
+		if err := s.db.Write(batch, nil); err != nil {
+			return err
+		}
+		return errors.Wrapf(cause, "giving up after %d attempts", job.Attempts)
+	}
+
+	job.Due = time.Now().Add(s.backoff(job.Attempts))
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	if err := s.db.Put(jobKey(job.ID), data, nil); err != nil {
+		return err
+	}
+	if err := s.add(id, job); err != nil {
+		return err
+	}
+	return errors.Wrapf(cause, "attempt %d failed, retrying at %s", job.Attempts, job.Due.Format(time.RFC3339))
+}
+
+func (s *Scheduler) backoff(attempts int) time.Duration {
+	d := s.opts.Backoff
+	for i := 1; i < attempts && d < s.opts.MaxBackoff; i++ {
+		d *= 2
+	}
+	if s.opts.MaxBackoff > 0 && d > s.opts.MaxBackoff {
+		d = s.opts.MaxBackoff
+	}
+	return d
+}
+
+// taskID is the id of the in-memory task of job. Every attempt gets its own
+// task id, since tasks removes a run once task only after its ErrFunc has been
+// started.
+func taskID(job *Job) string {
+	if job.Attempts == 0 {
+		return job.ID
+	}
+	return fmt.Sprintf("%s-%d", job.ID, job.Attempts)
+}
+
+// intervalUntil returns the delay before t, which is never zero since tasks
+// refuses to schedule a task without an interval.
+func intervalUntil(t time.Time) time.Duration {
+	if d := time.Until(t); d > 0 {
+		return d
+	}
+	return time.Millisecond
+}
+
+// migrate rewrites a database written with an older key scheme. Version 1
+// databases have no version key and store jobs, and dead letters after the
+// dead-letter/ prefix, under the raw 12 bytes of the job's xid.
+func migrate(db *leveldb.DB) error {
+	v, err := db.Get(versionKey, nil)
+	if err == nil && string(v) == keyVersion {
+		return nil
+	} else if err != nil && err != leveldb.ErrNotFound {
+		return err
+	}
+
+	batch := new(leveldb.Batch)
+	iter := db.NewIterator(nil, nil)
+	for iter.Next() {
+		key := iter.Key()
+		var newKey []byte
+		if string(key) == string(versionKey) {
+			continue
+		} else if id, err := xid.FromBytes(key); err == nil {
+			newKey = jobKey(id.String())
+		} else if len(key) == len(deadLetterPrefix)+12 && string(key[:len(deadLetterPrefix)]) == string(deadLetterPrefix) {
+			id, err := xid.FromBytes(key[len(deadLetterPrefix):])
+			if err != nil {
+				continue
+			}
+			newKey = deadLetterKey(id.String())
+		} else {
+			continue
+		}
+		batch.Delete(key)
+		batch.Put(newKey, append([]byte{}, iter.Value()...))
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	batch.Put(versionKey, []byte(keyVersion))
+	return db.Write(batch, nil)
+}
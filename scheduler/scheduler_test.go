@@ -0,0 +1,312 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/xid"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+const testJobType = "test"
+
+func testOptions() Options {
+	return Options{
+		MaxAttempts: 3,
+		Backoff:     10 * time.Millisecond,
+		MaxBackoff:  20 * time.Millisecond,
+	}
+}
+
+func newTestScheduler(t *testing.T, dir string, h Handler) *Scheduler {
+	t.Helper()
+	s, err := NewScheduler(dir, testOptions())
+	if err != nil {
+		t.Fatalf("failed to open scheduler: %v", err)
+	}
+	s.Register(testJobType, h)
+	if err := s.Recover(); err != nil {
+		t.Fatalf("failed to recover jobs: %v", err)
+	}
+	return s
+}
+
+// recorder is a Handler that reports the payload of every job it runs.
+type recorder chan string
+
+func (r recorder) handle(job *Job) error {
+	r <- string(job.Payload)
+	return nil
+}
+
+func (r recorder) wait(t *testing.T) string {
+	t.Helper()
+	select {
+	case p := <-r:
+		return p
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for job to run")
+		return ""
+	}
+}
+
+func (r recorder) none(t *testing.T, d time.Duration) {
+	t.Helper()
+	select {
+	case p := <-r:
+		t.Fatalf("unexpected run of job with payload %s", p)
+	case <-time.After(d):
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func pending(t *testing.T, s *Scheduler) int {
+	t.Helper()
+	jobs, err := s.List()
+	if err != nil {
+		t.Fatalf("failed to list jobs: %v", err)
+	}
+	return len(jobs)
+}
+
+func TestScheduleFire(t *testing.T) {
+	r := make(recorder, 1)
+	s := newTestScheduler(t, t.TempDir(), r.handle)
+	defer s.Close()
+
+	id, err := s.Schedule(time.Now().Add(20*time.Millisecond), testJobType, "k", []byte(`"a"`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job, err := s.Get(id); err != nil || job.Key != "k" {
+		t.Fatalf("Get(%s) = %+v, %v", id, job, err)
+	}
+
+	if p := r.wait(t); p != `"a"` {
+		t.Errorf("job ran with payload %s, want \"a\"", p)
+	}
+	waitFor(t, func() bool { return pending(t, s) == 0 })
+	if _, err := s.Get(id); err != ErrJobNotFound {
+		t.Errorf("Get(%s) after run returned %v, want ErrJobNotFound", id, err)
+	}
+}
+
+func TestScheduleUnknownType(t *testing.T) {
+	s := newTestScheduler(t, t.TempDir(), recorder(nil).handle)
+	defer s.Close()
+
+	if _, err := s.Schedule(time.Now(), "unknown", "", nil); err == nil {
+		t.Error("expected error scheduling a job without handler")
+	}
+}
+
+func TestRestartRecoversPendingJobs(t *testing.T) {
+	dir := t.TempDir()
+	r := make(recorder, 2)
+
+	s := newTestScheduler(t, dir, r.handle)
+	later, err := s.Schedule(time.Now().Add(time.Hour), testJobType, "k", []byte(`"later"`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Schedule(time.Now().Add(50*time.Millisecond), testJobType, "k", []byte(`"missed"`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// the job that became due while the scheduler was down runs right away
+	s = newTestScheduler(t, dir, r.handle)
+	defer s.Close()
+	if p := r.wait(t); p != `"missed"` {
+		t.Errorf("recovered job ran with payload %s, want \"missed\"", p)
+	}
+	r.none(t, 50*time.Millisecond)
+
+	if s.Len() != 1 {
+		t.Errorf("queue has %d tasks after recovery, want 1", s.Len())
+	}
+	jobs, err := s.Lookup("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].ID != later {
+		t.Fatalf("Lookup(k) = %+v, want job %s", jobs, later)
+	}
+}
+
+func TestRecoverSkipsLiveJobs(t *testing.T) {
+	r := make(recorder, 1)
+	s := newTestScheduler(t, t.TempDir(), r.handle)
+	defer s.Close()
+
+	if _, err := s.Schedule(time.Now().Add(time.Hour), testJobType, "", []byte(`"live"`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	r.none(t, 50*time.Millisecond)
+	if s.Len() != 1 {
+		t.Errorf("queue has %d tasks, want 1", s.Len())
+	}
+}
+
+func TestCancelAndReschedule(t *testing.T) {
+	r := make(recorder, 1)
+	s := newTestScheduler(t, t.TempDir(), r.handle)
+	defer s.Close()
+
+	canceled, err := s.Schedule(time.Now().Add(50*time.Millisecond), testJobType, "", []byte(`"canceled"`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved, err := s.Schedule(time.Now().Add(time.Hour), testJobType, "", []byte(`"moved"`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Cancel(canceled); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Cancel(canceled); err != ErrJobNotFound {
+		t.Errorf("second Cancel returned %v, want ErrJobNotFound", err)
+	}
+	if err := s.Reschedule(moved, time.Now().Add(20*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+
+	if p := r.wait(t); p != `"moved"` {
+		t.Errorf("job ran with payload %s, want \"moved\"", p)
+	}
+	r.none(t, 100*time.Millisecond)
+	waitFor(t, func() bool { return pending(t, s) == 0 && s.Len() == 0 })
+}
+
+func TestRetryThenDeadLetter(t *testing.T) {
+	var calls int32
+	s := newTestScheduler(t, t.TempDir(), func(job *Job) error {
+		atomic.AddInt32(&calls, 1)
+		return errors.New("drive is down")
+	})
+	defer s.Close()
+
+	id, err := s.Schedule(time.Now(), testJobType, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		dl, _ := s.DeadLetters()
+		return len(dl) == 1
+	})
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Errorf("handler ran %d times, want 3", n)
+	}
+	dl, _ := s.DeadLetters()
+	if dl[0].ID != id || dl[0].Attempts != 3 || dl[0].LastError != "drive is down" {
+		t.Errorf("unexpected dead letter %+v", dl[0])
+	}
+	if pending(t, s) != 0 {
+		t.Error("dead letter is still pending")
+	}
+
+	r := make(recorder, 1)
+	s.Register(testJobType, r.handle)
+	if err := s.Replay(id); err != nil {
+		t.Fatal(err)
+	}
+	r.wait(t)
+	waitFor(t, func() bool {
+		dl, _ := s.DeadLetters()
+		return len(dl) == 0 && pending(t, s) == 0
+	})
+}
+
+func TestRetrySucceeds(t *testing.T) {
+	var calls int32
+	done := make(chan struct{})
+	s := newTestScheduler(t, t.TempDir(), func(job *Job) error {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			return errors.New("transient")
+		}
+		close(done)
+		return nil
+	})
+	defer s.Close()
+
+	if _, err := s.Schedule(time.Now(), testJobType, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("job was not retried")
+	}
+	waitFor(t, func() bool { return pending(t, s) == 0 })
+	if dl, _ := s.DeadLetters(); len(dl) != 0 {
+		t.Errorf("found %d dead letters, want 0", len(dl))
+	}
+}
+
+func TestMigrateLegacyKeys(t *testing.T) {
+	dir := t.TempDir()
+	pendingID, deadID := xid.New(), xid.New()
+	job := func(payload string) []byte {
+		data, _ := json.Marshal(Job{Type: testJobType, Version: JobVersion, Due: time.Now().Add(time.Hour), Payload: json.RawMessage(payload)})
+		return data
+	}
+
+	db, err := leveldb.OpenFile(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put(pendingID.Bytes(), job(`"pending"`), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put(append([]byte("dead-letter/"), deadID.Bytes()...), job(`"dead"`), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := make(recorder, 1)
+	s := newTestScheduler(t, dir, r.handle)
+	defer s.Close()
+
+	got, err := s.Get(pendingID.String())
+	if err != nil {
+		t.Fatalf("migrated job not found: %v", err)
+	}
+	if string(got.Payload) != `"pending"` {
+		t.Errorf("migrated job has payload %s", got.Payload)
+	}
+	if s.Len() != 1 {
+		t.Errorf("queue has %d tasks after recovery, want 1", s.Len())
+	}
+	dl, err := s.DeadLetters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dl) != 1 || dl[0].ID != deadID.String() {
+		t.Errorf("DeadLetters() = %+v, want %s", dl, deadID)
+	}
+	if _, err := s.db.Get(pendingID.Bytes(), nil); err != leveldb.ErrNotFound {
+		t.Errorf("legacy key still present: %v", err)
+	}
+}
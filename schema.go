@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/gocarina/gocsv"
+	"github.com/pkg/errors"
+	gdrive "gomodules.xyz/gdrive-utils"
+	"google.golang.org/api/option"
+	"google.golang.org/api/sheets/v4"
+)
+
+// SchemaVersion is the version of the layout of the project sheets. Bump it
+// whenever a column is added to one of the sheets.
+const SchemaVersion = 10
+
+// schemaVersionKey is the key of the developer metadata of the project
+// spreadsheet holding the schema version it was last migrated to.
+const schemaVersionKey = "gdocSchemaVersion"
+
+// SheetSchema is the list of headers a project sheet is expected to have.
+type SheetSchema struct {
+	Name    string
+	Headers []string
+}
+
+// ProjectSchema returns the layout of every sheet of a project. The headers
+// come from the csv tags of the types stored in them.
+func ProjectSchema() ([]SheetSchema, error) {
+	config, err := csvHeaders([]*QuestionConfig{})
+	if err != nil {
+		return nil, err
+	}
+	test, err := csvHeaders([]*TestAnswer{})
+	if err != nil {
+		return nil, err
+	}
+	audit, err := csvHeaders([]*AuditEvent{})
+	if err != nil {
+		return nil, err
+	}
+	return []SheetSchema{
+		{Name: ProjectConfigSheet, Headers: config},
+		{Name: ProjectTestSheet, Headers: append(test, SyncStatusHeader, SyncErrorHeader)},
+		{Name: ProjectAuditSheet, Headers: audit},
+	}, nil
+}
+
+// csvHeaders returns the headers gocsv writes for a slice of the type of in.
+func csvHeaders(in interface{}) ([]string, error) {
+	w := &memCSV{}
+	if err := gocsv.MarshalCSV(in, w); err != nil {
+		return nil, err
+	}
+	if len(w.rows) == 0 {
+		return nil, errors.Errorf("no csv headers for %T", in)
+	}
+	return w.rows[0], nil
+}
+
+// missingHeaders returns the headers of want that are not in have, in the
+// order of want.
+func missingHeaders(have, want []string) []string {
+	seen := map[string]bool{}
+	for _, h := range have {
+		seen[strings.TrimSpace(h)] = true
+	}
+	var missing []string
+	for _, h := range want {
+		if !seen[h] {
+			missing = append(missing, h)
+		}
+	}
+	return missing
+}
+
+// MigrateResult describes the changes made to a project spreadsheet.
+type MigrateResult struct {
+	CreatedSheets []string            `json:"createdSheets,omitempty"`
+	AddedHeaders  map[string][]string `json:"addedHeaders,omitempty"`
+	FromVersion   int                 `json:"fromVersion"`
+	ToVersion     int                 `json:"toVersion"`
+}
+
+// Migrate brings the sheets of the project up to the current schema. Missing
+// sheets are created, and missing columns are added after the existing ones,
+// so data already in the sheets is never moved. If dryRun is set, the changes
+// are only reported.
+func Migrate(svcSheets *sheets.Service, configDocId string, dryRun bool) (*MigrateResult, error) {
+	from, metadataId, err := GetSchemaVersion(svcSheets, configDocId)
+	if err != nil {
+		return nil, err
+	}
+	if from > SchemaVersion {
+		return nil, errors.Errorf("spreadsheet %s has schema version %d, newer than %d", configDocId, from, SchemaVersion)
+	}
+	result := &MigrateResult{
+		AddedHeaders: map[string][]string{},
+		FromVersion:  from,
+		ToVersion:    SchemaVersion,
+	}
+
+	schema, err := ProjectSchema()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := svcSheets.Spreadsheets.Get(configDocId).Fields("sheets.properties.title").Do()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read spreadsheet %s", configDocId)
+	}
+	exists := map[string]bool{}
+	for _, sheet := range resp.Sheets {
+		exists[sheet.Properties.Title] = true
+	}
+	si, err := gdrive.NewSpreadsheet(svcSheets, configDocId)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, s := range schema {
+		if !exists[s.Name] {
+			result.CreatedSheets = append(result.CreatedSheets, s.Name)
+			if dryRun {
+				continue
+			}
+			if _, err := si.EnsureSheet(s.Name, s.Headers); err != nil {
+				return nil, errors.Wrapf(err, "failed to create sheet %s", s.Name)
+			}
+			continue
+		}
+
+		vr, err := svcSheets.Spreadsheets.Values.Get(configDocId, s.Name+"!1:1").Do()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read the header of sheet %s", s.Name)
+		}
+		var have []string
+		if len(vr.Values) > 0 {
+			for _, v := range vr.Values[0] {
+				have = append(have, cellString(v))
+			}
+		}
+		missing := missingHeaders(have, s.Headers)
+		if len(missing) == 0 {
+			continue
+		}
+		result.AddedHeaders[s.Name] = missing
+		if dryRun {
+			continue
+		}
+		row := make([]interface{}, len(missing))
+		for i, h := range missing {
+			row[i] = h
+		}
+		_, err = svcSheets.Spreadsheets.Values.Update(configDocId, fmt.Sprintf("%s!%s1", s.Name, columnName(len(have))), &sheets.ValueRange{
+			Values: [][]interface{}{row},
+		}).ValueInputOption("RAW").Do()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to add headers to sheet %s", s.Name)
+		}
+	}
+
+	if dryRun || from == SchemaVersion {
+		return result, nil
+	}
+	if err := setSchemaVersion(svcSheets, configDocId, metadataId, SchemaVersion); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// GetSchemaVersion returns the schema version recorded in the developer
+// metadata of the spreadsheet and the id of the metadata. The version is 0 if
+// the spreadsheet was never migrated.
+func GetSchemaVersion(svcSheets *sheets.Service, configDocId string) (int, int64, error) {
+	resp, err := svcSheets.Spreadsheets.DeveloperMetadata.Search(configDocId, &sheets.SearchDeveloperMetadataRequest{
+		DataFilters: []*sheets.DataFilter{
+			{
+				DeveloperMetadataLookup: &sheets.DeveloperMetadataLookup{
+					MetadataKey:  schemaVersionKey,
+					LocationType: "SPREADSHEET",
+				},
+			},
+		},
+	}).Do()
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "failed to read the schema version of spreadsheet %s", configDocId)
+	}
+	for _, m := range resp.MatchedDeveloperMetadata {
+		md := m.DeveloperMetadata
+		v, err := strconv.Atoi(md.MetadataValue)
+		if err != nil {
+			return 0, 0, errors.Wrapf(err, "invalid schema version %q", md.MetadataValue)
+		}
+		return v, md.MetadataId, nil
+	}
+	return 0, 0, nil
+}
+
+func setSchemaVersion(svcSheets *sheets.Service, configDocId string, metadataId int64, version int) error {
+	var req *sheets.Request
+	if metadataId == 0 {
+		req = &sheets.Request{
+			CreateDeveloperMetadata: &sheets.CreateDeveloperMetadataRequest{
+				DeveloperMetadata: &sheets.DeveloperMetadata{
+					MetadataKey:   schemaVersionKey,
+					MetadataValue: strconv.Itoa(version),
+					Location:      &sheets.DeveloperMetadataLocation{Spreadsheet: true},
+					Visibility:    "DOCUMENT",
+				},
+			},
+		}
+	} else {
+		req = &sheets.Request{
+			UpdateDeveloperMetadata: &sheets.UpdateDeveloperMetadataRequest{
+				DataFilters: []*sheets.DataFilter{
+					{
+						DeveloperMetadataLookup: &sheets.DeveloperMetadataLookup{MetadataId: metadataId},
+					},
+				},
+				DeveloperMetadata: &sheets.DeveloperMetadata{MetadataValue: strconv.Itoa(version)},
+				Fields:            "metadataValue",
+			},
+		}
+	}
+	_, err := svcSheets.Spreadsheets.BatchUpdate(configDocId, &sheets.BatchUpdateSpreadsheetRequest{
+		Requests: []*sheets.Request{req},
+	}).Do()
+	return errors.Wrapf(err, "failed to record the schema version of spreadsheet %s", configDocId)
+}
+
+// runMigrate implements
+//
+//	migrate --config-doc-id=<id> [--dry-run]
+func runMigrate(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	configDocId := fs.String("config-doc-id", "", "Id of the spreadsheet of the test to migrate")
+	dryRun := fs.Bool("dry-run", false, "Only print the changes that would be made")
+	_ = fs.Parse(args)
+	if *configDocId == "" {
+		log.Fatal("usage: migrate --config-doc-id=<id> [--dry-run]")
+	}
+
+	client, err := gdrive.DefaultClient(".")
+	handleError(err, "Error creating YouTube client")
+
+	svcSheets, err := sheets.NewService(context.TODO(), option.WithHTTPClient(client))
+	handleError(err, "Error creating Sheets client")
+
+	result, err := Migrate(svcSheets, *configDocId, *dryRun)
+	handleError(err, "Error migrating spreadsheet")
+	for _, name := range result.CreatedSheets {
+		fmt.Printf("created sheet %s\n", name)
+	}
+	for name, headers := range result.AddedHeaders {
+		fmt.Printf("added columns to sheet %s: %s\n", name, strings.Join(headers, ", "))
+	}
+	fmt.Printf("schema version %d -> %d\n", result.FromVersion, result.ToVersion)
+	if *dryRun {
+		fmt.Println("dry run, no changes made")
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestProjectSchema(t *testing.T) {
+	schema, err := ProjectSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers := map[string][]string{}
+	for _, s := range schema {
+		headers[s.Name] = s.Headers
+	}
+	if got := headers[ProjectConfigSheet]; len(got) == 0 || got[0] != "Config Type" {
+		t.Errorf("config headers = %v", got)
+	}
+	test := headers[ProjectTestSheet]
+	if len(test) < 2 || test[len(test)-2] != SyncStatusHeader || test[len(test)-1] != SyncErrorHeader {
+		t.Errorf("test headers = %v", test)
+	}
+	if got := headers[ProjectAuditSheet]; !reflect.DeepEqual(got, []string{"Time", "Email", "Event", "Details"}) {
+		t.Errorf("audit headers = %v", got)
+	}
+}
+
+func TestMissingHeaders(t *testing.T) {
+	cases := []struct {
+		have, want, missing []string
+	}{
+		{nil, []string{"A", "B"}, []string{"A", "B"}},
+		{[]string{"A", "B"}, []string{"A", "B"}, nil},
+		// existing columns keep their place, manual columns are left alone
+		{[]string{"B", "Notes", " A "}, []string{"A", "B", "C", "D"}, []string{"C", "D"}},
+	}
+	for _, c := range cases {
+		if got := missingHeaders(c.have, c.want); !reflect.DeepEqual(got, c.missing) {
+			t.Errorf("missingHeaders(%v, %v) = %v, want %v", c.have, c.want, got, c.missing)
+		}
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/tamalsaha/gdoc-expiring-link/scheduler"
+	gdrive "gomodules.xyz/gdrive-utils"
+	"google.golang.org/api/docs/v1"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/sheets/v4"
+)
+
+type Server struct {
+	svcDrive  *drive.Service
+	svcDocs   *docs.Service
+	svcSheets *sheets.Service
+	sched     *scheduler.Scheduler
+	db        *leveldb.DB
+	opts      ServerOptions
+	hub       *statusHub
+
+	mux *http.ServeMux
+}
+
+type ServerOptions struct {
+	// AdminToken is the bearer token required by the /admin/ api. The admin
+	// api is disabled when it is empty.
+	AdminToken string
+	// ReconcileInterval is how often manual edits to the sheets of an open
+	// test are applied. The reconcile loop is disabled when it is 0.
+	ReconcileInterval time.Duration
+	// Mailer sends one-time codes to candidates. Codes are logged when it is
+	// nil.
+	Mailer Mailer
+	// SessionSecret signs the sessions of verified candidates. A random
+	// secret is used when it is empty, and sessions end on restart.
+	SessionSecret []byte
+	// OIDC signs candidates in with Google before they start, to grant
+	// access to the account they use. Sign in is skipped when it is nil.
+	OIDC *OIDCProvider
+}
+
+func NewServer(svcDrive *drive.Service, svcDocs *docs.Service, svcSheets *sheets.Service, sched *scheduler.Scheduler, db *leveldb.DB, opts ServerOptions) *Server {
+	if opts.Mailer == nil {
+		opts.Mailer = LogMailer{}
+	}
+	if len(opts.SessionSecret) == 0 {
+		opts.SessionSecret = make([]byte, 32)
+		if _, err := rand.Read(opts.SessionSecret); err != nil {
+			panic(err)
+		}
+	}
+	s := &Server{
+		svcDrive:  svcDrive,
+		svcDocs:   svcDocs,
+		svcSheets: svcSheets,
+		sched:     sched,
+		db:        db,
+		opts:      opts,
+		hub:       newStatusHub(),
+		mux:       http.NewServeMux(),
+	}
+	s.registerJobs()
+
+	s.mux.Handle("/metrics", promhttp.Handler())
+	s.mux.HandleFunc("/healthz", s.healthz)
+	s.mux.HandleFunc("/readyz", s.readyz)
+	s.mux.HandleFunc("/tests/", s.tests)
+	s.mux.HandleFunc("/oidc/callback", s.oidcCallback)
+	s.mux.Handle("/admin/", s.requireAdmin(http.HandlerFunc(s.admin)))
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// tests serves
+//
+//	GET  /tests/<configDocId>
+//	POST /tests/<configDocId>/code
+//	POST /tests/<configDocId>/verify
+//	GET  /tests/<configDocId>/login
+//	POST /tests/<configDocId>/start
+//	GET  /tests/<configDocId>/test
+//	GET  /tests/<configDocId>/events
+//	POST /tests/<configDocId>/submit
+//
+// Start and submit require a session verified with a one-time code. If
+// sign in with Google is configured, start also requires the candidate to
+// have signed in. Start is only accepted from the consent form of the
+// landing page.
+func (s *Server) tests(w http.ResponseWriter, r *http.Request) {
+	configDocId, action := splitPath(strings.TrimPrefix(r.URL.Path, "/tests/"))
+	if configDocId == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		s.landing(w, r, configDocId)
+	case action == "code" && r.Method == http.MethodPost:
+		s.code(w, r, configDocId)
+	case action == "verify" && r.Method == http.MethodPost:
+		s.verify(w, r, configDocId)
+	case action == "login" && r.Method == http.MethodGet:
+		s.login(w, r, configDocId)
+	case action == "test" && r.Method == http.MethodGet:
+		s.countdown(w, r, configDocId)
+	case action == "events" && r.Method == http.MethodGet:
+		s.events(w, r, configDocId)
+	case action == "start" && r.Method == http.MethodPost:
+		sess, status, err := s.checkStart(r, configDocId)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		email := sess.Email
+		ans, started, err := s.Start(configDocId, StartRequest{
+			Email:       email,
+			Account:     sess.Account,
+			TimeZone:    r.PostFormValue("tz"),
+			ConsentedAt: time.Now(),
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if started {
+			testStartsTotal.Inc()
+			if err := s.fillPool(configDocId, true); err != nil {
+				log.Printf("failed to schedule pool fill for test %s: %v", configDocId, err)
+			}
+			if err := s.ensureReconcile(configDocId); err != nil {
+				log.Printf("failed to schedule reconcile of test %s: %v", configDocId, err)
+			}
+			s.hub.notify(jobKey(configDocId, email), "")
+			s.emit(WebhookEventStarted, configDocId, *ans, "")
+		}
+		http.Redirect(w, r, "/tests/"+configDocId+"/test", http.StatusSeeOther)
+	case action == "submit" && r.Method == http.MethodPost:
+		sess, ok := s.session(r, configDocId)
+		if !ok {
+			http.Error(w, "verify your email before submitting the test", http.StatusUnauthorized)
+			return
+		}
+		if !hmac.Equal([]byte(r.PostFormValue("csrf")), []byte(s.csrfToken(sess))) {
+			http.Error(w, "the form expired, reload the test page", http.StatusForbidden)
+			return
+		}
+		email := sess.Email
+		ans, err := s.Submit(configDocId, email)
+		if err == io.EOF {
+			http.Error(w, fmt.Sprintf("%s has not started the test yet!", email), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		testSubmissionsTotal.Inc()
+		if err := s.finishTestJobs(configDocId, *ans); err != nil {
+			log.Printf("failed to update jobs for %s in test %s: %v", email, configDocId, err)
+		}
+		s.hub.notify(jobKey(configDocId, email), TestStateSubmitted)
+		s.emit(WebhookEventSubmitted, configDocId, *ans, "")
+		http.Redirect(w, r, "/tests/"+configDocId+"/test", http.StatusSeeOther)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func splitPath(p string) (string, string) {
+	parts := strings.SplitN(strings.Trim(p, "/"), "/", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// Start starts the test for the candidate of req, unless it has already been
+// started, schedules the end of test jobs and then grants access to the doc,
+// so a failed start never leaves the candidate with access nothing revokes.
+// Starting a running test again finishes a start that failed half way. It
+// holds the lock of the test, so a repeated start, or a start racing a pause
+// or an extension, can't copy a second doc or add a second row.
+func (s *Server) Start(configDocId string, req StartRequest) (*TestAnswer, bool, error) {
+	mu := testLock(configDocId)
+	mu.Lock()
+	defer mu.Unlock()
+
+	ans, started, err := PostPage(s.svcDrive, s.svcDocs, s.svcSheets, configDocId, req)
+	if err != nil {
+		return nil, false, err
+	}
+	if !ans.SubmittedAt.IsZero() || !ans.PausedAt.IsZero() {
+		return ans, started, nil
+	}
+	jobs, err := s.sched.Lookup(jobKey(configDocId, ans.Email))
+	if err != nil {
+		return nil, false, err
+	}
+	if !hasJob(jobs, JobTypeRevoke) {
+		if err := s.scheduleTestJobs(configDocId, *ans); err != nil {
+			return nil, false, errors.Wrapf(err, "failed to schedule the end of the test of %s", ans.Email)
+		}
+	}
+	if err := s.grant(*ans); err != nil {
+		return nil, false, err
+	}
+	return ans, started, nil
+}
+
+// Submit ends the latest attempt of email before its end. The submission is
+// recorded on their row before access is revoked, so the reconcile loop does
+// not grant it again. It returns io.EOF if email has not started the test.
+func (s *Server) Submit(configDocId, email string) (*TestAnswer, error) {
+	mu := testLock(configDocId)
+	mu.Lock()
+	defer mu.Unlock()
+
+	ts, err := LoadTestSheet(s.svcSheets, configDocId)
+	if err != nil {
+		return nil, err
+	}
+	row := ts.Latest(email)
+	if row == nil {
+		return nil, io.EOF
+	}
+	ans := row.Answer
+	if now := time.Now(); ans.SubmittedAt.IsZero() && ans.EndDate.After(now) {
+		ans.SubmittedAt = OptionalTimestamp{Time: now}
+		if _, err := ts.Set(&ans); err != nil {
+			return nil, err
+		}
+		if err := ts.Flush(); err != nil {
+			return nil, err
+		}
+		if err := s.markApplied(configDocId, ans); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.revoke(ans); err != nil {
+		return nil, err
+	}
+	return &ans, nil
+}
+
+func (s *Server) revoke(ans TestAnswer) error {
+	err := gdrive.RevokePermission(s.svcDrive, ans.DocId, ans.Grantee())
+	revokesTotal.WithLabelValues(resultLabel(err)).Inc()
+	return err
+}
+
+func (s *Server) healthz(w http.ResponseWriter, _ *http.Request) {
+	if err := s.ping(); err != nil {
+		http.Error(w, "leveldb: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	_, _ = fmt.Fprintln(w, "ok")
+}
+
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	if err := s.ping(); err != nil {
+		http.Error(w, "leveldb: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	if _, err := s.svcDrive.About.Get().Fields("user").Context(ctx).Do(); err != nil {
+		http.Error(w, "google api: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	_, _ = fmt.Fprintln(w, "ok")
+}
+
+func (s *Server) ping() error {
+	if err := s.sched.Ping(); err != nil {
+		return err
+	}
+	_, err := s.db.GetProperty("leveldb.stats")
+	return err
+}
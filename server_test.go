@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+)
+
+func TestStart(t *testing.T) {
+	s, f := newFakeServer(t)
+	now := time.Now().UTC()
+	openTest(t, f, now)
+
+	// the doc is copied, but the row can't be saved
+	f.mu.Lock()
+	f.readOnly = true
+	f.mu.Unlock()
+	if _, _, err := s.Start("config", StartRequest{Email: "a@b.c", ConsentedAt: now}); err == nil {
+		t.Fatal("started without saving the row")
+	}
+	f.mu.Lock()
+	f.readOnly = false
+	docs := append([]*drive.File(nil), f.files...)
+	f.mu.Unlock()
+	for _, doc := range docs {
+		if got := f.role(doc.Id, "a@b.c"); got != "" {
+			t.Errorf("failed start granted %q on %s", got, doc.Name)
+		}
+	}
+	if due := dueJobs(t, s, "config", "a@b.c"); len(due) != 0 {
+		t.Errorf("failed start scheduled jobs %v", due)
+	}
+
+	ans, started, err := s.Start("config", StartRequest{Email: "a@b.c", ConsentedAt: now})
+	if err != nil || !started {
+		t.Fatalf("Start() = %v, %v", started, err)
+	}
+	if got := f.role(ans.DocId, "a@b.c"); got != "writer" {
+		t.Errorf("got role %q, want writer", got)
+	}
+	if due := dueJobs(t, s, "config", "a@b.c"); !due[JobTypeRevoke].Equal(ans.EndDate.Time) {
+		t.Errorf("revoke due %v, want %v", due[JobTypeRevoke], ans.EndDate)
+	}
+
+	// a start that failed after saving the row is finished by the next one
+	if err := s.cancelTestJobs("config", "a@b.c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.revoke(*ans); err != nil {
+		t.Fatal(err)
+	}
+	again, started, err := s.Start("config", StartRequest{Email: "a@b.c", ConsentedAt: now})
+	if err != nil || started || again.DocId != ans.DocId {
+		t.Fatalf("second Start() = %+v, %v, %v, want the first attempt", again, started, err)
+	}
+	if got := f.role(ans.DocId, "a@b.c"); got != "writer" {
+		t.Errorf("second start: got role %q, want writer", got)
+	}
+	// read back from the sheet, which keeps seconds
+	if due := dueJobs(t, s, "config", "a@b.c"); !due[JobTypeRevoke].Equal(ans.EndDate.Truncate(time.Second)) {
+		t.Errorf("second start: revoke due %v, want %v", due[JobTypeRevoke], ans.EndDate)
+	}
+}
@@ -0,0 +1,622 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gocarina/gocsv"
+	"github.com/pkg/errors"
+	"github.com/rs/xid"
+	gdrive "gomodules.xyz/gdrive-utils"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/sheets/v4"
+)
+
+// TestSheet is a snapshot of the test sheet of a project, read with a single
+// values.get call and indexed by row id, candidate email and doc id. The row
+// id is kept in the developer metadata of the rows the system created, so a
+// row is found again after the sheet was sorted by hand. Changes are kept in
+// memory until Flush writes them back with one values.batchUpdate call.
+type TestSheet struct {
+	svc         *sheets.Service
+	configDocId string
+	// sheetId is the id of the test sheet, or -1 if not known yet.
+	sheetId int64
+	// missing is set if the project has no test sheet yet. Flush creates it.
+	missing bool
+
+	header  []string
+	columns map[string]int
+	Rows    []*TestRow
+
+	byId    map[string]*TestRow
+	byEmail map[string][]*TestRow
+	byDocId map[string]*TestRow
+	dirty   map[*TestRow]bool
+	// cells holds changes to columns that are not part of TestAnswer
+	cells map[*TestRow]map[string]string
+}
+
+// TestRow is a row of the test sheet. Err is set if the row could not be
+// parsed, in which case Answer holds whatever could be read.
+type TestRow struct {
+	// Row is the 1-based row number in the sheet, the header is row 1. It is
+	// 0 for a row that is not written yet.
+	Row    int
+	Answer TestAnswer
+	Err    error
+	// Cells holds the raw content of every cell of the row by header.
+	Cells map[string]string
+	// DuplicateOf is the number of an earlier row holding the same test, eg,
+	// a row copied by hand. Duplicates are left out of the indexes.
+	DuplicateOf int
+
+	// metadataId is the id of the developer metadata holding the row id, or
+	// 0 if the row is not tagged yet.
+	metadataId int64
+}
+
+// rowIdKey is the key of the developer metadata holding the id of a row.
+const rowIdKey = "gdocRowId"
+
+// ErrRowDeleted is returned when saving an answer whose row was removed
+// from the test sheet.
+var ErrRowDeleted = errors.New("row was deleted from the test sheet")
+
+// memCSV is an in-memory gocsv.CSVReader and gocsv.CSVWriter.
+type memCSV struct {
+	rows [][]string
+	idx  int
+}
+
+var (
+	_ gocsv.CSVReader = &memCSV{}
+	_ gocsv.CSVWriter = &memCSV{}
+)
+
+func (m *memCSV) Read() ([]string, error) {
+	if m.idx >= len(m.rows) {
+		return nil, io.EOF
+	}
+	m.idx++
+	return m.rows[m.idx-1], nil
+}
+
+func (m *memCSV) ReadAll() ([][]string, error) {
+	rest := m.rows[m.idx:]
+	m.idx = len(m.rows)
+	return rest, nil
+}
+
+func (m *memCSV) Write(row []string) error {
+	m.rows = append(m.rows, append([]string(nil), row...))
+	return nil
+}
+
+func (m *memCSV) Flush() {}
+
+func (m *memCSV) Error() error { return nil }
+
+// cellString converts a cell returned by the Sheets api to a string. Empty
+// cells are nil, and numbers or booleans are not strings.
+func cellString(v interface{}) string {
+	switch u := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return u
+	case float64:
+		return strconv.FormatFloat(u, 'f', -1, 64)
+	default:
+		return fmt.Sprint(u)
+	}
+}
+
+// columnName returns the A1 notation name of the 0-based column i.
+func columnName(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
+
+func newTestSheet(svcSheets *sheets.Service, configDocId string) *TestSheet {
+	return &TestSheet{
+		svc:         svcSheets,
+		configDocId: configDocId,
+		sheetId:     -1,
+		columns:     map[string]int{},
+		byId:        map[string]*TestRow{},
+		byEmail:     map[string][]*TestRow{},
+		byDocId:     map[string]*TestRow{},
+		dirty:       map[*TestRow]bool{},
+		cells:       map[*TestRow]map[string]string{},
+	}
+}
+
+// isMissingSheet reports whether err is the error the Sheets api returns when
+// reading a sheet that does not exist. Other bad requests are real errors.
+func isMissingSheet(err error) bool {
+	e, ok := errors.Cause(err).(*googleapi.Error)
+	return ok && e.Code == http.StatusBadRequest && strings.Contains(e.Message, "Unable to parse range")
+}
+
+func LoadTestSheet(svcSheets *sheets.Service, configDocId string) (*TestSheet, error) {
+	ts := newTestSheet(svcSheets, configDocId)
+
+	resp, err := svcSheets.Spreadsheets.Values.Get(configDocId, ProjectTestSheet).
+		ValueRenderOption("FORMATTED_VALUE").
+		Do()
+	if isMissingSheet(err) {
+		// not migrated yet
+		ts.missing = true
+		return ts, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "failed to read sheet %s", ProjectTestSheet)
+	}
+	if len(resp.Values) == 0 {
+		return ts, nil
+	}
+	ids, err := ts.loadRowIds()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, v := range resp.Values[0] {
+		h := strings.TrimSpace(cellString(v))
+		ts.header = append(ts.header, h)
+		if _, ok := ts.columns[h]; !ok && h != "" {
+			ts.columns[h] = i
+		}
+	}
+	for i, values := range resp.Values[1:] {
+		record := make([]string, len(values))
+		empty := true
+		for j, v := range values {
+			record[j] = cellString(v)
+			empty = empty && strings.TrimSpace(record[j]) == ""
+		}
+		if empty {
+			continue
+		}
+		row := &TestRow{Row: i + 2, Cells: map[string]string{}}
+		for j, v := range record {
+			if j < len(ts.header) && ts.header[j] != "" {
+				row.Cells[ts.header[j]] = v
+			}
+		}
+		row.Answer, row.Err = parseTestAnswer(ts.header, record)
+		if md, ok := ids[row.Row]; ok {
+			row.Answer.Id = md.MetadataValue
+			row.metadataId = md.MetadataId
+		}
+		ts.Rows = append(ts.Rows, row)
+		ts.index(row)
+	}
+	return ts, nil
+}
+
+// loadRowIds returns the row id metadata of the test sheet by row number.
+func (ts *TestSheet) loadRowIds() (map[int]*sheets.DeveloperMetadata, error) {
+	resp, err := ts.svc.Spreadsheets.DeveloperMetadata.Search(ts.configDocId, &sheets.SearchDeveloperMetadataRequest{
+		DataFilters: []*sheets.DataFilter{
+			{A1Range: ProjectTestSheet},
+		},
+	}).Do()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read the row ids of sheet %s", ProjectTestSheet)
+	}
+	ids := map[int]*sheets.DeveloperMetadata{}
+	for _, m := range resp.MatchedDeveloperMetadata {
+		md := m.DeveloperMetadata
+		if md.MetadataKey != rowIdKey || md.Location == nil || md.Location.DimensionRange == nil {
+			continue
+		}
+		ts.sheetId = md.Location.DimensionRange.SheetId
+		ids[int(md.Location.DimensionRange.StartIndex)+1] = md
+	}
+	return ids, nil
+}
+
+// parseTestAnswer decodes a row of the test sheet. A cell that can't be
+// parsed, eg, an empty date, is skipped and reported in the returned error, so
+// one bad cell does not hide the rest of the row.
+func parseTestAnswer(header, record []string) (TestAnswer, error) {
+	header = append([]string(nil), header...)
+	record = append([]string(nil), record...)
+	if len(record) > len(header) {
+		record = record[:len(header)]
+	}
+
+	var errs []string
+	for {
+		var answers []*TestAnswer
+		err := gocsv.UnmarshalCSV(&memCSV{rows: [][]string{header, record}}, &answers)
+		if err == nil {
+			ans := *answers[0]
+			normalizeTestAnswer(&ans)
+			if len(errs) > 0 {
+				return ans, errors.New(strings.Join(errs, "; "))
+			}
+			return ans, nil
+		}
+		pe, ok := err.(*csv.ParseError)
+		if !ok || pe.Column < 1 || pe.Column > len(record) {
+			return TestAnswer{}, err
+		}
+		col := pe.Column - 1
+		errs = append(errs, fmt.Sprintf("invalid %s %q: %v", header[col], record[col], pe.Err))
+		header = append(header[:col], header[col+1:]...)
+		record = append(record[:col], record[col+1:]...)
+	}
+}
+
+func normalizeTestAnswer(ans *TestAnswer) {
+	if ans.Attempt == 0 {
+		// rows written before attempts were tracked
+		ans.Attempt = 1
+	}
+}
+
+func (ts *TestSheet) index(row *TestRow) {
+	if dup := ts.duplicateOf(row); dup != nil {
+		row.DuplicateOf = dup.Row
+		return
+	}
+	if id := row.Answer.Id; id != "" {
+		ts.byId[id] = row
+	}
+	if email := normalizeEmail(row.Answer.Email); email != "" {
+		ts.byEmail[email] = append(ts.byEmail[email], row)
+	}
+	if docId := row.Answer.DocId; docId != "" {
+		ts.byDocId[docId] = row
+	}
+}
+
+// duplicateOf returns the indexed row holding the same test as row, ie, with
+// the same row id, doc id, or email and attempt.
+func (ts *TestSheet) duplicateOf(row *TestRow) *TestRow {
+	ans := row.Answer
+	if dup := ts.byId[ans.Id]; ans.Id != "" && dup != nil {
+		return dup
+	}
+	if dup := ts.byDocId[ans.DocId]; ans.DocId != "" && dup != nil {
+		return dup
+	}
+	for _, dup := range ts.byEmail[normalizeEmail(ans.Email)] {
+		if ans.Email != "" && dup.Answer.Attempt == ans.Attempt {
+			return dup
+		}
+	}
+	return nil
+}
+
+// Duplicates returns the rows that hold the same test as an earlier row.
+func (ts *TestSheet) Duplicates() []*TestRow {
+	var out []*TestRow
+	for _, row := range ts.Rows {
+		if row.DuplicateOf != 0 {
+			out = append(out, row)
+		}
+	}
+	return out
+}
+
+// ById returns the row with the row id, or nil.
+func (ts *TestSheet) ById(id string) *TestRow {
+	return ts.byId[id]
+}
+
+// ByEmail returns the rows of email in sheet order. Emails are compared
+// like normalizeEmail does, since rows may be typed in by hand.
+func (ts *TestSheet) ByEmail(email string) []*TestRow {
+	return ts.byEmail[normalizeEmail(email)]
+}
+
+// Latest returns the row of the latest attempt of email, or nil.
+func (ts *TestSheet) Latest(email string) *TestRow {
+	var latest *TestRow
+	for _, row := range ts.ByEmail(email) {
+		if latest == nil || row.Answer.Attempt >= latest.Answer.Attempt {
+			latest = row
+		}
+	}
+	return latest
+}
+
+// LatestRows returns the rows of the latest attempt of every candidate in
+// sheet order.
+func (ts *TestSheet) LatestRows() []*TestRow {
+	var rows []*TestRow
+	for _, row := range ts.Rows {
+		if row.DuplicateOf == 0 && row.Answer.Email != "" && ts.Latest(row.Answer.Email) == row {
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+// ByDocId returns the row of the test taken in the doc, or nil.
+func (ts *TestSheet) ByDocId(docId string) *TestRow {
+	return ts.byDocId[docId]
+}
+
+// Set updates the row of ans, identified by its row id, and sets the row id of
+// a new answer. A new answer is added as a new row, unless a row the system
+// did not tag yet holds its doc id. ErrRowDeleted is returned if the row of
+// ans is gone. The change is written by Flush.
+func (ts *TestSheet) Set(ans *TestAnswer) (*TestRow, error) {
+	var row *TestRow
+	if ans.Id != "" {
+		row = ts.byId[ans.Id]
+		if row == nil {
+			return nil, errors.Wrapf(ErrRowDeleted, "test of %s in doc %s", ans.Email, ans.DocId)
+		}
+	} else if legacy := ts.byDocId[ans.DocId]; ans.DocId != "" && legacy != nil && legacy.Answer.Id == "" {
+		// written before rows were tagged
+		row = legacy
+	}
+	if ans.Id == "" {
+		ans.Id = xid.New().String()
+	}
+
+	if row == nil {
+		row = &TestRow{Cells: map[string]string{}, Answer: *ans}
+		ts.Rows = append(ts.Rows, row)
+		ts.index(row)
+	} else {
+		if row.Answer.DocId != ans.DocId {
+			delete(ts.byDocId, row.Answer.DocId)
+			ts.byDocId[ans.DocId] = row
+		}
+		row.Answer = *ans
+		row.Err = nil
+		ts.byId[ans.Id] = row
+	}
+	ts.dirty[row] = true
+	return row, nil
+}
+
+// SetCell sets the cell of row in a column that is not part of TestAnswer,
+// eg, a status column. The change is written by Flush.
+func (ts *TestSheet) SetCell(row *TestRow, header, value string) {
+	if ts.cells[row] == nil {
+		ts.cells[row] = map[string]string{}
+	}
+	ts.cells[row][header] = value
+	row.Cells[header] = value
+}
+
+// Flush writes the changed rows back to the sheet. Only the cells of the
+// columns of TestAnswer and the cells set with SetCell are written, so other
+// columns added by hand are preserved. Missing headers are added after the
+// existing ones, and a missing sheet is created with the headers of the
+// schema. New rows are appended one by one, so rows added at the same
+// time by another process are never overwritten, and then tagged with their
+// row id.
+func (ts *TestSheet) Flush() error {
+	if len(ts.dirty) == 0 && len(ts.cells) == 0 {
+		return nil
+	}
+
+	var data []*sheets.ValueRange
+	cell := func(row, col int, value string) {
+		data = append(data, &sheets.ValueRange{
+			Range:  fmt.Sprintf("%s!%s%d", ProjectTestSheet, columnName(col), row),
+			Values: [][]interface{}{{value}},
+		})
+	}
+	column := func(h string) int {
+		col, ok := ts.columns[h]
+		if !ok {
+			col = len(ts.header)
+			ts.header = append(ts.header, h)
+			ts.columns[h] = col
+			cell(1, col, h)
+		}
+		return col
+	}
+
+	if ts.missing {
+		headers, err := ts.create()
+		if err != nil {
+			return err
+		}
+		for _, h := range headers {
+			column(h)
+		}
+	}
+
+	var added []*TestRow
+	values := map[*TestRow]map[int]string{}
+	for row := range ts.dirty {
+		w := &memCSV{}
+		if err := gocsv.MarshalCSV([]*TestAnswer{&row.Answer}, w); err != nil {
+			return err
+		}
+		header, record := w.rows[0], w.rows[1]
+		values[row] = map[int]string{}
+		for i, h := range header {
+			values[row][column(h)] = record[i]
+		}
+		if row.Row == 0 {
+			added = append(added, row)
+		}
+	}
+	for row, cells := range ts.cells {
+		if values[row] == nil {
+			values[row] = map[int]string{}
+		}
+		headers := make([]string, 0, len(cells))
+		for h := range cells {
+			headers = append(headers, h)
+		}
+		sort.Strings(headers)
+		for _, h := range headers {
+			values[row][column(h)] = cells[h]
+		}
+	}
+	for row, cells := range values {
+		if row.Row == 0 {
+			continue
+		}
+		cols := make([]int, 0, len(cells))
+		for col := range cells {
+			cols = append(cols, col)
+		}
+		sort.Ints(cols)
+		for _, col := range cols {
+			cell(row.Row, col, cells[col])
+		}
+	}
+
+	if len(data) > 0 {
+		_, err := ts.svc.Spreadsheets.Values.BatchUpdate(ts.configDocId, &sheets.BatchUpdateValuesRequest{
+			ValueInputOption: "USER_ENTERED",
+			Data:             data,
+		}).Do()
+		if err != nil {
+			return errors.Wrapf(err, "failed to write sheet %s", ProjectTestSheet)
+		}
+	}
+	// keep the order in which rows were added
+	sort.SliceStable(added, func(i, j int) bool {
+		return rowIndex(ts.Rows, added[i]) < rowIndex(ts.Rows, added[j])
+	})
+	for _, row := range added {
+		record := make([]interface{}, len(ts.header))
+		for i := range record {
+			record[i] = values[row][i]
+		}
+		resp, err := ts.svc.Spreadsheets.Values.Append(ts.configDocId, ProjectTestSheet+"!A1", &sheets.ValueRange{
+			Values: [][]interface{}{record},
+		}).ValueInputOption("USER_ENTERED").InsertDataOption("INSERT_ROWS").Do()
+		if err != nil {
+			return errors.Wrapf(err, "failed to append to sheet %s", ProjectTestSheet)
+		}
+		if row.Row, err = rangeRow(resp.Updates.UpdatedRange); err != nil {
+			return err
+		}
+	}
+	if err := ts.tagRows(); err != nil {
+		return err
+	}
+
+	ts.dirty = map[*TestRow]bool{}
+	ts.cells = map[*TestRow]map[string]string{}
+	return nil
+}
+
+// create adds the test sheet to the project and returns the headers of its
+// schema. The headers are written by Flush with the rows.
+func (ts *TestSheet) create() ([]string, error) {
+	schema, err := ProjectSchema()
+	if err != nil {
+		return nil, err
+	}
+	si, err := gdrive.NewSpreadsheet(ts.svc, ts.configDocId)
+	if err != nil {
+		return nil, err
+	}
+	if ts.sheetId, err = si.EnsureSheet(ProjectTestSheet, nil); err != nil {
+		return nil, errors.Wrapf(err, "failed to create sheet %s", ProjectTestSheet)
+	}
+	ts.missing = false
+	for _, s := range schema {
+		if s.Name == ProjectTestSheet {
+			return s.Headers, nil
+		}
+	}
+	return nil, nil
+}
+
+// tagRows records the row id of every written row that is not tagged yet in
+// the developer metadata of the row.
+func (ts *TestSheet) tagRows() error {
+	var rows []*TestRow
+	for row := range ts.dirty {
+		if row.metadataId == 0 && row.Answer.Id != "" && row.Row > 0 {
+			rows = append(rows, row)
+		}
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	if ts.sheetId < 0 {
+		resp, err := ts.svc.Spreadsheets.Get(ts.configDocId).Fields("sheets.properties(sheetId,title)").Do()
+		if err != nil {
+			return errors.Wrapf(err, "failed to read spreadsheet %s", ts.configDocId)
+		}
+		for _, sheet := range resp.Sheets {
+			if sheet.Properties.Title == ProjectTestSheet {
+				ts.sheetId = sheet.Properties.SheetId
+			}
+		}
+		if ts.sheetId < 0 {
+			return errors.Errorf("sheet %s not found", ProjectTestSheet)
+		}
+	}
+
+	reqs := make([]*sheets.Request, 0, len(rows))
+	for _, row := range rows {
+		reqs = append(reqs, &sheets.Request{
+			CreateDeveloperMetadata: &sheets.CreateDeveloperMetadataRequest{
+				DeveloperMetadata: &sheets.DeveloperMetadata{
+					MetadataKey:   rowIdKey,
+					MetadataValue: row.Answer.Id,
+					Location: &sheets.DeveloperMetadataLocation{
+						DimensionRange: &sheets.DimensionRange{
+							SheetId:    ts.sheetId,
+							Dimension:  "ROWS",
+							StartIndex: int64(row.Row - 1),
+							EndIndex:   int64(row.Row),
+						},
+					},
+					Visibility: "DOCUMENT",
+				},
+			},
+		})
+	}
+	resp, err := ts.svc.Spreadsheets.BatchUpdate(ts.configDocId, &sheets.BatchUpdateSpreadsheetRequest{
+		Requests: reqs,
+	}).Do()
+	if err != nil {
+		return errors.Wrapf(err, "failed to tag rows of sheet %s", ProjectTestSheet)
+	}
+	for i, reply := range resp.Replies {
+		if i < len(rows) && reply.CreateDeveloperMetadata != nil && reply.CreateDeveloperMetadata.DeveloperMetadata != nil {
+			rows[i].metadataId = reply.CreateDeveloperMetadata.DeveloperMetadata.MetadataId
+		}
+	}
+	return nil
+}
+
+func rowIndex(rows []*TestRow, row *TestRow) int {
+	for i, r := range rows {
+		if r == row {
+			return i
+		}
+	}
+	return -1
+}
+
+// rangeRow returns the number of the first row of an A1 range, eg, 5 for
+// test!A5:E5.
+func rangeRow(a1 string) (int, error) {
+	cells := a1[strings.LastIndex(a1, "!")+1:]
+	if i := strings.Index(cells, ":"); i >= 0 {
+		cells = cells[:i]
+	}
+	n, err := strconv.Atoi(strings.TrimLeft(cells, "ABCDEFGHIJKLMNOPQRSTUVWXYZ$"))
+	if err != nil {
+		return 0, errors.Errorf("invalid range %q", a1)
+	}
+	return n, nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+func TestColumnName(t *testing.T) {
+	cases := map[int]string{0: "A", 25: "Z", 26: "AA", 27: "AB", 701: "ZZ", 702: "AAA"}
+	for i, want := range cases {
+		if got := columnName(i); got != want {
+			t.Errorf("columnName(%d) = %s, want %s", i, got, want)
+		}
+	}
+}
+
+func TestCellString(t *testing.T) {
+	cases := []struct {
+		in   interface{}
+		want string
+	}{
+		{nil, ""},
+		{"a@b.c", "a@b.c"},
+		{float64(3), "3"},
+		{1.5, "1.5"},
+		{true, "true"},
+	}
+	for _, c := range cases {
+		if got := cellString(c.in); got != c.want {
+			t.Errorf("cellString(%#v) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestParseTestAnswer(t *testing.T) {
+	header := []string{"Email", "Doc Id", "Start Date", "End Date", "Attempt", "Notes"}
+
+	ans, err := parseTestAnswer(header, []string{"a@b.c", "doc", "6/1/2022 10:00:00", "6/1/2022 11:30:00", "2", "anything"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := time.Date(2022, 6, 1, 11, 30, 0, 0, time.UTC)
+	if ans.Email != "a@b.c" || ans.DocId != "doc" || !ans.EndDate.Equal(want) || ans.Attempt != 2 {
+		t.Errorf("unexpected answer %+v", ans)
+	}
+
+	// trailing empty cells are not returned by the Sheets api
+	ans, err = parseTestAnswer(header, []string{"a@b.c", "doc", "6/1/2022 10:00:00", "6/1/2022 11:30:00"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ans.Attempt != 1 {
+		t.Errorf("rows without attempt must be the first attempt, got %d", ans.Attempt)
+	}
+
+	ans, err = parseTestAnswer(header, []string{"a@b.c", "doc", "", "not a date", "x"})
+	if err == nil {
+		t.Fatal("expected error for invalid cells")
+	}
+	for _, col := range []string{"Start Date", "End Date", "Attempt"} {
+		if !strings.Contains(err.Error(), col) {
+			t.Errorf("error %q does not mention %s", err, col)
+		}
+	}
+	if ans.Email != "a@b.c" || ans.DocId != "doc" {
+		t.Errorf("valid cells of a bad row were dropped: %+v", ans)
+	}
+}
+
+func TestRangeRow(t *testing.T) {
+	cases := map[string]int{"test!A5:E5": 5, "'test'!A12": 12, "test!$B$7:$C$7": 7}
+	for a1, want := range cases {
+		if got, err := rangeRow(a1); err != nil || got != want {
+			t.Errorf("rangeRow(%q) = %d, %v, want %d", a1, got, err, want)
+		}
+	}
+	if _, err := rangeRow("test!A:E"); err == nil {
+		t.Error("expected error for a range without row")
+	}
+}
+
+func TestTestSheetRowIdentity(t *testing.T) {
+	ts := newTestSheet(nil, "config")
+	add := func(n int, ans TestAnswer) *TestRow {
+		row := &TestRow{Row: n, Answer: ans, Cells: map[string]string{}}
+		ts.Rows = append(ts.Rows, row)
+		ts.index(row)
+		return row
+	}
+	tagged := add(2, TestAnswer{Id: "r1", Email: "a@b.c", DocId: "doc1", Attempt: 1})
+	legacy := add(3, TestAnswer{Email: "a@b.c", DocId: "doc2", Attempt: 2})
+	// a row copied by hand
+	dup := add(4, TestAnswer{Email: "a@b.c", DocId: "doc1", Attempt: 1})
+
+	if dup.DuplicateOf != tagged.Row {
+		t.Errorf("DuplicateOf = %d, want %d", dup.DuplicateOf, tagged.Row)
+	}
+	if got := ts.Duplicates(); len(got) != 1 || got[0] != dup {
+		t.Errorf("Duplicates() = %v", got)
+	}
+	if got := ts.ByEmail("a@b.c"); len(got) != 2 {
+		t.Errorf("duplicates must not count as attempts, got %d rows", len(got))
+	}
+
+	// found by id even after the doc id was fixed by hand
+	ans := TestAnswer{Id: "r1", Email: "a@b.c", DocId: "doc3", Attempt: 1}
+	if row, err := ts.Set(&ans); err != nil || row != tagged {
+		t.Fatalf("Set() = %v, %v, want row %d", row, err, tagged.Row)
+	}
+	if ts.ByDocId("doc3") != tagged || ts.ByDocId("doc1") != nil {
+		t.Error("doc id index not updated")
+	}
+
+	// untagged rows are matched by doc id and get an id
+	ans = TestAnswer{Email: "a@b.c", DocId: "doc2", Attempt: 2}
+	if row, err := ts.Set(&ans); err != nil || row != legacy {
+		t.Fatalf("Set() = %v, %v, want row %d", row, err, legacy.Row)
+	}
+	if ans.Id == "" || ts.ById(ans.Id) != legacy {
+		t.Errorf("legacy row not tagged, id %q", ans.Id)
+	}
+
+	ans = TestAnswer{Email: "d@e.f", DocId: "doc4", Attempt: 1}
+	row, err := ts.Set(&ans)
+	if err != nil || row.Row != 0 || ans.Id == "" {
+		t.Fatalf("Set() = %+v, %v, want a new row with an id", row, err)
+	}
+
+	ans = TestAnswer{Id: "gone", Email: "g@h.i", DocId: "doc5", Attempt: 1}
+	if _, err := ts.Set(&ans); !errors.Is(err, ErrRowDeleted) {
+		t.Errorf("Set() of a deleted row = %v, want ErrRowDeleted", err)
+	}
+}
+
+func TestIsMissingSheet(t *testing.T) {
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{&googleapi.Error{Code: http.StatusBadRequest, Message: "Unable to parse range: test"}, true},
+		{&googleapi.Error{Code: http.StatusBadRequest, Message: "Invalid value at 'value_render_option'"}, false},
+		{&googleapi.Error{Code: http.StatusNotFound, Message: "Requested entity was not found."}, false},
+		{errors.New("Unable to parse range: test"), false},
+		{nil, false},
+	}
+	for _, c := range cases {
+		if got := isMissingSheet(c.err); got != c.want {
+			t.Errorf("isMissingSheet(%v) = %v, want %v", c.err, got, c.want)
+		}
+	}
+}
+
+func TestFirstStartWithoutTestSheet(t *testing.T) {
+	s, f := newFakeServer(t)
+	now := time.Now().UTC()
+	openTest(t, f, now)
+
+	ans, started, err := s.Start("config", StartRequest{Email: "a@b.c", ConsentedAt: now})
+	if err != nil || !started {
+		t.Fatalf("Start() = %v, %v", started, err)
+	}
+	schema, err := ProjectSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := f.sheets[ProjectTestSheet].rows[0], schema[1].Headers; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got header %v, want %v", got, want)
+	}
+	if got := f.cell(ProjectTestSheet, 2, "Doc Id"); got != ans.DocId {
+		t.Errorf("got doc id %q, want %q", got, ans.DocId)
+	}
+
+	// found again by a later start
+	again, started, err := s.Start("config", StartRequest{Email: "a@b.c", ConsentedAt: now})
+	if err != nil || started || again.Id != ans.Id {
+		t.Errorf("second Start() = %+v, %v, %v, want the first attempt", again, started, err)
+	}
+}
+
+func TestTestSheetEmailCase(t *testing.T) {
+	ts := newTestSheet(nil, "config")
+	for n, ans := range []TestAnswer{
+		{Email: "Alice@Example.com", DocId: "doc1", Attempt: 1},
+		{Email: "alice@example.com", DocId: "doc2", Attempt: 2},
+		// a row copied by hand
+		{Email: "ALICE@example.com", DocId: "doc3", Attempt: 2},
+	} {
+		row := &TestRow{Row: n + 2, Answer: ans, Cells: map[string]string{}}
+		ts.Rows = append(ts.Rows, row)
+		ts.index(row)
+	}
+	if got := ts.ByEmail(" alice@EXAMPLE.com"); len(got) != 2 {
+		t.Errorf("got %d rows, want the 2 attempts", len(got))
+	}
+	if got := ts.Latest("alice@example.com"); got == nil || got.Answer.DocId != "doc2" {
+		t.Errorf("Latest() = %+v, want the second attempt", got)
+	}
+	if got := ts.Duplicates(); len(got) != 1 || got[0].Answer.DocId != "doc3" {
+		t.Errorf("Duplicates() = %v, want the copied row", got)
+	}
+}
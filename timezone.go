@@ -0,0 +1,177 @@
+package main
+
+import (
+	"strings"
+	"time"
+	_ "time/tzdata" // time zones of tests don't depend on the host's tz database
+
+	"github.com/pkg/errors"
+	csvtypes "gomodules.xyz/encoding/csv/types"
+)
+
+// LocalTimeFormat is how a LocalTime is written to a sheet.
+const LocalTimeFormat = "1/2/2006 15:04:05"
+
+// localTimeFormats are the layouts of a cell without a UTC offset, as
+// rendered by Sheets in the common locales.
+var localTimeFormats = []string{
+	LocalTimeFormat,
+	"1/2/2006 15:04",
+	"1/2/2006",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// OptionalTimestamp is a csvtypes.Timestamp that may be empty.
+type OptionalTimestamp struct {
+	time.Time
+}
+
+func (t *OptionalTimestamp) MarshalCSV() (string, error) {
+	if t.IsZero() {
+		return "", nil
+	}
+	return t.UTC().Format(csvtypes.TimestampFormat), nil
+}
+
+func (t *OptionalTimestamp) UnmarshalCSV(csv string) (err error) {
+	if strings.TrimSpace(csv) == "" {
+		t.Time = time.Time{}
+		return nil
+	}
+	t.Time, err = time.Parse(csvtypes.TimestampFormat, csv)
+	return err
+}
+
+// LocalTime is a point in time in the config sheet. A cell with a UTC offset,
+// eg, 2022-06-01T09:00:00+02:00, is used as is. A cell without one, eg,
+// 6/1/2022 09:00:00, is a wall clock time in the time zone of the test and is
+// resolved with In once the zone is known. A cell with only a date is
+// midnight of that day.
+type LocalTime struct {
+	time.Time
+	// wall is set while the time is a wall clock time without a zone.
+	wall bool
+}
+
+func (t *LocalTime) MarshalCSV() (string, error) {
+	return t.Time.Format(LocalTimeFormat), nil
+}
+
+func (t *LocalTime) UnmarshalCSV(csv string) error {
+	csv = strings.TrimSpace(csv)
+	if v, err := time.Parse(time.RFC3339, csv); err == nil {
+		t.Time, t.wall = v, false
+		return nil
+	}
+	for _, layout := range localTimeFormats {
+		if v, err := time.Parse(layout, csv); err == nil {
+			t.Time, t.wall = v, true
+			return nil
+		}
+	}
+	return errors.Errorf("invalid time %q, expected eg 6/1/2022 09:00:00 or 2022-06-01T09:00:00+02:00", csv)
+}
+
+// In resolves a wall clock time in loc, and converts any other time to loc.
+// A wall clock time skipped by a daylight saving change is moved forward by
+// the length of the change, eg, 02:30 becomes 03:30. A time that happens
+// twice is the first of the two.
+func (t LocalTime) In(loc *time.Location) LocalTime {
+	if !t.wall {
+		return LocalTime{Time: t.Time.In(loc)}
+	}
+	return LocalTime{Time: wallClockIn(t.Time, loc)}
+}
+
+// wallClockIn returns the time in loc whose wall clock reads the same as the
+// wall clock of t. time.Date leaves the choice open for the times around a
+// daylight saving change, so the UTC offsets in effect a day before and a day
+// after are tried instead.
+func wallClockIn(t time.Time, loc *time.Location) time.Time {
+	wallOf := func(t time.Time) time.Time {
+		y, mo, d := t.Date()
+		h, mi, s := t.Clock()
+		return time.Date(y, mo, d, h, mi, s, t.Nanosecond(), time.UTC)
+	}
+	wall := wallOf(t)
+
+	var first, before time.Time
+	for i, probe := range []time.Time{wall.Add(-24 * time.Hour), wall.Add(24 * time.Hour)} {
+		_, offset := probe.In(loc).Zone()
+		c := wall.Add(-time.Duration(offset) * time.Second).In(loc)
+		if i == 0 {
+			before = c
+		}
+		if wallOf(c).Equal(wall) && (first.IsZero() || c.Before(first)) {
+			first = c
+		}
+	}
+	if first.IsZero() {
+		// skipped, use the offset before the change
+		return before
+	}
+	return first
+}
+
+// loadLocation returns the time zone with the IANA name, eg, Europe/Berlin.
+// An empty name is UTC.
+func loadLocation(name string) (*time.Location, error) {
+	if name == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, errors.Errorf("unknown time zone %q, expected an IANA name like Europe/Berlin", name)
+	}
+	return loc, nil
+}
+
+// Location returns the time zone of the test.
+func (cfg QuestionConfig) Location() (*time.Location, error) {
+	return loadLocation(cfg.TimeZone)
+}
+
+// resolveTimeZone reads the start and end of the test in its time zone.
+func (cfg *QuestionConfig) resolveTimeZone() error {
+	loc, err := cfg.Location()
+	if err != nil {
+		return err
+	}
+	cfg.StartDate = cfg.StartDate.In(loc)
+	cfg.EndDate = cfg.EndDate.In(loc)
+	return nil
+}
+
+// Location returns the time zone times are shown to the candidate in. It
+// falls back to UTC for rows written before display zones were recorded.
+func (ans TestAnswer) Location() *time.Location {
+	loc, err := loadLocation(ans.TimeZone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// displayZone returns the candidate's time zone if it is a valid IANA name,
+// else the time zone of the test.
+func displayZone(cfg *QuestionConfig, tz string) string {
+	if tz != "" {
+		if _, err := loadLocation(tz); err == nil {
+			return tz
+		}
+	}
+	if cfg.TimeZone == "" {
+		return "UTC"
+	}
+	return cfg.TimeZone
+}
+
+// formatTime formats t for people in loc, eg,
+// Wed Jun 1, 2022 09:00 CEST (Europe/Berlin).
+func formatTime(t time.Time, loc *time.Location) string {
+	return t.In(loc).Format("Mon Jan 2, 2006 15:04 MST") + " (" + loc.String() + ")"
+}
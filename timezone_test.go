@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLocalTime(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		cell string
+		loc  *time.Location
+		want time.Time
+	}{
+		// wall clock times are read in the zone of the test
+		{"6/1/2022 9:00:00", berlin, time.Date(2022, 6, 1, 7, 0, 0, 0, time.UTC)},
+		{"2022-12-01 09:00", berlin, time.Date(2022, 12, 1, 8, 0, 0, 0, time.UTC)},
+		{"6/1/2022", newYork, time.Date(2022, 6, 1, 4, 0, 0, 0, time.UTC)},
+		// an explicit offset wins over the zone of the test
+		{"2022-06-01T09:00:00+05:30", berlin, time.Date(2022, 6, 1, 3, 30, 0, 0, time.UTC)},
+		// skipped by the spring forward in New York
+		{"3/13/2022 2:30:00", newYork, time.Date(2022, 3, 13, 7, 30, 0, 0, time.UTC)},
+		// happens twice in the fall back in New York, the first is used
+		{"11/6/2022 1:30:00", newYork, time.Date(2022, 11, 6, 5, 30, 0, 0, time.UTC)},
+	}
+	for _, c := range cases {
+		var lt LocalTime
+		if err := lt.UnmarshalCSV(c.cell); err != nil {
+			t.Errorf("UnmarshalCSV(%q): %v", c.cell, err)
+			continue
+		}
+		if got := lt.In(c.loc); !got.Equal(c.want) {
+			t.Errorf("%q in %s = %s, want %s", c.cell, c.loc, got.UTC(), c.want)
+		}
+	}
+
+	var lt LocalTime
+	if err := lt.UnmarshalCSV("next tuesday"); err == nil {
+		t.Error("expected error for an invalid time")
+	}
+}
+
+func TestConfigTimeZone(t *testing.T) {
+	cfg := QuestionConfig{TimeZone: "Asia/Tokyo"}
+	if err := cfg.StartDate.UnmarshalCSV("6/1/2022 10:00:00"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.EndDate.UnmarshalCSV("6/1/2022 18:00:00"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.resolveTimeZone(); err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2022, 6, 1, 1, 0, 0, 0, time.UTC); !cfg.StartDate.Equal(want) {
+		t.Errorf("StartDate = %s, want %s", cfg.StartDate.UTC(), want)
+	}
+	if got := cfg.EndDate.Sub(cfg.StartDate.Time); got != 8*time.Hour {
+		t.Errorf("window is %s, want 8h", got)
+	}
+
+	if got := displayZone(&cfg, "America/Sao_Paulo"); got != "America/Sao_Paulo" {
+		t.Errorf("displayZone() = %s, want the candidate's zone", got)
+	}
+	if got := displayZone(&cfg, "not a zone"); got != "Asia/Tokyo" {
+		t.Errorf("displayZone() = %s, want the test's zone", got)
+	}
+
+	bad := QuestionConfig{TimeZone: "Europe/Atlantis"}
+	if err := bad.resolveTimeZone(); err == nil {
+		t.Error("expected error for an unknown time zone")
+	}
+}
+
+func TestFormatTime(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := formatTime(time.Date(2022, 6, 1, 7, 0, 0, 0, time.UTC), loc)
+	if want := "Wed Jun 1, 2022 09:00 CEST (Europe/Berlin)"; got != want {
+		t.Errorf("formatTime() = %q, want %q", got, want)
+	}
+}
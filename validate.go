@@ -0,0 +1,483 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/tamalsaha/gdoc-expiring-link/scheduler"
+	csvtypes "gomodules.xyz/encoding/csv/types"
+	"google.golang.org/api/docs/v1"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/sheets/v4"
+)
+
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// AuditEventPreflight is recorded when the pre-flight check of a test finds
+// problems.
+const AuditEventPreflight = "PreflightFailed"
+
+const (
+	// preflightBefore is how long before the start of a test it is checked.
+	preflightBefore = 30 * time.Minute
+	// minFreeQuota is the free Drive storage below which a warning is given.
+	minFreeQuota = 100 << 20
+)
+
+// Placeholders are the fields filled in the candidate's copy of the template.
+var Placeholders = []string{"{{email}}", "{{start-time}}", "{{end-time}}", "{{attempt}}"}
+
+var placeholderRe = regexp.MustCompile(`{{[^{}]*}}`)
+
+type Problem struct {
+	Severity string `json:"severity"`
+	Check    string `json:"check"`
+	Message  string `json:"message"`
+}
+
+// ValidationReport lists the problems found in the setup of a test.
+// PreflightAt is when the automatic check before the start of the test runs.
+type ValidationReport struct {
+	ConfigDocId string     `json:"configDocId"`
+	Problems    []Problem  `json:"problems"`
+	PreflightAt *time.Time `json:"preflightAt,omitempty"`
+}
+
+func (r *ValidationReport) add(severity, check, format string, args ...interface{}) {
+	r.Problems = append(r.Problems, Problem{
+		Severity: severity,
+		Check:    check,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// OK reports whether the test can be opened, ie, there are no errors.
+func (r *ValidationReport) OK() bool {
+	for _, p := range r.Problems {
+		if p.Severity == SeverityError {
+			return false
+		}
+	}
+	return true
+}
+
+// Check returns the problems with the values of the config.
+func (cfg QuestionConfig) Check() []Problem {
+	r := &ValidationReport{}
+	if cfg.ConfigType != ConfigTypeQuestion {
+		r.add(SeverityError, "config", "unknown config type %q", cfg.ConfigType)
+	}
+	if cfg.QuestionTemplateDocId == "" {
+		r.add(SeverityError, "config", "missing Question Template Doc Id")
+	}
+	if _, err := cfg.Location(); err != nil {
+		r.add(SeverityError, "config", "%v", err)
+	}
+	if cfg.StartDate.IsZero() || cfg.EndDate.IsZero() {
+		r.add(SeverityError, "config", "missing Start Date or End Date")
+	} else if !cfg.EndDate.After(cfg.StartDate.Time) {
+		r.add(SeverityError, "config", "End Date %s is not after Start Date %s", cfg.EndDate.Format(time.RFC3339), cfg.StartDate.Format(time.RFC3339))
+	}
+	switch mode := cfg.TestMode(); {
+	case !mode.valid():
+		r.add(SeverityError, "config", "unknown Mode %q, expected one of %s, %s or %s", cfg.Mode, TestModeTimed, TestModeDeadline, TestModeFixedWindow)
+	case mode == TestModeTimed && cfg.Duration.Duration <= 0:
+		r.add(SeverityError, "config", "Duration must be positive, got %s", cfg.Duration.Duration)
+	case cfg.Duration.Duration < 0:
+		r.add(SeverityError, "config", "Duration must not be negative, got %s", cfg.Duration.Duration)
+	}
+	if cfg.MaxAttempts < 1 {
+		r.add(SeverityError, "config", "Max Attempts must be at least 1, got %d", cfg.MaxAttempts)
+	}
+	if cfg.RetakeCooldown.Duration < 0 {
+		r.add(SeverityError, "config", "Retake Cooldown must not be negative, got %s", cfg.RetakeCooldown.Duration)
+	}
+	if cfg.PoolSize < 0 {
+		r.add(SeverityError, "config", "Pool Size must not be negative, got %d", cfg.PoolSize)
+	}
+	for _, d := range cfg.Warnings {
+		if d <= 0 {
+			r.add(SeverityError, "config", "Countdown Warnings must be positive, got %s", d)
+		}
+	}
+	return r.Problems
+}
+
+// Validate checks that the test can be opened to candidates: the config is
+// valid, the template can be read and copied, only uses known placeholders
+// and is not shared with anyone but its owners and the server, and the
+// candidates folder can be written to. Nothing is changed. An error is returned only if the checks themselves could not be run.
+func Validate(svcDrive *drive.Service, svcDocs *docs.Service, svcSheets *sheets.Service, configDocId string) (*ValidationReport, error) {
+	r := &ValidationReport{ConfigDocId: configDocId, Problems: []Problem{}}
+
+	configCache.Invalidate(configDocId)
+	cfg, err := LoadConfig(svcSheets, configDocId)
+	if err != nil && isGoogleAPIError(err) && !isNotFound(err) {
+		return nil, err
+	} else if err != nil {
+		r.add(SeverityError, "config", "failed to load the config: %v", err)
+		return r, nil
+	}
+	r.Problems = append(r.Problems, cfg.Check()...)
+
+	if cfg.QuestionTemplateDocId != "" {
+		if err := checkTemplate(r, svcDrive, svcDocs, svcSheets, configDocId, cfg.QuestionTemplateDocId); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkCandidatesFolder(r, svcDrive, configDocId); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func checkTemplate(r *ValidationReport, svcDrive *drive.Service, svcDocs *docs.Service, svcSheets *sheets.Service, configDocId, templateDocId string) error {
+	f, err := svcDrive.Files.Get(templateDocId).Fields("id,name,mimeType,trashed,capabilities(canCopy)").Do()
+	if isNotFound(err) {
+		r.add(SeverityError, "template", "template doc %s does not exist or is not readable", templateDocId)
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, "failed to read template doc %s", templateDocId)
+	}
+	if f.MimeType != MimeTypeDocument {
+		r.add(SeverityError, "template", "template %s is a %s, not a Google Doc", f.Name, f.MimeType)
+		return nil
+	}
+	if f.Trashed {
+		r.add(SeverityError, "template", "template %s is in the trash", f.Name)
+	}
+	if f.Capabilities != nil && !f.Capabilities.CanCopy {
+		r.add(SeverityError, "template", "template %s can't be copied", f.Name)
+	}
+
+	doc, err := svcDocs.Documents.Get(templateDocId).Do()
+	if err != nil {
+		return errors.Wrapf(err, "failed to read template doc %s", templateDocId)
+	}
+	used := templatePlaceholders(doc)
+	if len(used) == 0 {
+		r.add(SeverityWarning, "placeholders", "template %s has no placeholders, candidates' copies can't be told apart", f.Name)
+	}
+	for _, p := range used {
+		if !isPlaceholder(p) {
+			r.add(SeverityWarning, "placeholders", "unknown placeholder %s is left as is in candidates' copies, known ones are %s", p, strings.Join(Placeholders, ", "))
+		}
+	}
+
+	perms, err := listPermissions(svcDrive, templateDocId)
+	if err != nil {
+		return errors.Wrapf(err, "failed to list permissions of template doc %s", templateDocId)
+	}
+	about, err := svcDrive.About.Get().Fields("user(emailAddress)").Do()
+	if err != nil {
+		return errors.Wrap(err, "failed to read the account of the server")
+	}
+	ts, err := LoadTestSheet(svcSheets, configDocId)
+	if err != nil {
+		return err
+	}
+	for _, perm := range perms {
+		switch {
+		case perm.Type == "anyone":
+			r.add(SeverityError, "sharing", "template %s is shared with anyone who has the link", f.Name)
+		case perm.Type == "domain":
+			r.add(SeverityWarning, "sharing", "template %s is shared with everyone in %s", f.Name, perm.Domain)
+		case perm.Role == "owner" || (perm.Type != "user" && perm.Type != "group"):
+		case about.User != nil && strings.EqualFold(perm.EmailAddress, about.User.EmailAddress):
+		case len(ts.ByEmail(perm.EmailAddress)) > 0:
+			r.add(SeverityError, "sharing", "template %s is shared with candidate %s", f.Name, perm.EmailAddress)
+		default:
+			// candidates may not have rows before the test opens
+			r.add(SeverityWarning, "sharing", "template %s is shared with %s, make sure they are not a candidate", f.Name, perm.EmailAddress)
+		}
+	}
+	return nil
+}
+
+// templatePlaceholders returns the distinct {{...}} fields in the body,
+// headers and footers of the doc, sorted.
+func templatePlaceholders(doc *docs.Document) []string {
+	var sb strings.Builder
+	if doc.Body != nil {
+		writeText(&sb, doc.Body.Content)
+	}
+	for _, h := range doc.Headers {
+		writeText(&sb, h.Content)
+	}
+	for _, f := range doc.Footers {
+		writeText(&sb, f.Content)
+	}
+
+	seen := map[string]bool{}
+	var out []string
+	for _, p := range placeholderRe.FindAllString(sb.String(), -1) {
+		if !seen[p] {
+			seen[p] = true
+			out = append(out, p)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+func writeText(sb *strings.Builder, content []*docs.StructuralElement) {
+	for _, el := range content {
+		switch {
+		case el.Paragraph != nil:
+			for _, pe := range el.Paragraph.Elements {
+				if pe.TextRun != nil {
+					sb.WriteString(pe.TextRun.Content)
+				}
+			}
+		case el.Table != nil:
+			for _, row := range el.Table.TableRows {
+				for _, cell := range row.TableCells {
+					writeText(sb, cell.Content)
+				}
+			}
+		case el.TableOfContents != nil:
+			writeText(sb, el.TableOfContents.Content)
+		}
+	}
+}
+
+func isPlaceholder(p string) bool {
+	for _, known := range Placeholders {
+		if p == known {
+			return true
+		}
+	}
+	return false
+}
+
+// checkCandidatesFolder checks that the docs of candidates can be added to
+// the candidates folder, or to the folder of the config doc if the candidates
+// folder is not created yet. Nothing is created, a validation is read only.
+func checkCandidatesFolder(r *ValidationReport, svcDrive *drive.Service, configDocId string) error {
+	folderId, err := FindFolderId(svcDrive, configDocId, "candidates")
+	if isForbidden(err) {
+		r.add(SeverityError, "candidates-folder", "candidates folder can't be read: %v", err)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	missing := folderId == ""
+	if missing {
+		// created by the first start
+		if folderId, err = FindParentFolderId(svcDrive, configDocId); err != nil {
+			return errors.Wrapf(err, "failed to find the folder of config doc %s", configDocId)
+		}
+	}
+	f, err := svcDrive.Files.Get(folderId).Fields("id,capabilities(canAddChildren)").Do()
+	if err != nil {
+		return errors.Wrapf(err, "failed to read folder %s", folderId)
+	}
+	switch {
+	case f.Capabilities == nil || f.Capabilities.CanAddChildren:
+	case missing:
+		r.add(SeverityError, "candidates-folder", "the candidates folder can't be created in folder %s", folderId)
+	default:
+		r.add(SeverityError, "candidates-folder", "docs can't be added to the candidates folder %s", folderId)
+	}
+
+	about, err := svcDrive.About.Get().Fields("storageQuota").Do()
+	if err != nil {
+		return errors.Wrap(err, "failed to read the storage quota")
+	}
+	if q := about.StorageQuota; q != nil && q.Limit > 0 {
+		switch free := q.Limit - q.Usage; {
+		case free <= 0:
+			r.add(SeverityError, "quota", "Drive storage is full, %d of %d bytes used", q.Usage, q.Limit)
+		case free < minFreeQuota:
+			r.add(SeverityWarning, "quota", "only %d MB of Drive storage left", free>>20)
+		}
+	}
+	return nil
+}
+
+func isGoogleAPIError(err error) bool {
+	_, ok := errors.Cause(err).(*googleapi.Error)
+	return ok
+}
+
+func isNotFound(err error) bool {
+	e, ok := errors.Cause(err).(*googleapi.Error)
+	return ok && e.Code == http.StatusNotFound
+}
+
+func isForbidden(err error) bool {
+	e, ok := errors.Cause(err).(*googleapi.Error)
+	return ok && e.Code == http.StatusForbidden
+}
+
+// schedulePreflight makes sure the test is checked shortly before it starts.
+// It returns when the check runs, or nil if the test has already started.
+func (s *Server) schedulePreflight(configDocId string, cfg *QuestionConfig) (*time.Time, error) {
+	now := time.Now()
+	if !cfg.StartDate.After(now) {
+		return nil, nil
+	}
+	at := cfg.StartDate.Add(-preflightBefore)
+	if at.Before(now) {
+		at = now
+	}
+
+	key := "preflight/" + configDocId
+	jobs, err := s.sched.Lookup(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(jobs) > 0 {
+		if jobs[0].Due.Equal(at) {
+			return &at, nil
+		}
+		// the start date may have been changed
+		err = s.sched.Reschedule(jobs[0].ID, at)
+		if err != scheduler.ErrJobNotFound {
+			return &at, err
+		}
+	}
+	return &at, s.scheduleJob(at, JobTypePreflight, key, configDocId)
+}
+
+// preflightKey holds the start date the pre-flight check of a test last ran
+// for.
+func preflightKey(configDocId string) []byte {
+	return []byte("preflight/" + configDocId)
+}
+
+// ensurePreflight schedules the pre-flight check of a test with a valid
+// config that was not checked for its start date yet, so a test is checked
+// before it starts even if nobody validated it by hand.
+func (s *Server) ensurePreflight(configDocId string, cfg *QuestionConfig) error {
+	if len(cfg.Check()) > 0 {
+		return nil
+	}
+	data, err := s.db.Get(preflightKey(configDocId), nil)
+	if err != nil && err != leveldb.ErrNotFound {
+		return err
+	}
+	if string(data) == cfg.StartDate.UTC().Format(time.RFC3339) {
+		return nil
+	}
+	_, err = s.schedulePreflight(configDocId, cfg)
+	return err
+}
+
+// prepare gets the background work of a test going before candidates start:
+// the doc pool is filled and the reconcile loop is scheduled.
+func (s *Server) prepare(configDocId string, cfg *QuestionConfig) error {
+	if cfg.PoolSize > 0 {
+		if err := s.fillPool(configDocId, false); err != nil {
+			return err
+		}
+	}
+	return s.ensureReconcile(configDocId)
+}
+
+// preflight runs the checks of a test and records the problems found in the
+// audit trail. The test is prepared if its config is valid.
+func (s *Server) preflight(configDocId string) error {
+	r, err := Validate(s.svcDrive, s.svcDocs, s.svcSheets, configDocId)
+	if err != nil {
+		return err
+	}
+	if cfg, err := LoadConfig(s.svcSheets, configDocId); err == nil && len(cfg.Check()) == 0 {
+		if err := s.db.Put(preflightKey(configDocId), []byte(cfg.StartDate.UTC().Format(time.RFC3339)), nil); err != nil {
+			return err
+		}
+		if err := s.prepare(configDocId, cfg); err != nil {
+			return err
+		}
+	}
+	if len(r.Problems) == 0 {
+		log.Printf("pre-flight check of test %s passed", configDocId)
+		return nil
+	}
+	msgs := make([]string, 0, len(r.Problems))
+	for _, p := range r.Problems {
+		msgs = append(msgs, fmt.Sprintf("%s: %s: %s", p.Severity, p.Check, p.Message))
+	}
+	log.Printf("pre-flight check of test %s found problems:\n%s", configDocId, strings.Join(msgs, "\n"))
+	return SaveAuditEvent(s.svcSheets, configDocId, AuditEvent{
+		Time:    csvtypes.Timestamp{Time: time.Now()},
+		Event:   AuditEventPreflight,
+		Details: strings.Join(msgs, "\n"),
+	})
+}
+
+// validate serves POST /admin/tests/<configDocId>/validate. The test is
+// checked right away, and again shortly before it starts. A test with a valid
+// config is prepared right away.
+func (s *Server) validate(w http.ResponseWriter, configDocId string) {
+	r, err := Validate(s.svcDrive, s.svcDocs, s.svcSheets, configDocId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if cfg, err := LoadConfig(s.svcSheets, configDocId); err == nil && len(cfg.Check()) == 0 {
+		if r.PreflightAt, err = s.schedulePreflight(configDocId, cfg); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := s.prepare(configDocId, cfg); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	writeJSON(w, r)
+}
+
+// runConfig implements
+//
+//	config validate --config-doc-id=<id>
+func runConfig(args []string) {
+	fs := flag.NewFlagSet("config", flag.ExitOnError)
+	c := adminFlags(fs)
+	configDocId := fs.String("config-doc-id", "", "Id of the spreadsheet of the test")
+	asJSON := fs.Bool("json", false, "Print the report as json")
+	action, args := subcommand(args)
+	_ = fs.Parse(args)
+
+	switch action {
+	case "validate":
+		if *configDocId == "" {
+			log.Fatal("usage: config validate --config-doc-id=<id>")
+		}
+		var r ValidationReport
+		handleError(c.Do(http.MethodPost, "tests/"+*configDocId+"/validate", nil, &r), "Error validating config")
+		if *asJSON {
+			data, _ := json.MarshalIndent(r, "", "  ")
+			fmt.Println(string(data))
+		} else {
+			for _, p := range r.Problems {
+				fmt.Printf("%s\t%s\t%s\n", p.Severity, p.Check, p.Message)
+			}
+			if len(r.Problems) == 0 {
+				fmt.Println("no problems found")
+			}
+			if r.PreflightAt != nil {
+				fmt.Printf("pre-flight check scheduled at %s\n", r.PreflightAt.Format(time.RFC3339))
+			}
+		}
+		if !r.OK() {
+			os.Exit(1)
+		}
+	default:
+		log.Fatal("usage: config validate --config-doc-id=<id>")
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tamalsaha/gdoc-expiring-link/scheduler"
+	csvtypes "gomodules.xyz/encoding/csv/types"
+	"google.golang.org/api/docs/v1"
+	"google.golang.org/api/drive/v3"
+)
+
+func TestQuestionConfigCheck(t *testing.T) {
+	start := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+	valid := QuestionConfig{
+		ConfigType:            ConfigTypeQuestion,
+		QuestionTemplateDocId: "template",
+		StartDate:             LocalTime{Time: start},
+		EndDate:               LocalTime{Time: start.AddDate(0, 0, 1)},
+		Duration:              csvtypes.Duration{Duration: time.Hour},
+		MaxAttempts:           1,
+	}
+	if problems := valid.Check(); len(problems) != 0 {
+		t.Errorf("unexpected problems %v", problems)
+	}
+
+	bad := valid
+	bad.QuestionTemplateDocId = ""
+	bad.EndDate = LocalTime{Time: start.AddDate(0, 0, -1)}
+	bad.Duration = csvtypes.Duration{}
+	bad.TimeZone = "Mars/Olympus_Mons"
+	var msgs []string
+	for _, p := range bad.Check() {
+		if p.Severity != SeverityError {
+			t.Errorf("expected an error, got %+v", p)
+		}
+		msgs = append(msgs, p.Message)
+	}
+	for _, want := range []string{"Question Template Doc Id", "End Date", "Duration", "time zone"} {
+		if !strings.Contains(strings.Join(msgs, "\n"), want) {
+			t.Errorf("problems %q do not mention %s", msgs, want)
+		}
+	}
+}
+
+func TestTemplatePlaceholders(t *testing.T) {
+	para := func(text ...string) *docs.StructuralElement {
+		p := &docs.Paragraph{}
+		for _, s := range text {
+			p.Elements = append(p.Elements, &docs.ParagraphElement{TextRun: &docs.TextRun{Content: s}})
+		}
+		return &docs.StructuralElement{Paragraph: p}
+	}
+	doc := &docs.Document{
+		Body: &docs.Body{Content: []*docs.StructuralElement{
+			para("Name: {{email}}\n"),
+			// a placeholder split over two text runs, eg, partly bold
+			para("Ends at {{end-", "time}}\n"),
+			{Table: &docs.Table{TableRows: []*docs.TableRow{{
+				TableCells: []*docs.TableCell{{Content: []*docs.StructuralElement{para("{{score}}")}}},
+			}}}},
+		}},
+		Headers: map[string]docs.Header{"h": {Content: []*docs.StructuralElement{para("{{email}}")}}},
+	}
+	want := []string{"{{email}}", "{{end-time}}", "{{score}}"}
+	if got := templatePlaceholders(doc); !reflect.DeepEqual(got, want) {
+		t.Errorf("templatePlaceholders() = %v, want %v", got, want)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	s, f := newFakeServer(t)
+	f.perms["template"] = []*drive.Permission{
+		{Id: "1", Type: "user", Role: "owner", EmailAddress: "owner@x.y"},
+		{Id: "2", Type: "user", Role: "writer", EmailAddress: fakeAccount},
+		{Id: "3", Type: "user", Role: "reader", EmailAddress: "friend@x.y"},
+		{Id: "4", Type: "group", Role: "commenter", EmailAddress: "team@x.y"},
+		{Id: "5", Type: "anyone", Role: "reader"},
+	}
+	openTest(t, f, time.Now())
+
+	r, err := Validate(s.svcDrive, s.svcDocs, s.svcSheets, "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sharing := map[string]string{}
+	for _, p := range r.Problems {
+		if p.Check == "sharing" {
+			sharing[p.Message] = p.Severity
+		}
+	}
+	want := map[string]string{
+		"template template is shared with friend@x.y, make sure they are not a candidate": SeverityWarning,
+		"template template is shared with team@x.y, make sure they are not a candidate":   SeverityWarning,
+		"template template is shared with anyone who has the link":                        SeverityError,
+	}
+	if !reflect.DeepEqual(sharing, want) {
+		t.Errorf("got sharing problems %v, want %v", sharing, want)
+	}
+	if len(f.files) != 0 {
+		t.Errorf("validation created %d files", len(f.files))
+	}
+}
+
+func TestEnsurePreflight(t *testing.T) {
+	s, f := newFakeServer(t)
+	start := time.Now().Add(2 * time.Hour).UTC().Truncate(time.Second)
+	cfg := &QuestionConfig{
+		ConfigType:            ConfigTypeQuestion,
+		QuestionTemplateDocId: "template",
+		StartDate:             LocalTime{Time: start},
+		EndDate:               LocalTime{Time: start.Add(24 * time.Hour)},
+		Duration:              csvtypes.Duration{Duration: time.Hour},
+		TimeZone:              "UTC",
+		MaxAttempts:           1,
+	}
+	f.setConfig(t, *cfg)
+	preflights := func() []*scheduler.Job {
+		jobs, err := s.sched.Lookup("preflight/config")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return jobs
+	}
+
+	if err := s.ensurePreflight("config", cfg); err != nil {
+		t.Fatal(err)
+	}
+	jobs := preflights()
+	if len(jobs) != 1 || !jobs[0].Due.Equal(start.Add(-preflightBefore)) {
+		t.Fatalf("got pre-flight jobs %v, want one due %v", jobs, start.Add(-preflightBefore))
+	}
+
+	// ran early, eg, from the admin api
+	if err := s.sched.Cancel(jobs[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.preflight("config"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ensurePreflight("config", cfg); err != nil {
+		t.Fatal(err)
+	}
+	if jobs := preflights(); len(jobs) != 0 {
+		t.Errorf("checked test scheduled again: %v", jobs)
+	}
+
+	moved := *cfg
+	moved.StartDate = LocalTime{Time: start.Add(time.Hour)}
+	if err := s.ensurePreflight("config", &moved); err != nil {
+		t.Fatal(err)
+	}
+	if jobs := preflights(); len(jobs) != 1 {
+		t.Errorf("moved start: got pre-flight jobs %v, want one", jobs)
+	}
+}
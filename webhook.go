@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/xid"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Types of the events sent to webhooks. A candidate is invited when a code to
+// start the test is emailed to them, and graded when a reviewer records the
+// grade of their test.
+const (
+	WebhookEventInvited   = "test.invited"
+	WebhookEventStarted   = "test.started"
+	WebhookEventSubmitted = "test.submitted"
+	WebhookEventExpired   = "test.expired"
+	WebhookEventPaused    = "test.paused"
+	WebhookEventResumed   = "test.resumed"
+	WebhookEventExtended  = "test.extended"
+	WebhookEventReopened  = "test.reopened"
+	WebhookEventGraded    = "test.graded"
+)
+
+var webhookEvents = []string{
+	WebhookEventInvited,
+	WebhookEventStarted,
+	WebhookEventSubmitted,
+	WebhookEventExpired,
+	WebhookEventPaused,
+	WebhookEventResumed,
+	WebhookEventExtended,
+	WebhookEventReopened,
+	WebhookEventGraded,
+}
+
+const (
+	// webhookTimeout is how long a webhook has to respond to a delivery.
+	webhookTimeout = 10 * time.Second
+	// webhookLogSize is the number of deliveries kept in the log of a webhook.
+	webhookLogSize = 200
+
+	webhookSignatureHeader = "X-Gdoc-Signature"
+	webhookTimestampHeader = "X-Gdoc-Timestamp"
+)
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// Webhook is a subscription to the events of tests.
+type Webhook struct {
+	Id  string `json:"id"`
+	URL string `json:"url"`
+	// Secret is the key deliveries are signed with. It is only returned
+	// when the webhook is created.
+	Secret string `json:"secret,omitempty"`
+	// Events are the event types sent to the webhook, every type if empty.
+	Events []string `json:"events,omitempty"`
+	// ConfigDocId limits the events to those of one test, if set.
+	ConfigDocId string    `json:"configDocId,omitempty"`
+	Created     time.Time `json:"created"`
+}
+
+func (h Webhook) wants(event WebhookEvent) bool {
+	if h.ConfigDocId != "" && h.ConfigDocId != event.ConfigDocId {
+		return false
+	}
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, e := range h.Events {
+		if e == event.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookEvent is the JSON body of a delivery.
+type WebhookEvent struct {
+	Id          string      `json:"id"`
+	Type        string      `json:"type"`
+	Time        time.Time   `json:"time"`
+	ConfigDocId string      `json:"configDocId"`
+	Email       string      `json:"email"`
+	Answer      *TestAnswer `json:"answer,omitempty"`
+	Details     string      `json:"details,omitempty"`
+}
+
+// WebhookDelivery is the payload of a webhook job.
+type WebhookDelivery struct {
+	WebhookId string       `json:"webhookId"`
+	Event     WebhookEvent `json:"event"`
+}
+
+// WebhookAttempt is an entry of the delivery log of a webhook.
+type WebhookAttempt struct {
+	EventId string        `json:"eventId"`
+	Type    string        `json:"type"`
+	Attempt int           `json:"attempt"`
+	Time    time.Time     `json:"time"`
+	Status  int           `json:"status,omitempty"`
+	Error   string        `json:"error,omitempty"`
+	Latency time.Duration `json:"latency"`
+}
+
+func webhookKey(id string) []byte {
+	return []byte("webhook/" + id)
+}
+
+func webhookLogPrefix(id string) []byte {
+	return []byte("webhook-log/" + id + "/")
+}
+
+// AddWebhook subscribes url to events. A secret is generated if it is
+// empty.
+func (s *Server) AddWebhook(h Webhook) (*Webhook, error) {
+	u, err := url.Parse(h.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.Errorf("invalid webhook url %q", h.URL)
+	}
+	for _, e := range h.Events {
+		if !knownWebhookEvent(e) {
+			return nil, errors.Errorf("unknown event %q, expected one of %s", e, strings.Join(webhookEvents, ", "))
+		}
+	}
+	if h.Secret == "" {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		h.Secret = hex.EncodeToString(b)
+	}
+	h.Id = xid.New().String()
+	h.Created = time.Now().UTC()
+	data, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	return &h, s.db.Put(webhookKey(h.Id), data, nil)
+}
+
+func knownWebhookEvent(e string) bool {
+	for _, known := range webhookEvents {
+		if e == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Webhooks returns every webhook, with their secrets.
+func (s *Server) Webhooks() ([]Webhook, error) {
+	iter := s.db.NewIterator(util.BytesPrefix(webhookKey("")), nil)
+	defer iter.Release()
+	hooks := []Webhook{}
+	for iter.Next() {
+		var h Webhook
+		if err := json.Unmarshal(iter.Value(), &h); err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, h)
+	}
+	return hooks, iter.Error()
+}
+
+func (s *Server) webhook(id string) (*Webhook, error) {
+	data, err := s.db.Get(webhookKey(id), nil)
+	if err != nil {
+		return nil, err
+	}
+	var h Webhook
+	return &h, json.Unmarshal(data, &h)
+}
+
+// RemoveWebhook drops the webhook with id and its delivery log. Pending
+// deliveries to it are dropped when they are due.
+func (s *Server) RemoveWebhook(id string) error {
+	if _, err := s.webhook(id); err != nil {
+		return err
+	}
+	batch := new(leveldb.Batch)
+	batch.Delete(webhookKey(id))
+	iter := s.db.NewIterator(util.BytesPrefix(webhookLogPrefix(id)), nil)
+	for iter.Next() {
+		batch.Delete(append([]byte(nil), iter.Key()...))
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	return s.db.Write(batch, nil)
+}
+
+// WebhookLog returns the latest deliveries to the webhook with id, newest
+// first.
+func (s *Server) WebhookLog(id string) ([]WebhookAttempt, error) {
+	iter := s.db.NewIterator(util.BytesPrefix(webhookLogPrefix(id)), nil)
+	defer iter.Release()
+	attempts := []WebhookAttempt{}
+	for ok := iter.Last(); ok; ok = iter.Prev() {
+		var a WebhookAttempt
+		if err := json.Unmarshal(iter.Value(), &a); err != nil {
+			return nil, err
+		}
+		attempts = append(attempts, a)
+	}
+	return attempts, iter.Error()
+}
+
+// logDelivery appends a to the delivery log of the webhook with id, and
+// drops the oldest entries beyond webhookLogSize.
+func (s *Server) logDelivery(id string, a WebhookAttempt) error {
+	data, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	// xids sort by time, so the log is kept in order
+	key := append(webhookLogPrefix(id), xid.New().String()...)
+	if err := s.db.Put(key, data, nil); err != nil {
+		return err
+	}
+
+	iter := s.db.NewIterator(util.BytesPrefix(webhookLogPrefix(id)), nil)
+	defer iter.Release()
+	batch := new(leveldb.Batch)
+	n := 0
+	for ok := iter.Last(); ok; ok = iter.Prev() {
+		if n++; n > webhookLogSize {
+			batch.Delete(append([]byte(nil), iter.Key()...))
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	if batch.Len() == 0 {
+		return nil
+	}
+	return s.db.Write(batch, nil)
+}
+
+// emit schedules the delivery of an event of the test of ans to every
+// webhook subscribed to it. Failures are logged, they don't fail the change
+// the event is about.
+func (s *Server) emit(eventType, configDocId string, ans TestAnswer, details string) {
+	if s.db == nil {
+		return
+	}
+	hooks, err := s.Webhooks()
+	if err != nil {
+		log.Printf("failed to load webhooks for %s of %s in test %s: %v", eventType, ans.Email, configDocId, err)
+		return
+	}
+	event := WebhookEvent{
+		Id:          xid.New().String(),
+		Type:        eventType,
+		Time:        time.Now().UTC(),
+		ConfigDocId: configDocId,
+		Email:       ans.Email,
+		Answer:      &ans,
+		Details:     details,
+	}
+	for _, h := range hooks {
+		if !h.wants(event) {
+			continue
+		}
+		if err := s.scheduleJob(time.Now(), JobTypeWebhook, "webhook/"+h.Id, WebhookDelivery{WebhookId: h.Id, Event: event}); err != nil {
+			log.Printf("failed to schedule %s delivery %s to webhook %s: %v", eventType, event.Id, h.Id, err)
+		}
+	}
+}
+
+// signWebhook returns the signature of a delivery of body at ts:
+// sha256=<hex of the HMAC-SHA256 of "<ts>.<body>" keyed with secret>.
+func signWebhook(secret, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliver posts the event of d to its webhook, and logs the attempt. An
+// error is returned if the webhook did not accept it, so the job is retried
+// with backoff by the scheduler.
+func (s *Server) deliver(d WebhookDelivery, attempt int) error {
+	h, err := s.webhook(d.WebhookId)
+	if err == leveldb.ErrNotFound {
+		// removed since the event
+		return nil
+	} else if err != nil {
+		return err
+	}
+	body, err := json.Marshal(d.Event)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	ts := strconv.FormatInt(start.Unix(), 10)
+	req, err := http.NewRequest(http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "gdoc-expiring-link")
+	req.Header.Set("X-Gdoc-Event", d.Event.Type)
+	req.Header.Set("X-Gdoc-Delivery", d.Event.Id)
+	req.Header.Set(webhookTimestampHeader, ts)
+	req.Header.Set(webhookSignatureHeader, signWebhook(h.Secret, ts, body))
+
+	a := WebhookAttempt{EventId: d.Event.Id, Type: d.Event.Type, Attempt: attempt, Time: start.UTC()}
+	resp, err := webhookClient.Do(req)
+	if err == nil {
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+		resp.Body.Close()
+		a.Status = resp.StatusCode
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			err = errors.Errorf("webhook responded %s", resp.Status)
+		}
+	}
+	a.Latency = time.Since(start)
+	if err != nil {
+		a.Error = err.Error()
+	}
+	if lerr := s.logDelivery(h.Id, a); lerr != nil {
+		log.Printf("failed to log delivery %s to webhook %s: %v", d.Event.Id, h.Id, lerr)
+	}
+	webhookDeliveriesTotal.WithLabelValues(resultLabel(err)).Inc()
+	return errors.Wrapf(err, "failed to deliver %s to webhook %s", d.Event.Id, h.Id)
+}
+
+// webhooks serves
+//
+//	GET    /admin/webhooks
+//	POST   /admin/webhooks
+//	DELETE /admin/webhooks/<id>
+//	GET    /admin/webhooks/<id>/deliveries
+func (s *Server) webhooks(w http.ResponseWriter, r *http.Request, parts []string) {
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		hooks, err := s.Webhooks()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for i := range hooks {
+			hooks[i].Secret = ""
+		}
+		writeJSON(w, hooks)
+	case len(parts) == 1 && r.Method == http.MethodPost:
+		var h Webhook
+		if err := json.NewDecoder(r.Body).Decode(&h); err != nil {
+			http.Error(w, "invalid webhook: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		created, err := s.AddWebhook(h)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, created)
+	case len(parts) == 2 && r.Method == http.MethodDelete:
+		err := s.RemoveWebhook(parts[1])
+		if err == leveldb.ErrNotFound {
+			http.Error(w, "webhook not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 3 && parts[2] == "deliveries" && r.Method == http.MethodGet:
+		attempts, err := s.WebhookLog(parts[1])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, attempts)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// runWebhooks implements
+//
+//	webhooks list
+//	webhooks add --url=<url> [--events=<type>,...] [--config-doc-id=<id>] [--secret=<secret>]
+//	webhooks remove <id>...
+//	webhooks deliveries <id>
+func runWebhooks(args []string) {
+	fs := flag.NewFlagSet("webhooks", flag.ExitOnError)
+	c := adminFlags(fs)
+	u := fs.String("url", "", "URL events are posted to")
+	events := fs.String("events", "", "Comma separated event types to send, every type if empty: "+strings.Join(webhookEvents, ", "))
+	configDocId := fs.String("config-doc-id", "", "Only send the events of this test")
+	secret := fs.String("secret", "", "Key to sign deliveries with, generated if empty")
+	action, args := subcommand(args)
+	_ = fs.Parse(args)
+
+	switch action {
+	case "list":
+		var hooks []Webhook
+		handleError(c.Do(http.MethodGet, "webhooks", nil, &hooks), "Error listing webhooks")
+		for _, h := range hooks {
+			fmt.Printf("%s\t%s\tevents=%s\ttest=%s\n", h.Id, h.URL, strings.Join(h.Events, ","), h.ConfigDocId)
+		}
+	case "add":
+		if *u == "" {
+			log.Fatal("usage: webhooks add --url=<url> [--events=<type>,...] [--config-doc-id=<id>] [--secret=<secret>]")
+		}
+		h := Webhook{URL: *u, ConfigDocId: *configDocId, Secret: *secret}
+		for _, e := range strings.Split(*events, ",") {
+			if e = strings.TrimSpace(e); e != "" {
+				h.Events = append(h.Events, e)
+			}
+		}
+		var created Webhook
+		handleError(c.Do(http.MethodPost, "webhooks", h, &created), "Error adding webhook")
+		fmt.Printf("added webhook %s, deliveries are signed with secret %s\n", created.Id, created.Secret)
+	case "remove":
+		if fs.NArg() < 1 {
+			log.Fatal("usage: webhooks remove <id>...")
+		}
+		for _, id := range fs.Args() {
+			handleError(c.Do(http.MethodDelete, "webhooks/"+id, nil, nil), "Error removing webhook "+id)
+			fmt.Printf("removed %s\n", id)
+		}
+	case "deliveries":
+		if fs.NArg() != 1 {
+			log.Fatal("usage: webhooks deliveries <id>")
+		}
+		var attempts []WebhookAttempt
+		handleError(c.Do(http.MethodGet, "webhooks/"+fs.Arg(0)+"/deliveries", nil, &attempts), "Error listing deliveries")
+		for _, a := range attempts {
+			result := strconv.Itoa(a.Status)
+			if a.Error != "" {
+				result = a.Error
+			}
+			fmt.Printf("%s\t%s\t%s\tattempt=%d\t%s\t%s\n", a.Time.Format(time.RFC3339), a.EventId, a.Type, a.Attempt, a.Latency.Round(time.Millisecond), result)
+		}
+	default:
+		log.Fatal("usage: webhooks list|add|remove|deliveries")
+	}
+}
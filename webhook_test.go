@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/tamalsaha/gdoc-expiring-link/scheduler"
+)
+
+// newTestServer returns a server with a temporary state db and scheduler,
+// which retries failed jobs right away.
+func newTestServer(t *testing.T) *Server {
+	dir := t.TempDir()
+	db, err := leveldb.OpenFile(filepath.Join(dir, "state"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	sched, err := scheduler.NewScheduler(filepath.Join(dir, "scheduler"), scheduler.Options{
+		MaxAttempts: 3,
+		Backoff:     10 * time.Millisecond,
+		MaxBackoff:  10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sched.Close() })
+	s := &Server{db: db, sched: sched}
+	s.registerJobs()
+	return s
+}
+
+// delivery is a request received by a webhook receiver.
+type delivery struct {
+	header http.Header
+	body   []byte
+}
+
+// webhookReceiver is a local webhook that fails the first fail requests.
+func webhookReceiver(t *testing.T, fail int) (*httptest.Server, <-chan delivery) {
+	var mu sync.Mutex
+	received := make(chan delivery, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		if fail > 0 {
+			fail--
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		received <- delivery{header: r.Header, body: body}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, received
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	s := newTestServer(t)
+	receiver, received := webhookReceiver(t, 1)
+	h, err := s.AddWebhook(Webhook{URL: receiver.URL, Events: []string{WebhookEventStarted}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Secret == "" {
+		t.Fatal("no secret generated")
+	}
+	other, err := s.AddWebhook(Webhook{URL: receiver.URL, ConfigDocId: "other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ans := TestAnswer{Email: "a@b.c", DocId: "doc"}
+	s.emit(WebhookEventSubmitted, "config", ans, "")
+	s.emit(WebhookEventStarted, "config", ans, "")
+
+	var d delivery
+	select {
+	case d = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no delivery received")
+	}
+	var event WebhookEvent
+	if err := json.Unmarshal(d.body, &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Type != WebhookEventStarted || event.ConfigDocId != "config" || event.Email != "a@b.c" || event.Answer.DocId != "doc" {
+		t.Errorf("got event %+v", event)
+	}
+	ts := d.header.Get(webhookTimestampHeader)
+	if got, want := d.header.Get(webhookSignatureHeader), signWebhook(h.Secret, ts, d.body); got != want {
+		t.Errorf("got signature %s, want %s", got, want)
+	}
+	if got := d.header.Get("X-Gdoc-Delivery"); got != event.Id {
+		t.Errorf("got delivery id %s, want %s", got, event.Id)
+	}
+	select {
+	case d := <-received:
+		t.Errorf("unexpected delivery %s", d.body)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	var log []WebhookAttempt
+	for deadline := time.Now().Add(5 * time.Second); len(log) < 2 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if log, err = s.WebhookLog(h.Id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(log) != 2 {
+		t.Fatalf("got %d logged attempts, want 2", len(log))
+	}
+	if log[0].Attempt != 2 || log[0].Status != http.StatusOK || log[0].Error != "" {
+		t.Errorf("latest attempt: got %+v", log[0])
+	}
+	if log[1].Attempt != 1 || log[1].Status != http.StatusServiceUnavailable || log[1].Error == "" {
+		t.Errorf("first attempt: got %+v", log[1])
+	}
+	if log, err := s.WebhookLog(other.Id); err != nil || len(log) != 0 {
+		t.Errorf("delivered to the webhook of another test: %v, %v", log, err)
+	}
+
+	if err := s.RemoveWebhook(h.Id); err != nil {
+		t.Fatal(err)
+	}
+	if log, err := s.WebhookLog(h.Id); err != nil || len(log) != 0 {
+		t.Errorf("log of removed webhook: %v, %v", log, err)
+	}
+	if err := s.deliver(WebhookDelivery{WebhookId: h.Id, Event: event}, 1); err != nil {
+		t.Errorf("delivery to a removed webhook: %v", err)
+	}
+}
+
+func TestAddWebhook(t *testing.T) {
+	s := newTestServer(t)
+	for _, h := range []Webhook{
+		{URL: "ftp://example.com"},
+		{URL: "/relative"},
+		{URL: "https://example.com", Events: []string{"test.deleted"}},
+	} {
+		if _, err := s.AddWebhook(h); err == nil {
+			t.Errorf("AddWebhook(%+v) accepted", h)
+		}
+	}
+}
+
+func TestWebhookLogSize(t *testing.T) {
+	s := newTestServer(t)
+	for i := 0; i < webhookLogSize+5; i++ {
+		if err := s.logDelivery("h", WebhookAttempt{Attempt: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	log, err := s.WebhookLog("h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(log) != webhookLogSize || log[0].Attempt != webhookLogSize+4 {
+		t.Errorf("got %d entries, newest %d", len(log), log[0].Attempt)
+	}
+}